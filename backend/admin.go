@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+)
+
+// runSetRoleCommand handles `homework set-role <username> <role> [reason]`. It is the only way to make the first admin.
+func runSetRoleCommand(dbConfig config.Database, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: set-role <username> <role> [reason]")
+	}
+
+	if err := db.InitDatabase(dbConfig, false); err != nil {
+		return fmt.Errorf("error connecting to db: %v", err)
+	}
+	defer db.CloseConnection()
+
+	user, err := db.GetUserByUsername(args[0], false)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return fmt.Errorf("there is no user called %q", args[0])
+		}
+		return err
+	}
+
+	reason := strings.Join(args[2:], " ")
+	if reason == "" {
+		reason = "set on the command line"
+	}
+
+	change, err := db.SetUserRole(user.ID.String(), args[1], "", reason)
+	if err != nil {
+		return err
+	}
+
+	logging.InfoLogger.Printf("changed the role of %s from %s to %s\n", user.Username, change.OldRole, change.NewRole)
+	return nil
+}
+
+// runRotateKeysCommand handles `homework rotate-keys`. It encrypts all moodle tokens with the current encryption key,
+// including tokens stored before encryption was set up. Afterwards old keys can be removed from the configuration.
+func runRotateKeysCommand(dbConfig config.Database, encryption config.Encryption) error {
+	if !encryption.Enabled() {
+		return fmt.Errorf("no encryption keys are configured, add them to [encryption] in config.toml first")
+	}
+
+	if err := db.InitEncryption(encryption); err != nil {
+		return fmt.Errorf("error setting up encryption: %v", err)
+	}
+
+	if err := db.InitDatabase(dbConfig, false); err != nil {
+		return fmt.Errorf("error connecting to db: %v", err)
+	}
+	defer db.CloseConnection()
+
+	rotated, err := db.RotateMoodleTokens()
+	if err != nil {
+		return err
+	}
+
+	logging.InfoLogger.Printf("encrypted %d moodle tokens with the key %s\n", rotated, encryption.CurrentKey)
+	return nil
+}
@@ -0,0 +1,302 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml"
+)
+
+// Config is the typed content of config.toml. Every field has a default, environment variables take precedence over
+// the file.
+type Config struct {
+	Debugging  bool       `toml:"debugging"`
+	LogFile    string     `toml:"log_file"`
+	Server     Server     `toml:"server"`
+	Session    Session    `toml:"session"`
+	Moodle     Moodle     `toml:"moodle"`
+	Cache      Cache      `toml:"cache"`
+	RateLimit  RateLimit  `toml:"rate_limit"`
+	Mail       Mail       `toml:"mail"`
+	OIDC       OIDC       `toml:"oidc"`
+	Encryption Encryption `toml:"encryption"`
+	Database   Database   `toml:"database"`
+}
+
+type Server struct {
+	ListenAddress string `toml:"listen_address"`
+	// AllowedOrigins are the origins allowed to make credentialed cross-origin requests. "*" allows every origin.
+	AllowedOrigins []string `toml:"allowed_origins"`
+	// FrontendURL is the address of the frontend. Links in mails point there and the browser is sent back there after
+	// logging in with an identity provider.
+	FrontendURL string `toml:"frontend_url"`
+}
+
+type Session struct {
+	// Lifetime is how long a session cookie stays valid after logging in
+	Lifetime time.Duration `toml:"lifetime"`
+}
+
+type Moodle struct {
+	// Timeout limits every request to a moodle instance
+	Timeout time.Duration `toml:"timeout"`
+	// TokenCheckInterval is how often every moodle token is checked in the background, so users find out that it
+	// expired before something fails. 0 disables the checks.
+	TokenCheckInterval time.Duration `toml:"token_check_interval"`
+	// AssignmentSyncInterval is how often the assignments of all moodle courses are imported. 0 disables the import.
+	AssignmentSyncInterval time.Duration `toml:"assignment_sync_interval"`
+}
+
+type Cache struct {
+	// MoodleCourses is how long a user's moodle courses are cached before they are fetched again
+	MoodleCourses time.Duration `toml:"moodle_courses"`
+}
+
+type RateLimit struct {
+	// Requests is how many requests one ip may make to the login, registration and account lookup routes per Window.
+	// 0 disables the limit.
+	Requests int           `toml:"requests"`
+	Window   time.Duration `toml:"window"`
+	// after LoginAttempts failed logins, an account or ip is locked out for Lockout. Every further failure doubles
+	// that, up to MaxLockout. 0 disables lockouts.
+	LoginAttempts int           `toml:"login_attempts"`
+	Lockout       time.Duration `toml:"lockout"`
+	MaxLockout    time.Duration `toml:"max_lockout"`
+}
+
+// ValidationError contains everything that is wrong with a configuration, not just the first problem
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e, "; ")
+}
+
+var current = Default()
+
+// Get returns the configuration currently in use. Until Set is called, that's Default().
+func Get() *Config {
+	return current
+}
+
+// Set replaces the configuration currently in use
+func Set(c *Config) {
+	current = c
+}
+
+// Default returns the configuration used if nothing else is configured
+func Default() *Config {
+	return &Config{
+		Debugging: false,
+		LogFile:   "logs.txt",
+		Server: Server{
+			ListenAddress:  ":8005",
+			AllowedOrigins: []string{"*"},
+			FrontendURL:    "http://localhost:3000",
+		},
+		Session: Session{
+			Lifetime: 90 * 24 * time.Hour,
+		},
+		Moodle: Moodle{
+			Timeout:                15 * time.Second,
+			TokenCheckInterval:     24 * time.Hour,
+			AssignmentSyncInterval: time.Hour,
+		},
+		Cache: Cache{
+			MoodleCourses: 7 * 24 * time.Hour,
+		},
+		RateLimit: RateLimit{
+			Requests:      30,
+			Window:        time.Minute,
+			LoginAttempts: 5,
+			Lockout:       time.Minute,
+			MaxLockout:    time.Hour,
+		},
+		Mail:       DefaultMail(),
+		OIDC:       DefaultOIDC(),
+		Encryption: DefaultEncryption(),
+		Database:   DefaultDatabase(),
+	}
+}
+
+// Load reads the config file at path. If the file doesn't exist and required is false, the defaults are used.
+func Load(path string, required bool) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return Parse("")
+		}
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	c, err := Parse(string(data))
+	if err != nil {
+		if _, ok := err.(ValidationError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	return c, nil
+}
+
+// Parse parses the content of a config file, applies environment variables and validates the result
+func Parse(data string) (*Config, error) {
+	c := Default()
+
+	tree, err := toml.Load(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// unmarshalling into the defaults keeps them for every key that isn't in the file
+	if err := tree.Unmarshal(c); err != nil {
+		return nil, err
+	}
+
+	var problems ValidationError
+	problems = append(problems, c.applyEnv()...)
+	problems = append(problems, c.validate()...)
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return c, nil
+}
+
+// applyEnv overrides fields with environment variables and returns problems parsing them
+func (c *Config) applyEnv() []string {
+	var problems []string
+
+	if value, ok := os.LookupEnv("HW_DEBUGGING"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("HW_DEBUGGING is not a valid boolean: %q", value))
+		} else {
+			c.Debugging = parsed
+		}
+	}
+
+	if value, ok := os.LookupEnv("HW_LOG_FILE"); ok {
+		c.LogFile = value
+	}
+
+	if value, ok := os.LookupEnv("HW_LISTEN_ADDRESS"); ok {
+		c.Server.ListenAddress = value
+	}
+
+	if value, ok := os.LookupEnv("HW_FRONTEND_URL"); ok {
+		c.Server.FrontendURL = value
+	}
+
+	if value, ok := os.LookupEnv("HW_ALLOWED_ORIGINS"); ok {
+		c.Server.AllowedOrigins = nil
+		for _, origin := range strings.Split(value, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.Server.AllowedOrigins = append(c.Server.AllowedOrigins, origin)
+			}
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"HW_SESSION_LIFETIME":                &c.Session.Lifetime,
+		"HW_MOODLE_TIMEOUT":                  &c.Moodle.Timeout,
+		"HW_MOODLE_TOKEN_CHECK_INTERVAL":     &c.Moodle.TokenCheckInterval,
+		"HW_MOODLE_ASSIGNMENT_SYNC_INTERVAL": &c.Moodle.AssignmentSyncInterval,
+		"HW_CACHE_MOODLE_COURSES":            &c.Cache.MoodleCourses,
+		"HW_RATE_LIMIT_WINDOW":               &c.RateLimit.Window,
+	}
+	for key, field := range durations {
+		if value, ok := os.LookupEnv(key); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s is not a valid duration: %q", key, value))
+				continue
+			}
+			*field = parsed
+		}
+	}
+
+	ints := map[string]*int{
+		"HW_RATE_LIMIT_REQUESTS":       &c.RateLimit.Requests,
+		"HW_RATE_LIMIT_LOGIN_ATTEMPTS": &c.RateLimit.LoginAttempts,
+	}
+	for key, field := range ints {
+		if value, ok := os.LookupEnv(key); ok {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s is not a valid integer: %q", key, value))
+				continue
+			}
+			*field = parsed
+		}
+	}
+
+	problems = append(problems, c.Mail.applyEnv()...)
+	problems = append(problems, c.OIDC.applyEnv()...)
+	problems = append(problems, c.Encryption.applyEnv()...)
+	problems = append(problems, c.Database.applyEnv()...)
+
+	return problems
+}
+
+func (c *Config) validate() []string {
+	var problems []string
+
+	if c.Server.ListenAddress == "" {
+		problems = append(problems, "server listen_address must not be empty")
+	}
+	if !absoluteURL(c.Server.FrontendURL) {
+		problems = append(problems, fmt.Sprintf("server frontend_url %q is not an absolute url", c.Server.FrontendURL))
+	}
+	if c.Session.Lifetime <= 0 {
+		problems = append(problems, "session lifetime must be positive")
+	}
+	if c.Moodle.Timeout <= 0 {
+		problems = append(problems, "moodle timeout must be positive")
+	}
+	if c.Moodle.TokenCheckInterval < 0 {
+		problems = append(problems, "moodle token_check_interval must not be negative (0 disables the checks)")
+	}
+	if c.Moodle.AssignmentSyncInterval < 0 {
+		problems = append(problems, "moodle assignment_sync_interval must not be negative (0 disables the import)")
+	}
+	if c.Cache.MoodleCourses < 0 {
+		problems = append(problems, "cache moodle_courses must not be negative")
+	}
+
+	if c.RateLimit.Requests < 0 {
+		problems = append(problems, "rate_limit requests must not be negative (0 disables the limit)")
+	}
+	if c.RateLimit.Requests > 0 && c.RateLimit.Window <= 0 {
+		problems = append(problems, "rate_limit window must be positive")
+	}
+	if c.RateLimit.LoginAttempts < 0 {
+		problems = append(problems, "rate_limit login_attempts must not be negative (0 disables lockouts)")
+	}
+	if c.RateLimit.LoginAttempts > 0 && (c.RateLimit.Lockout <= 0 || c.RateLimit.MaxLockout < c.RateLimit.Lockout) {
+		problems = append(problems, "rate_limit lockout must be positive and not larger than max_lockout")
+	}
+
+	problems = append(problems, c.Mail.validate()...)
+	problems = append(problems, c.OIDC.validate()...)
+	problems = append(problems, c.Encryption.validate()...)
+	problems = append(problems, c.Database.validate()...)
+
+	return problems
+}
+
+// OriginAllowed returns true if cross-origin requests from origin may be answered
+func (s Server) OriginAllowed(origin string) bool {
+	for _, allowed := range s.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,282 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// most tests don't care about encryption, without keys it has to be allowed to run without
+	_ = os.Setenv("HW_ENCRYPTION_ALLOW_PLAINTEXT", "true")
+	os.Exit(m.Run())
+}
+
+func TestParseDefaults(t *testing.T) {
+	c, err := Parse("")
+	if err != nil {
+		t.Fatalf("error loading defaults: %v", err)
+	}
+
+	if c.Server.ListenAddress != ":8005" || c.Session.Lifetime != 90*24*time.Hour {
+		t.Errorf("unexpected defaults: %+v", c)
+	}
+
+	d := c.Database
+	if d.Host != "localhost" || d.Port != 5432 || d.SSLMode != "disable" {
+		t.Errorf("unexpected database defaults: %+v", d)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load("does-not-exist.toml", false); err != nil {
+		t.Errorf("a missing optional config file should fall back to the defaults, got %v", err)
+	}
+
+	if _, err := Load("does-not-exist.toml", true); err == nil {
+		t.Errorf("a missing required config file should be an error")
+	}
+}
+
+func TestParseServerSettings(t *testing.T) {
+	setenv(t, "HW_ALLOWED_ORIGINS", "https://hausis.3nt3.de, http://localhost:3000")
+
+	c, err := Parse(`
+debugging = true
+
+[server]
+listen_address = "127.0.0.1:9000"
+allowed_origins = ["https://example.com"]
+frontend_url = "https://hausis.3nt3.de"
+
+[session]
+lifetime = "24h"
+`)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+
+	if !c.Debugging || c.Server.ListenAddress != "127.0.0.1:9000" || c.Server.FrontendURL != "https://hausis.3nt3.de" || c.Session.Lifetime != 24*time.Hour {
+		t.Errorf("values from the file were not applied: %+v", c)
+	}
+
+	if c.Server.OriginAllowed("https://example.com") || !c.Server.OriginAllowed("http://localhost:3000") {
+		t.Errorf("HW_ALLOWED_ORIGINS should replace the allowed origins from the file, got %v", c.Server.AllowedOrigins)
+	}
+}
+
+func TestParseDatabaseFromFileAndEnv(t *testing.T) {
+	setenv(t, "DB_HOST", "staging-db")
+
+	c, err := Parse(`
+[database]
+host = "db.example.com"
+port = 6543
+sslmode = "require"
+max_open_conns = 10
+conn_max_lifetime = "5m"
+`)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+
+	d := c.Database
+
+	if d.Host != "staging-db" {
+		t.Errorf("DB_HOST should override the file, got host %q", d.Host)
+	}
+	if d.Port != 6543 || d.SSLMode != "require" || d.MaxOpenConns != 10 || d.ConnMaxLifetime != 5*time.Minute {
+		t.Errorf("values from the file were not applied: %+v", d)
+	}
+	if d.User != "homework" {
+		t.Errorf("defaults for missing keys should be kept, got user %q", d.User)
+	}
+}
+
+func TestParseValidation(t *testing.T) {
+	setenv(t, "DB_MAX_OPEN_CONNS", "lots")
+
+	_, err := Parse(`
+[session]
+lifetime = "-1h"
+
+[database]
+port = 0
+sslmode = "sometimes"
+max_open_conns = 2
+max_idle_conns = 5
+`)
+	problems, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+
+	// every problem should be reported at once
+	for _, expected := range []string{"session lifetime", "DB_MAX_OPEN_CONNS", "port", "sslmode", "max_idle_conns"} {
+		if !strings.Contains(problems.Error(), expected) {
+			t.Errorf("expected a problem mentioning %s, got %v", expected, problems)
+		}
+	}
+}
+
+func TestParseMail(t *testing.T) {
+	setenv(t, "SMTP_PASSWORD", "hunter22")
+
+	c, err := Parse(`
+[mail]
+sender = "smtp"
+
+[mail.smtp]
+host = "smtp.example.com"
+`)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+
+	m := c.Mail
+	if m.Sender != "smtp" || m.SMTP.Host != "smtp.example.com" || m.SMTP.Password != "hunter22" {
+		t.Errorf("values from the file and environment were not applied: %+v", m)
+	}
+	if m.SMTP.Port != 587 || m.ResetPasswordTokenLifetime != time.Hour {
+		t.Errorf("defaults for missing keys should be kept: %+v", m)
+	}
+
+	_, err = Parse(`
+[mail]
+sender = "smtp"
+`)
+	if err == nil || !strings.Contains(err.Error(), "smtp host") {
+		t.Errorf("sending with smtp without a host should be a validation error, got %v", err)
+	}
+}
+
+func TestParseOIDC(t *testing.T) {
+	setenv(t, "HW_OIDC_SCHOOL_IDP_CLIENT_SECRET", "hunter22")
+
+	c, err := Parse(`
+[oidc]
+redirect_base_url = "https://api.hausis.3nt3.de"
+
+[[oidc.providers]]
+name = "school-idp"
+display_name = "School"
+issuer = "https://idp.example.com"
+client_id = "homework"
+link_by_email = true
+`)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+
+	o := c.OIDC
+	if len(o.Providers) != 1 || o.Providers[0].ClientSecret != "hunter22" || !o.Providers[0].LinkByEmail {
+		t.Errorf("values from the file and environment were not applied: %+v", o)
+	}
+	if o.StateLifetime != 10*time.Minute {
+		t.Errorf("defaults for missing keys should be kept: %+v", o)
+	}
+
+	_, err = Parse(`
+[[oidc.providers]]
+name = "School IdP"
+issuer = "idp.example.com"
+
+[[oidc.providers]]
+name = "school"
+issuer = "https://idp.example.com"
+client_id = "homework"
+
+[[oidc.providers]]
+name = "school"
+`)
+	problems, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	for _, expected := range []string{"may only contain", "more than once", "issuer", "client_id"} {
+		if !strings.Contains(problems.Error(), expected) {
+			t.Errorf("expected a problem mentioning %s, got %v", expected, problems)
+		}
+	}
+}
+
+func TestParseEncryption(t *testing.T) {
+	setenv(t, "HW_ENCRYPTION_CURRENT_KEY", "2026")
+
+	c, err := Parse(`
+[encryption]
+current_key = "2025"
+
+[encryption.keys]
+2025 = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+2026 = "HxweHRwbGhkYFxYVFBMSERAPDg0MCwoJCAcGBQQDAgE="
+`)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+
+	e := c.Encryption
+	if !e.Enabled() || e.CurrentKey != "2026" || len(e.DecodedKeys()["2025"]) != 32 {
+		t.Errorf("values from the file and environment were not applied: %+v", e)
+	}
+
+	_, err = Parse(`
+[encryption]
+current_key = "missing"
+
+[encryption.keys]
+"bad id" = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+short = "AAECAw=="
+`)
+	problems, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError, got %v", err)
+	}
+	for _, expected := range []string{"may only contain", "32 bytes", "not one of the keys"} {
+		if !strings.Contains(problems.Error(), expected) {
+			t.Errorf("expected a problem mentioning %s, got %v", expected, problems)
+		}
+	}
+}
+
+func TestEncryptionKeysRequired(t *testing.T) {
+	setenv(t, "HW_ENCRYPTION_ALLOW_PLAINTEXT", "false")
+
+	if _, err := Parse(""); err == nil || !strings.Contains(err.Error(), "encryption keys are required") {
+		t.Errorf("running without encryption keys should be a validation error, got %v", err)
+	}
+
+	_ = os.Unsetenv("HW_ENCRYPTION_ALLOW_PLAINTEXT")
+	if _, err := Parse("[encryption]\nallow_plaintext = true\n"); err != nil {
+		t.Errorf("running without encryption keys should be possible with allow_plaintext, got %v", err)
+	}
+}
+
+func TestConnectionStringQuoting(t *testing.T) {
+	d := DefaultDatabase()
+	d.Password = `it's a \secret`
+
+	expected := `password='it\'s a \\secret'`
+	if !strings.Contains(d.ConnectionString(), expected) {
+		t.Errorf("expected %s in %s", expected, d.ConnectionString())
+	}
+
+	if strings.Contains(d.String(), "secret") {
+		t.Errorf("String() leaks the password: %s", d.String())
+	}
+}
+
+// setenv sets an environment variable for the duration of the test
+func setenv(t *testing.T, key string, value string) {
+	old, existed := os.LookupEnv(key)
+	_ = os.Setenv(key, value)
+
+	t.Cleanup(func() {
+		if existed {
+			_ = os.Setenv(key, old)
+		} else {
+			_ = os.Unsetenv(key)
+		}
+	})
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Encryption configures how secrets like moodle tokens are encrypted in the database, it is the [encryption] table in
+// config.toml. Every value gets its own data key, which is encrypted with one of Keys.
+type Encryption struct {
+	// Keys are the key encryption keys by id, each 32 random bytes encoded with base64 (`openssl rand -base64 32`).
+	// Old keys have to be kept until `homework rotate-keys` re-encrypted everything with CurrentKey.
+	Keys map[string]string `toml:"keys"`
+	// CurrentKey is the id of the key new values are encrypted with
+	CurrentKey string `toml:"current_key"`
+	// AllowPlaintext allows running without Keys, secrets are stored unencrypted then. Without it, keys are required.
+	AllowPlaintext bool `toml:"allow_plaintext"`
+}
+
+var encryptionKeyID = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// DefaultEncryption returns the encryption configuration used if nothing else is configured. It has no keys, so they
+// have to be configured.
+func DefaultEncryption() Encryption {
+	return Encryption{}
+}
+
+// Enabled returns true if keys are configured
+func (e Encryption) Enabled() bool {
+	return len(e.Keys) > 0
+}
+
+// DecodedKeys returns the keys by id. Only call it on a validated configuration.
+func (e Encryption) DecodedKeys() map[string][]byte {
+	keys := make(map[string][]byte, len(e.Keys))
+	for id, key := range e.Keys {
+		keys[id], _ = base64.StdEncoding.DecodeString(key)
+	}
+
+	return keys
+}
+
+// applyEnv overrides fields with environment variables and returns problems parsing them
+func (e *Encryption) applyEnv() []string {
+	var problems []string
+
+	// HW_ENCRYPTION_KEYS="<id>:<key>,<id>:<key>" replaces all keys of the file
+	if value, ok := os.LookupEnv("HW_ENCRYPTION_KEYS"); ok {
+		e.Keys = make(map[string]string)
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+
+			parts := strings.SplitN(pair, ":", 2)
+			if len(parts) != 2 {
+				problems = append(problems, "HW_ENCRYPTION_KEYS must be a list of <id>:<key> pairs")
+				continue
+			}
+			e.Keys[parts[0]] = parts[1]
+		}
+	}
+
+	if value, ok := os.LookupEnv("HW_ENCRYPTION_CURRENT_KEY"); ok {
+		e.CurrentKey = value
+	}
+
+	if value, ok := os.LookupEnv("HW_ENCRYPTION_ALLOW_PLAINTEXT"); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("HW_ENCRYPTION_ALLOW_PLAINTEXT is not a valid boolean: %q", value))
+		} else {
+			e.AllowPlaintext = parsed
+		}
+	}
+
+	return problems
+}
+
+func (e Encryption) validate() []string {
+	var problems []string
+
+	// sorted so the problems are always reported in the same order
+	ids := make([]string, 0, len(e.Keys))
+	for id := range e.Keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if !encryptionKeyID.MatchString(id) {
+			problems = append(problems, fmt.Sprintf("encryption key id %q may only contain letters, digits, - and _", id))
+		}
+
+		key, err := base64.StdEncoding.DecodeString(e.Keys[id])
+		if err != nil || len(key) != 32 {
+			problems = append(problems, fmt.Sprintf("encryption key %q must be 32 bytes encoded with base64", id))
+		}
+	}
+
+	if len(e.Keys) > 0 {
+		if _, ok := e.Keys[e.CurrentKey]; !ok {
+			problems = append(problems, fmt.Sprintf("encryption current_key %q is not one of the keys", e.CurrentKey))
+		}
+	} else if e.CurrentKey != "" {
+		problems = append(problems, "encryption current_key is set, but there are no keys")
+	} else if !e.AllowPlaintext {
+		// moodle tokens can be used to act as their users on moodle, they must not end up in the database as they are
+		problems = append(problems, "encryption keys are required to store moodle tokens, set encryption keys or allow_plaintext")
+	}
+
+	return problems
+}
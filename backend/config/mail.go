@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mail configures how mails are sent, it is the [mail] table in config.toml
+type Mail struct {
+	// Sender is "smtp" to actually send mails or "file" to write them to Directory instead
+	Sender    string `toml:"sender"`
+	From      string `toml:"from"`
+	Directory string `toml:"directory"`
+	SMTP      SMTP   `toml:"smtp"`
+
+	// how long links to verify an email address or reset a password can be used
+	VerifyEmailTokenLifetime   time.Duration `toml:"verify_email_token_lifetime"`
+	ResetPasswordTokenLifetime time.Duration `toml:"reset_password_token_lifetime"`
+}
+
+type SMTP struct {
+	Host     string `toml:"host"`
+	Port     int    `toml:"port"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+var mailSenders = []string{"smtp", "file"}
+
+// DefaultMail returns the mail configuration used if nothing else is configured. Mails are written to files so
+// nothing is sent by accident.
+func DefaultMail() Mail {
+	return Mail{
+		Sender:    "file",
+		From:      "homework <noreply@localhost>",
+		Directory: "mails",
+		SMTP: SMTP{
+			Port: 587,
+		},
+		VerifyEmailTokenLifetime:   7 * 24 * time.Hour,
+		ResetPasswordTokenLifetime: time.Hour,
+	}
+}
+
+// applyEnv overrides fields with environment variables and returns problems parsing them
+func (m *Mail) applyEnv() []string {
+	var problems []string
+
+	setString := func(key string, field *string) {
+		if value, ok := os.LookupEnv(key); ok {
+			*field = value
+		}
+	}
+
+	setString("HW_MAIL_SENDER", &m.Sender)
+	setString("HW_MAIL_FROM", &m.From)
+	setString("HW_MAIL_DIRECTORY", &m.Directory)
+	setString("SMTP_HOST", &m.SMTP.Host)
+	setString("SMTP_USERNAME", &m.SMTP.Username)
+	setString("SMTP_PASSWORD", &m.SMTP.Password)
+
+	if value, ok := os.LookupEnv("SMTP_PORT"); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("SMTP_PORT is not a valid integer: %q", value))
+		} else {
+			m.SMTP.Port = parsed
+		}
+	}
+
+	return problems
+}
+
+func (m Mail) validate() []string {
+	var problems []string
+
+	validSender := false
+	for _, sender := range mailSenders {
+		if m.Sender == sender {
+			validSender = true
+			break
+		}
+	}
+	if !validSender {
+		problems = append(problems, fmt.Sprintf("mail sender %q is not one of %s", m.Sender, strings.Join(mailSenders, ", ")))
+	}
+
+	if m.From == "" {
+		problems = append(problems, "mail from must not be empty")
+	}
+
+	switch m.Sender {
+	case "smtp":
+		if m.SMTP.Host == "" {
+			problems = append(problems, "mail smtp host must not be empty when sending mails with smtp")
+		}
+		if m.SMTP.Port < 1 || m.SMTP.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("mail smtp port %d is out of range", m.SMTP.Port))
+		}
+	case "file":
+		if m.Directory == "" {
+			problems = append(problems, "mail directory must not be empty when writing mails to files")
+		}
+	}
+
+	if m.VerifyEmailTokenLifetime <= 0 {
+		problems = append(problems, "mail verify_email_token_lifetime must be positive")
+	}
+	if m.ResetPasswordTokenLifetime <= 0 {
+		problems = append(problems, "mail reset_password_token_lifetime must be positive")
+	}
+
+	return problems
+}
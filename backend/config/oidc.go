@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// OIDC configures login with OpenID Connect identity providers, it is the [oidc] table in config.toml. Every provider
+// is a [[oidc.providers]] table.
+type OIDC struct {
+	// RedirectBaseURL is the public address of the backend. Providers redirect back to
+	// <RedirectBaseURL>/auth/oidc/<name>/callback, that url has to be registered with them.
+	RedirectBaseURL string `toml:"redirect_base_url"`
+	// Timeout limits every request to a provider
+	Timeout time.Duration `toml:"timeout"`
+	// StateLifetime is how long a login that was started may take at the provider
+	StateLifetime time.Duration `toml:"state_lifetime"`
+
+	Providers []OIDCProvider `toml:"providers"`
+}
+
+type OIDCProvider struct {
+	// Name identifies the provider in urls and linked accounts. It must not be changed after users logged in with it.
+	Name        string `toml:"name"`
+	DisplayName string `toml:"display_name"`
+	// Issuer is the issuer url of the provider, its configuration is discovered from
+	// <Issuer>/.well-known/openid-configuration
+	Issuer       string   `toml:"issuer"`
+	ClientID     string   `toml:"client_id"`
+	ClientSecret string   `toml:"client_secret"`
+	Scopes       []string `toml:"scopes"`
+	// LinkByEmail logs users in to existing accounts with the same email address if the provider says it verified the
+	// address. Only enable this for providers that can be trusted to verify addresses.
+	LinkByEmail bool `toml:"link_by_email"`
+}
+
+var oidcProviderName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// DefaultOIDC returns the oidc configuration used if nothing else is configured. No providers are configured, so only
+// local passwords work.
+func DefaultOIDC() OIDC {
+	return OIDC{
+		RedirectBaseURL: "http://localhost:8005",
+		Timeout:         15 * time.Second,
+		StateLifetime:   10 * time.Minute,
+	}
+}
+
+// SecretEnv is the environment variable the client secret of the provider is read from, e.g.
+// HW_OIDC_SCHOOL_CLIENT_SECRET for the provider "school"
+func (p OIDCProvider) SecretEnv() string {
+	return "HW_OIDC_" + strings.ToUpper(strings.ReplaceAll(p.Name, "-", "_")) + "_CLIENT_SECRET"
+}
+
+// applyEnv overrides fields with environment variables and returns problems parsing them
+func (o *OIDC) applyEnv() []string {
+	var problems []string
+
+	if value, ok := os.LookupEnv("HW_OIDC_REDIRECT_BASE_URL"); ok {
+		o.RedirectBaseURL = value
+	}
+
+	if value, ok := os.LookupEnv("HW_OIDC_TIMEOUT"); ok {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("HW_OIDC_TIMEOUT is not a valid duration: %q", value))
+		} else {
+			o.Timeout = parsed
+		}
+	}
+
+	for i := range o.Providers {
+		if value, ok := os.LookupEnv(o.Providers[i].SecretEnv()); ok {
+			o.Providers[i].ClientSecret = value
+		}
+	}
+
+	return problems
+}
+
+func (o OIDC) validate() []string {
+	var problems []string
+
+	if o.Timeout <= 0 {
+		problems = append(problems, "oidc timeout must be positive")
+	}
+	if o.StateLifetime <= 0 {
+		problems = append(problems, "oidc state_lifetime must be positive")
+	}
+	if len(o.Providers) > 0 && !absoluteURL(o.RedirectBaseURL) {
+		problems = append(problems, fmt.Sprintf("oidc redirect_base_url %q is not an absolute url", o.RedirectBaseURL))
+	}
+
+	names := make(map[string]bool)
+	for i, p := range o.Providers {
+		if !oidcProviderName.MatchString(p.Name) {
+			problems = append(problems, fmt.Sprintf("oidc provider %d: name %q may only contain lowercase letters, digits, - and _", i+1, p.Name))
+		} else if p.Name == "moodle" {
+			problems = append(problems, `oidc provider name "moodle" is reserved for logging in with moodle`)
+		} else if names[p.Name] {
+			problems = append(problems, fmt.Sprintf("oidc provider %q is configured more than once", p.Name))
+		}
+		names[p.Name] = true
+
+		if !absoluteURL(p.Issuer) {
+			problems = append(problems, fmt.Sprintf("oidc provider %q: issuer %q is not an absolute url", p.Name, p.Issuer))
+		}
+		if p.ClientID == "" {
+			problems = append(problems, fmt.Sprintf("oidc provider %q: client_id must not be empty", p.Name))
+		}
+	}
+
+	return problems
+}
+
+func absoluteURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
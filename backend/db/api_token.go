@@ -0,0 +1,130 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/lib/pq"
+	"github.com/segmentio/ksuid"
+)
+
+const apiTokenColumns = "id, user_id, name, scopes, created_at, last_used_at"
+
+// apiTokenPrefix makes personal access tokens recognizable, e.g. for secret scanners
+const apiTokenPrefix = "hw_"
+
+// how often last_used_at is updated at most, like sessionTouchInterval
+const apiTokenTouchInterval = time.Minute
+
+// NewAPIToken creates a personal access token for the user. The returned token is the only time the token itself is
+// known, only its hash is stored.
+func NewAPIToken(userID string, name string, scopes []string) (structs.APIToken, error) {
+	secret, err := newToken()
+	if err != nil {
+		return structs.APIToken{}, err
+	}
+
+	token := structs.APIToken{
+		ID:      ksuid.New(),
+		Name:    name,
+		Token:   apiTokenPrefix + secret,
+		Scopes:  scopes,
+		Created: structs.UnixTime(time.Now()),
+	}
+	if token.UserID, err = ksuid.Parse(userID); err != nil {
+		return structs.APIToken{}, err
+	}
+
+	_, err = database.Exec("INSERT INTO api_tokens (id, user_id, name, token_hash, scopes, created_at) VALUES ($1, $2, $3, $4, $5, $6)", token.ID.String(), userID, name, hashToken(token.Token), pq.Array(scopes), token.Created.Time())
+	if err != nil {
+		return structs.APIToken{}, err
+	}
+
+	return token, nil
+}
+
+// GetAPITokens returns all personal access tokens of the user, newest first
+func GetAPITokens(userID string) ([]structs.APIToken, error) {
+	rows, err := database.Query("SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	tokens := make([]structs.APIToken, 0)
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken revokes the personal access token with the id if it belongs to the user.
+// If there is no such token, ErrNotFound is returned.
+func DeleteAPIToken(userID string, id string) error {
+	res, err := database.Exec("DELETE FROM api_tokens WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// GetUserByAPIToken returns the personal access token and the user it belongs to and records that it was used. If the
+// token doesn't exist or was revoked, ErrInvalidToken is returned.
+func GetUserByAPIToken(token string) (structs.User, structs.APIToken, error) {
+	row := database.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_hash = $1", hashToken(token))
+	if row.Err() != nil {
+		return structs.User{}, structs.APIToken{}, row.Err()
+	}
+
+	apiToken, err := scanAPIToken(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return structs.User{}, structs.APIToken{}, ErrInvalidToken
+		}
+		return structs.User{}, structs.APIToken{}, err
+	}
+
+	user, err := GetUserById(apiToken.UserID.String(), false)
+	if err != nil {
+		return structs.User{}, structs.APIToken{}, err
+	}
+
+	now := time.Now()
+	_, err = database.Exec("UPDATE api_tokens SET last_used_at = $1 WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $3)", now, apiToken.ID.String(), now.Add(-apiTokenTouchInterval))
+	if err != nil {
+		return structs.User{}, structs.APIToken{}, err
+	}
+
+	return user, apiToken, nil
+}
+
+func scanAPIToken(row rowScanner) (structs.APIToken, error) {
+	var token structs.APIToken
+	var lastUsed sql.NullTime
+	if err := row.Scan(&token.ID, &token.UserID, &token.Name, pq.Array(&token.Scopes), &token.Created, &lastUsed); err != nil {
+		return structs.APIToken{}, err
+	}
+
+	if lastUsed.Valid {
+		t := structs.UnixTime(lastUsed.Time)
+		token.LastUsed = &t
+	}
+
+	return token, nil
+}
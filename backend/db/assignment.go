@@ -1,7 +1,6 @@
 package db
 
 import (
-	"database/sql"
 	"strconv"
 	"time"
 
@@ -12,7 +11,7 @@ import (
 
 func CreateAssignment(assignment structs.Assignment) (structs.Assignment, error) {
 	id := ksuid.New()
-	_, err := database.Exec("INSERT INTO assignments (id, content, course_id, due_date, creator_id, created_at, from_moodle, done_by) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", id.String(), assignment.Title, assignment.Course, assignment.DueDate.Time(), assignment.User.ID, assignment.Created.Time(), assignment.FromMoodle, pq.Array(make([]string, 0)))
+	_, err := database.Exec("INSERT INTO assignments (id, content, course_id, due_date, creator_id, created_at, from_moodle) VALUES ($1, $2, $3, $4, $5, $6, $7)", id.String(), assignment.Title, assignment.Course, assignment.DueDate.Time(), assignment.User.ID, assignment.Created.Time(), assignment.FromMoodle)
 
 	newAssignment := assignment
 	newAssignment.UID = id
@@ -20,203 +19,297 @@ func CreateAssignment(assignment structs.Assignment) (structs.Assignment, error)
 	return newAssignment, err
 }
 
-func GetAssignmentByID(id string) (structs.Assignment, error) {
-	row := database.QueryRow("SELECT * FROM assignments WHERE id = $1", id)
+// UpsertMoodleAssignment creates the assignment imported from the moodle instance at moodleURL, or updates its title,
+// due date and course if it was imported before. It returns the id of the assignment and true if it was created.
+func UpsertMoodleAssignment(moodleURL string, moodleAssignmentID int, assignment structs.Assignment) (string, bool, error) {
+	newID := ksuid.New().String()
 
-	var a structs.Assignment
-	if row.Err() != nil {
-		return a, row.Err()
+	var id string
+	err := database.QueryRow("INSERT INTO assignments (id, content, course_id, due_date, creator_id, created_at, from_moodle, moodle_url, moodle_assignment_id) VALUES ($1, $2, $3, $4, $5, $6, true, $7, $8) ON CONFLICT (moodle_url, moodle_assignment_id) DO UPDATE SET content = EXCLUDED.content, course_id = EXCLUDED.course_id, due_date = EXCLUDED.due_date RETURNING id", newID, assignment.Title, assignment.Course, assignment.DueDate.Time(), assignment.User.ID, assignment.Created.Time(), moodleURL, moodleAssignmentID).Scan(&id)
+	if err != nil {
+		return "", false, err
 	}
 
-	var creatorID string
-	var dueDateT time.Time
+	return id, id == newID, nil
+}
 
-	err := row.Scan(&a.UID, &a.Title, &a.Course, &dueDateT, &creatorID, &a.Created, &a.FromMoodle, pq.Array(&a.DoneBy))
-	if err != nil {
-		return a, err
-	}
+// assignmentColumns are the columns scanAssignment expects, in that order. Never use SELECT * for assignments,
+// adding a column would break every query.
+const assignmentColumns = "assignments.id, assignments.content, assignments.course_id, assignments.due_date, assignments.creator_id, assignments.created_at, assignments.from_moodle, coalesce(assignments.moodle_url, '')"
+
+// scanAssignment scans a row selected with assignmentColumns. Completions and creator are not loaded, only
+// a.User.ID is set.
+func scanAssignment(row rowScanner) (structs.Assignment, error) {
+	var a structs.Assignment
+	var dueDateT time.Time
 
-	creator, err := GetUserById(creatorID, false)
+	err := row.Scan(&a.UID, &a.Title, &a.Course, &dueDateT, &a.User.ID, &a.Created, &a.FromMoodle, &a.MoodleURL)
 	if err != nil {
-		return a, err
+		return structs.Assignment{}, err
 	}
 
-	a.User = creator
 	a.DueDate = structs.UnixTime(dueDateT)
+	a.DoneBy = make([]string, 0)
+	a.DoneAt = make(map[string]structs.UnixTime)
+	a.AutoDoneBy = make([]string, 0)
 
-	a.DoneByUsers, err = getUsersFromIDs(a.DoneBy)
-
-	return a, err
+	return a, nil
 }
 
-func DeleteAssignment(id string) error {
-	_, err := database.Exec("DELETE FROM assignments WHERE id = $1", id)
-	return err
-}
-
-func GetAssignmentsByCourse(courseID int) ([]structs.Assignment, error) {
-	rows, err := database.Query("SELECT * FROM assignments WHERE course_id = $1", courseID)
-
+// queryAssignments selects assignmentColumns with the rest of the query appended (e.g. "WHERE course_id = $1") and
+// returns the scanned assignments with their completions, creators and done by users
+func queryAssignments(query string, args ...interface{}) ([]structs.Assignment, error) {
+	rows, err := database.Query("SELECT "+assignmentColumns+" FROM assignments "+query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer func() { _ = rows.Close() }()
 
 	var assignments []structs.Assignment
 	for rows.Next() {
-		var a structs.Assignment
-
-		var creatorID string
-		var dueDateT time.Time
-
-		err := rows.Scan(&a.UID, &a.Title, &a.Course, &dueDateT, &creatorID, &a.Created, &a.FromMoodle, pq.Array(&a.DoneBy))
+		a, err := scanAssignment(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		a.DueDate = structs.UnixTime(dueDateT)
+		assignments = append(assignments, a)
+	}
 
-		creator, err := GetUserById(creatorID, false)
-		a.User = creator
-		if err != nil {
-			return nil, err
-		}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
 
-		a.DoneByUsers, err = getUsersFromIDs(a.DoneBy)
-		if err != nil {
-			return nil, err
-		}
+	if err = loadCompletions(assignments); err != nil {
+		return nil, err
+	}
 
-		assignments = append(assignments, a)
+	if err = resolveAssignmentUsers(assignments); err != nil {
+		return nil, err
 	}
 
 	return assignments, nil
 }
 
-// GetAssignments returns all assignments that were created by user in the given time frame specified by maxDays.
-// If maxDays is -1, time is ignored and all assignments are returned
+// loadCompletions sets DoneBy, DoneAt and AutoDoneBy of the assignments from assignment_completions using a single
+// query. DoneBy is ordered by completion time.
+func loadCompletions(assignments []structs.Assignment) error {
+	if len(assignments) == 0 {
+		return nil
+	}
 
-// FIXME: is this intended behavior? shouldn't all assignments from the specific course be returned?
-func GetAssignments(user structs.User, maxDays int) ([]structs.Assignment, error) {
-	var rows *sql.Rows
-	var err error
-	if maxDays == -1 {
-		rows, err = database.Query("SELECT * FROM assignments WHERE creator_id = $1", user.ID.String())
-	} else {
-		rows, err = database.Query("SELECT * FROM assignments WHERE creator_id = $1 AND assignments.due_date >= NOW() - ($2 || ' days')::INTERVAL", user.ID.String(), strconv.Itoa(maxDays))
+	ids := make([]string, 0, len(assignments))
+	byID := make(map[string]*structs.Assignment)
+	for i := range assignments {
+		ids = append(ids, assignments[i].UID.String())
+		byID[assignments[i].UID.String()] = &assignments[i]
 	}
 
+	rows, err := database.Query("SELECT assignment_id, user_id, completed_at, auto_completed FROM assignment_completions WHERE assignment_id = ANY($1) ORDER BY completed_at", pq.Array(ids))
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer func() { _ = rows.Close() }()
 
-	var assignments []structs.Assignment
 	for rows.Next() {
-		var a structs.Assignment
+		var assignmentID, userID string
+		var completedAt time.Time
+		var autoCompleted bool
+		if err := rows.Scan(&assignmentID, &userID, &completedAt, &autoCompleted); err != nil {
+			return err
+		}
 
-		var creatorID string
-		var dueDateT time.Time
-		err := rows.Scan(&a.UID, &a.Title, &a.Course, &dueDateT, &creatorID, &a.Created, &a.FromMoodle, pq.Array(&a.DoneBy))
-		if err != nil {
-			return nil, err
+		a, ok := byID[assignmentID]
+		if !ok {
+			continue
 		}
+		a.DoneBy = append(a.DoneBy, userID)
+		a.DoneAt[userID] = structs.UnixTime(completedAt)
+		if autoCompleted {
+			a.AutoDoneBy = append(a.AutoDoneBy, userID)
+		}
+	}
 
-		creator, err := GetUserById(creatorID, false)
-		a.User = creator
-		a.DueDate = structs.UnixTime(dueDateT)
-		if err != nil {
-			return nil, err
+	return rows.Err()
+}
+
+// resolveAssignmentUsers replaces the creator ids and done by ids of the assignments with the actual users.
+// All users are fetched with a single query, no matter how many assignments there are.
+func resolveAssignmentUsers(assignments []structs.Assignment) error {
+	var ids []string
+	seen := make(map[string]bool)
+	addID := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
 		}
+	}
 
-		a.DoneByUsers, err = getUsersFromIDs(a.DoneBy)
-		if err != nil {
-			return nil, err
+	for _, a := range assignments {
+		addID(a.User.ID.String())
+		for _, id := range a.DoneBy {
+			addID(id)
 		}
+	}
 
-		assignments = append(assignments, a)
+	users, err := getUsersFromIDs(ids)
+	if err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	return assignments, nil
+	usersByID := make(map[string]structs.User)
+	for _, u := range users {
+		usersByID[u.ID.String()] = u
+	}
+
+	for i := range assignments {
+		a := &assignments[i]
+
+		// creators that were deleted keep their id so the assignment is still usable
+		if creator, ok := usersByID[a.User.ID.String()]; ok {
+			a.User = creator
+		}
+
+		a.DoneByUsers = make([]structs.User, 0, len(a.DoneBy))
+		for _, id := range a.DoneBy {
+			if u, ok := usersByID[id]; ok {
+				a.DoneByUsers = append(a.DoneByUsers, u)
+			}
+		}
+	}
+
+	return nil
 }
 
-// UpdateAssignment replaces the assignment with the specified id with the specified one
-func UpdateAssignment(id string, assignment structs.Assignment) error {
-	_, err := database.Exec("UPDATE assignments SET content = $1 WHERE id = $2;", assignment.Title, id)
+func GetAssignmentByID(id string) (structs.Assignment, error) {
+	assignments, err := queryAssignments("WHERE id = $1", id)
+	if err != nil {
+		return structs.Assignment{}, err
+	}
+
+	if len(assignments) == 0 {
+		return structs.Assignment{}, ErrNotFound
+	}
 
+	return assignments[0], nil
+}
+
+func DeleteAssignment(id string) error {
+	_, err := database.Exec("DELETE FROM assignments WHERE id = $1", id)
 	return err
 }
 
-func GetAllAssignments() ([]structs.Assignment, error) {
-	rows, err := database.Query("SELECT * FROM assignments")
+// GetAssignmentsByCourse returns the assignments of the course. Moodle course ids are only unique per instance, so
+// assignments imported from moodle are only returned if they come from the instance at moodleURL.
+func GetAssignmentsByCourse(moodleURL string, courseID int) ([]structs.Assignment, error) {
+	return queryAssignments("WHERE course_id = $1 AND (moodle_url IS NULL OR moodle_url = $2)", courseID, moodleURL)
+}
+
+// GetAssignmentsByCourses returns the assignments of all given courses, grouped by course id, like
+// GetAssignmentsByCourse does for one course. Use this instead of calling GetAssignmentsByCourse in a loop.
+func GetAssignmentsByCourses(moodleURL string, courseIDs []int) (map[int][]structs.Assignment, error) {
+	byCourse := make(map[int][]structs.Assignment)
+	if len(courseIDs) == 0 {
+		return byCourse, nil
+	}
+
+	ids := make([]int64, 0, len(courseIDs))
+	for _, id := range courseIDs {
+		ids = append(ids, int64(id))
+	}
+
+	assignments, err := queryAssignments("WHERE course_id = ANY($1) AND (moodle_url IS NULL OR moodle_url = $2)", pq.Array(ids), moodleURL)
 	if err != nil {
 		return nil, err
 	}
 
-	var assignments []structs.Assignment
-	for rows.Next() {
-		var a structs.Assignment
+	for _, a := range assignments {
+		byCourse[a.Course] = append(byCourse[a.Course], a)
+	}
 
-		var creatorID string
-		var dueDateT time.Time
-		err := rows.Scan(&a.UID, &a.Title, &a.Course, &dueDateT, &creatorID, &a.Created, &a.FromMoodle, pq.Array(&a.DoneBy))
-		if err != nil {
-			return nil, err
-		}
+	return byCourse, nil
+}
 
-		creator, err := GetUserById(creatorID, false)
-		a.User = creator
-		a.DueDate = structs.UnixTime(dueDateT)
-		if err != nil {
-			return nil, err
-		}
+// GetAssignments returns all assignments that were created by user in the given time frame specified by maxDays.
+// If maxDays is -1, time is ignored and all assignments are returned
 
-		a.DoneByUsers, err = getUsersFromIDs(a.DoneBy)
-		if err != nil {
-			return nil, err
-		}
+// FIXME: is this intended behavior? shouldn't all assignments from the specific course be returned?
+func GetAssignments(user structs.User, maxDays int) ([]structs.Assignment, error) {
+	if maxDays == -1 {
+		return queryAssignments("WHERE creator_id = $1", user.ID.String())
+	}
 
-		assignments = append(assignments, a)
+	return queryAssignments("WHERE creator_id = $1 AND assignments.due_date >= NOW() - ($2 || ' days')::INTERVAL", user.ID.String(), strconv.Itoa(maxDays))
+}
+
+// UpdateAssignment replaces title and due date of the assignment with the specified id with the ones of the specified one
+func UpdateAssignment(id string, assignment structs.Assignment) error {
+	_, err := database.Exec("UPDATE assignments SET content = $1, due_date = $2 WHERE id = $3;", assignment.Title, assignment.DueDate.Time(), id)
+
+	return err
+}
+
+func GetAllAssignments() ([]structs.Assignment, error) {
+	return queryAssignments("")
+}
+
+// AssignmentDone marks the assignment as done or not done for the user. Marking it twice doesn't change when it was
+// first done. Both directions are a single statement, so concurrent calls can't overwrite each other.
+func AssignmentDone(id string, userID string, done bool) error {
+	var err error
+	if done {
+		_, err = database.Exec("INSERT INTO assignment_completions (assignment_id, user_id, completed_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", id, userID, time.Now())
+	} else {
+		_, err = database.Exec("DELETE FROM assignment_completions WHERE assignment_id = $1 AND user_id = $2", id, userID)
 	}
-	defer rows.Close()
 
-	return assignments, nil
+	return err
 }
 
-func AssignmentDone(id string, user_id string, done bool) (err error) {
-	a, err := GetAssignmentByID(id)
+// GetMoodleAssignmentsToCheck returns the assignments imported from the moodle instance at moodleURL into the courses
+// that are due after since and weren't submitted by the user yet. The keys are the assignment ids, the values the
+// moodle assignment ids.
+func GetMoodleAssignmentsToCheck(userID string, moodleURL string, courseIDs []int, since time.Time) (map[string]int, error) {
+	ids := make([]int64, 0, len(courseIDs))
+	for _, id := range courseIDs {
+		ids = append(ids, int64(id))
+	}
+
+	rows, err := database.Query("SELECT id, moodle_assignment_id FROM assignments WHERE moodle_url = $1 AND course_id = ANY($2) AND due_date > $3 AND NOT EXISTS (SELECT 1 FROM moodle_submissions WHERE assignment_id = assignments.id AND user_id = $4)", moodleURL, pq.Array(ids), since, userID)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer func() { _ = rows.Close() }()
 
-	var already_marked bool
-	for _, u := range a.DoneBy {
-		if u == user_id {
-			already_marked = true
-			break
+	assignments := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var moodleAssignmentID int
+		if err := rows.Scan(&id, &moodleAssignmentID); err != nil {
+			return nil, err
 		}
+		assignments[id] = moodleAssignmentID
 	}
 
-	var stmt string
-	if done {
-		if already_marked {
-			return nil
-		}
+	return assignments, rows.Err()
+}
 
-		// append user_id to done_by array if done == true
-		stmt = "UPDATE assignments SET done_by = array_append(done_by, $1) WHERE id = $2;"
-	} else {
-		// if not in done_by, do nothing
-		if !already_marked {
-			return nil
-		}
+// MoodleAssignmentSubmitted records that the user submitted the assignment on moodle and marks it as done for them,
+// unless they already did that themselves. Each submission only marks the assignment as done once.
+func MoodleAssignmentSubmitted(assignmentID string, userID string, submittedAt time.Time) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
 
-		// remove user_id from done_by array if done == false
-		stmt = "UPDATE assignments SET done_by = array_remove(done_by, $1) WHERE id = $2;"
+	res, err := tx.Exec("INSERT INTO moodle_submissions (assignment_id, user_id, submitted_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", assignmentID, userID, submittedAt)
+	if submitted, err := affectsRow(res, err); err != nil || !submitted {
+		return err
 	}
-	_, err = database.Exec(stmt, user_id, id)
-	if err != nil {
-		return
+
+	if _, err := tx.Exec("INSERT INTO assignment_completions (assignment_id, user_id, completed_at, auto_completed) VALUES ($1, $2, $3, true) ON CONFLICT DO NOTHING", assignmentID, userID, submittedAt); err != nil {
+		return err
 	}
 
-	return
+	return tx.Commit()
 }
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/lib/pq"
+	"github.com/segmentio/ksuid"
+)
+
+// far away from the ids handed out by courses_id_seq so it can't collide with courses created by other tests
+const testCourseID = -1000000
+
+// createTestAssignments creates n assignments in the test course, each created by its own user and done by
+// doneBy other users. The returned function removes all of them again.
+func createTestAssignments(tb testing.TB, n int, doneBy int) (cleanup func()) {
+	var userIDs []string
+	newUser := func() structs.User {
+		name := ksuid.New().String()
+		user, err := NewUser(name, name+"@example.com", "password")
+		if err != nil {
+			tb.Fatalf("error creating user: %v", err)
+		}
+		userIDs = append(userIDs, user.ID.String())
+		return user
+	}
+
+	cleanup = func() {
+		_, _ = database.Exec("DELETE FROM assignments WHERE course_id = $1", testCourseID)
+		_, _ = database.Exec("DELETE FROM users WHERE id = ANY($1)", pq.Array(userIDs))
+	}
+
+	for i := 0; i < n; i++ {
+		a, err := CreateAssignment(structs.Assignment{
+			User:    newUser(),
+			Created: structs.UnixTime(time.Now()),
+			Title:   fmt.Sprintf("assignment %d", i),
+			DueDate: structs.UnixTime(time.Now().Add(24 * time.Hour)),
+			Course:  testCourseID,
+		})
+		if err != nil {
+			tb.Fatalf("error creating assignment: %v", err)
+		}
+
+		for j := 0; j < doneBy; j++ {
+			if err := AssignmentDone(a.UID.String(), newUser().ID.String(), true); err != nil {
+				tb.Fatalf("error marking assignment as done: %v", err)
+			}
+		}
+	}
+
+	return cleanup
+}
+
+func countQueries(tb testing.TB, f func() ([]structs.Assignment, error)) ([]structs.Assignment, uint64) {
+	before := queryCount()
+	assignments, err := f()
+	if err != nil {
+		tb.Fatalf("error getting assignments: %v", err)
+	}
+	return assignments, queryCount() - before
+}
+
+func TestGetAssignmentsByCourseQueryCount(t *testing.T) {
+	connectTestDatabase(t)
+
+	getAssignments := func() ([]structs.Assignment, error) { return GetAssignmentsByCourse("", testCourseID) }
+
+	defer createTestAssignments(t, 1, 2)()
+	_, few := countQueries(t, getAssignments)
+
+	defer createTestAssignments(t, 20, 2)()
+	assignments, many := countQueries(t, getAssignments)
+
+	if len(assignments) != 21 {
+		t.Fatalf("got %d assignments, expected 21", len(assignments))
+	}
+
+	for _, a := range assignments {
+		if a.User.Username == "" {
+			t.Errorf("creator of assignment %s was not loaded", a.UID)
+		}
+		if len(a.DoneByUsers) != 2 {
+			t.Errorf("assignment %s has %d done by users, expected 2", a.UID, len(a.DoneByUsers))
+		}
+	}
+
+	if many != few {
+		t.Errorf("loading 21 assignments took %d queries, loading 1 took %d", many, few)
+	}
+}
+
+func BenchmarkGetAssignmentsByCourse(b *testing.B) {
+	connectTestDatabase(b)
+
+	for _, n := range []int{1, 10, 100} {
+		cleanup := createTestAssignments(b, n, 5)
+
+		b.Run(fmt.Sprintf("%d assignments", n), func(b *testing.B) {
+			before := queryCount()
+			for i := 0; i < b.N; i++ {
+				if _, err := GetAssignmentsByCourse("", testCourseID); err != nil {
+					b.Fatalf("error getting assignments: %v", err)
+				}
+			}
+			b.ReportMetric(float64(queryCount()-before)/float64(b.N), "queries/op")
+		})
+
+		cleanup()
+	}
+}
+
+func TestUpdateAssignment(t *testing.T) {
+	connectTestDatabase(t)
+	defer createTestAssignments(t, 1, 0)()
+
+	assignments, err := GetAssignmentsByCourse("", testCourseID)
+	if err != nil || len(assignments) != 1 {
+		t.Fatalf("getting assignments returned %d assignments, %v", len(assignments), err)
+	}
+
+	dueDate := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	updated := assignments[0]
+	updated.Title = "updated"
+	updated.DueDate = structs.UnixTime(dueDate)
+	if err := UpdateAssignment(updated.UID.String(), updated); err != nil {
+		t.Fatalf("error updating assignment: %v", err)
+	}
+
+	a, err := GetAssignmentByID(updated.UID.String())
+	if err != nil {
+		t.Fatalf("error getting assignment: %v", err)
+	}
+	if a.Title != "updated" || !a.DueDate.Time().Equal(dueDate) {
+		t.Errorf("assignment has title %q and due date %v after updating, expected %q and %v", a.Title, a.DueDate.Time(), "updated", dueDate)
+	}
+}
@@ -0,0 +1,390 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"math/big"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/segmentio/ksuid"
+)
+
+const courseColumns = "courses.id, courses.name, courses.teacher_id, coalesce(users.username, ''), courses.archived, coalesce(courses.invite_code, '')"
+
+// no 0/O and 1/I/L so codes can be read out loud in class
+const inviteCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+const inviteCodeLength = 8
+
+// CreateCourse creates a new native (non-moodle) course with teacher as its teacher and first member
+func CreateCourse(name string, teacher structs.User) (structs.Course, error) {
+	now := time.Now()
+
+	inviteCode, err := newInviteCode()
+	if err != nil {
+		return structs.Course{}, err
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return structs.Course{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var id int
+	row := tx.QueryRow("INSERT INTO courses (name, teacher_id, created_at, archived, invite_code) VALUES ($1, $2, $3, false, $4) RETURNING id", name, teacher.ID.String(), now, inviteCode)
+	if err := row.Scan(&id); err != nil {
+		return structs.Course{}, err
+	}
+
+	// without its teacher as a member, nobody could access the course
+	if _, err := tx.Exec("INSERT INTO course_members (course_id, user_id, joined_at, role) VALUES ($1, $2, $3, $4)", id, teacher.ID.String(), now, structs.CourseRoleTeacher); err != nil {
+		return structs.Course{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return structs.Course{}, err
+	}
+
+	return structs.Course{
+		ID:          id,
+		Name:        name,
+		Teacher:     teacher.Username,
+		TeacherID:   teacher.ID,
+		FromMoodle:  false,
+		InviteCode:  inviteCode,
+		Assignments: make([]structs.Assignment, 0),
+		User:        teacher.ID,
+	}, nil
+}
+
+// GetCourseByID returns the native course with the given id including its assignments
+func GetCourseByID(id int) (structs.Course, error) {
+	row := database.QueryRow("SELECT "+courseColumns+" FROM courses LEFT JOIN users ON users.id = courses.teacher_id WHERE courses.id = $1", id)
+	if row.Err() != nil {
+		return structs.Course{}, row.Err()
+	}
+
+	return scanCourseWithAssignments(row)
+}
+
+// GetCourseByInviteCode returns the native course with the given invite code including its assignments
+func GetCourseByInviteCode(inviteCode string) (structs.Course, error) {
+	row := database.QueryRow("SELECT "+courseColumns+" FROM courses LEFT JOIN users ON users.id = courses.teacher_id WHERE courses.invite_code = $1", inviteCode)
+	if row.Err() != nil {
+		return structs.Course{}, row.Err()
+	}
+
+	return scanCourseWithAssignments(row)
+}
+
+// GetNativeUserCourses returns all native courses the user is a member of.
+// Archived courses are only included if includeArchived is true.
+func GetNativeUserCourses(user structs.User, includeArchived bool) ([]structs.Course, error) {
+	rows, err := database.Query("SELECT "+courseColumns+", course_members.role FROM courses JOIN course_members ON course_members.course_id = courses.id LEFT JOIN users ON users.id = courses.teacher_id WHERE course_members.user_id = $1 AND (NOT courses.archived OR $2) ORDER BY courses.name", user.ID.String(), includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var courses []structs.Course
+	for rows.Next() {
+		var role string
+		course, err := scanCourse(rows, &role)
+		if err != nil {
+			return nil, err
+		}
+
+		// only people managing the course get to see the invite code
+		if role == structs.CourseRoleStudent {
+			course.InviteCode = ""
+		}
+
+		course.User = user.ID
+		courses = append(courses, course)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = addAssignmentsToCourses(courses); err != nil {
+		return nil, err
+	}
+
+	return courses, nil
+}
+
+// UpdateCourse updates name and archived state of the native course with the specified id
+func UpdateCourse(id int, course structs.Course) error {
+	_, err := database.Exec("UPDATE courses SET name = $1, archived = $2 WHERE id = $3", course.Name, course.Archived, id)
+	return err
+}
+
+// RegenerateInviteCode replaces the invite code of the native course so the old one can't be used to join anymore
+func RegenerateInviteCode(id int) (string, error) {
+	inviteCode, err := newInviteCode()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = database.Exec("UPDATE courses SET invite_code = $1 WHERE id = $2", inviteCode, id)
+	return inviteCode, err
+}
+
+// AddCourseMember enrolls the user in the native course with the given id. Enrolling twice is a no-op.
+func AddCourseMember(courseID int, user structs.User, role string) error {
+	_, err := database.Exec("INSERT INTO course_members (course_id, user_id, joined_at, role) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING", courseID, user.ID.String(), time.Now(), role)
+	return err
+}
+
+// RemoveCourseMember removes the user from the native course with the given id. If they were the course's teacher,
+// another teacher of the course becomes it. If the user is not a member, ErrNotFound is returned.
+func RemoveCourseMember(courseID int, userID string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("DELETE FROM course_members WHERE course_id = $1 AND user_id = $2", courseID, userID)
+	if removed, err := affectsRow(res, err); err != nil || !removed {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return err
+	}
+
+	if err := updateCourseTeacher(tx, courseID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SetCourseMemberRole changes the role of a member of the native course with the given id. If the course's teacher
+// isn't a teacher anymore afterwards, another teacher of the course becomes it.
+func SetCourseMemberRole(courseID int, userID string, role string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE course_members SET role = $1 WHERE course_id = $2 AND user_id = $3", role, courseID, userID)
+	if updated, err := affectsRow(res, err); err != nil || !updated {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return err
+	}
+
+	if err := updateCourseTeacher(tx, courseID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// updateCourseTeacher points teacher_id of the native course to a member with the teacher role again, the one who
+// joined first, unless it already is one. Courses without any teacher keep their teacher_id.
+func updateCourseTeacher(tx *sql.Tx, courseID int) error {
+	_, err := tx.Exec("UPDATE courses SET teacher_id = teachers.user_id FROM (SELECT user_id FROM course_members WHERE course_id = $1 AND role = 'teacher' ORDER BY joined_at LIMIT 1) AS teachers WHERE courses.id = $1 AND NOT EXISTS (SELECT 1 FROM course_members WHERE course_id = $1 AND user_id = courses.teacher_id AND role = 'teacher')", courseID)
+	return err
+}
+
+// GetCourseMembers returns all members of the native course with the given id, teachers first
+func GetCourseMembers(courseID int) ([]structs.CourseMember, error) {
+	rows, err := database.Query("SELECT course_members.user_id, course_members.role, course_members.joined_at FROM course_members WHERE course_id = $1 ORDER BY course_members.role = 'teacher' DESC, course_members.role = 'helper' DESC, course_members.joined_at", courseID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var ids []string
+	var members []structs.CourseMember
+	for rows.Next() {
+		var member structs.CourseMember
+		if err := rows.Scan(&member.User.ID, &member.Role, &member.Joined); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, member.User.ID.String())
+		members = append(members, member)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	users, err := getUsersFromIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	usersByID := make(map[ksuid.KSUID]structs.User)
+	for _, u := range users {
+		usersByID[u.ID] = u
+	}
+
+	for i := range members {
+		members[i].User = usersByID[members[i].User.ID].GetClean()
+	}
+
+	return members, nil
+}
+
+// GetCourseTeacherID returns the id of the teacher the native course with the given id belongs to
+func GetCourseTeacherID(courseID int) (string, error) {
+	var teacherID string
+	err := database.QueryRow("SELECT teacher_id FROM courses WHERE id = $1", courseID).Scan(&teacherID)
+	return teacherID, err
+}
+
+// IsCourseArchived returns whether the native course with the given id is archived, without loading the course
+func IsCourseArchived(courseID int) (bool, error) {
+	var archived bool
+	err := database.QueryRow("SELECT archived FROM courses WHERE id = $1", courseID).Scan(&archived)
+	return archived, err
+}
+
+// GetCourseMemberRole returns the role of the user in the native course with the given id.
+// If the user is not a member, ErrNotFound is returned.
+func GetCourseMemberRole(courseID int, user structs.User) (string, error) {
+	row := database.QueryRow("SELECT role FROM course_members WHERE course_id = $1 AND user_id = $2", courseID, user.ID.String())
+	if row.Err() != nil {
+		return "", row.Err()
+	}
+
+	var role string
+	if err := row.Scan(&role); err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+// IsCourseMember returns true if the user is enrolled in the native course with the given id
+func IsCourseMember(courseID int, user structs.User) (bool, error) {
+	row := database.QueryRow("SELECT exists(SELECT 1 FROM course_members WHERE course_id = $1 AND user_id = $2)", courseID, user.ID.String())
+	if row.Err() != nil {
+		return false, row.Err()
+	}
+
+	var member bool
+	if err := row.Scan(&member); err != nil {
+		return false, err
+	}
+
+	return member, nil
+}
+
+// UserCanAccessCourse returns true if the user may see and work with assignments of the course with the given id.
+// For native courses this means being a member, for moodle courses the course has to be one of the user's moodle courses.
+func UserCanAccessCourse(user structs.User, courseID int) (bool, error) {
+	if courseID < 0 {
+		return IsCourseMember(courseID, user)
+	}
+
+	if courseID == 0 {
+		return false, nil
+	}
+
+	courses, err := GetMoodleUserCourses(user)
+	if err != nil {
+		if err == ErrNotFound || err == ErrMoodleNotConnected || err == ErrMoodleTokenExpired {
+			return false, nil
+		}
+		return false, err
+	}
+
+	for _, c := range courses {
+		if c.FromMoodle && moodleCourseID(c.ID) == courseID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// moodleCourseID converts the id of a moodle course to an int.
+// It is an int for fresh courses but a float64 for courses decoded from the cache.
+func moodleCourseID(id interface{}) int {
+	switch v := id.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+func scanCourse(row rowScanner, extra ...interface{}) (structs.Course, error) {
+	var course structs.Course
+	var id int
+
+	err := row.Scan(append([]interface{}{&id, &course.Name, &course.TeacherID, &course.Teacher, &course.Archived, &course.InviteCode}, extra...)...)
+	if err != nil {
+		return structs.Course{}, err
+	}
+
+	// stored as int so type switches on Course.ID work the same as for freshly fetched moodle courses
+	course.ID = id
+
+	return course, nil
+}
+
+func scanCourseWithAssignments(row rowScanner) (structs.Course, error) {
+	course, err := scanCourse(row)
+	if err != nil {
+		return structs.Course{}, err
+	}
+
+	course.Assignments, err = GetAssignmentsByCourse("", course.ID.(int))
+	if err != nil && err != sql.ErrNoRows {
+		return structs.Course{}, err
+	}
+
+	if course.Assignments == nil {
+		course.Assignments = make([]structs.Assignment, 0)
+	}
+
+	return course, nil
+}
+
+// addAssignmentsToCourses fetches the assignments of all courses at once and sets them on the courses
+func addAssignmentsToCourses(courses []structs.Course) error {
+	var ids []int
+	for _, c := range courses {
+		ids = append(ids, moodleCourseID(c.ID))
+	}
+
+	byCourse, err := GetAssignmentsByCourses("", ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range courses {
+		courses[i].Assignments = byCourse[moodleCourseID(courses[i].ID)]
+		if courses[i].Assignments == nil {
+			courses[i].Assignments = make([]structs.Assignment, 0)
+		}
+	}
+
+	return nil
+}
+
+func newInviteCode() (string, error) {
+	code := make([]byte, inviteCodeLength)
+	max := big.NewInt(int64(len(inviteCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = inviteCodeAlphabet[n.Int64()]
+	}
+
+	return string(code), nil
+}
@@ -2,95 +2,91 @@ package db
 
 import (
 	"database/sql"
-	"fmt"
-	"os"
+	"strings"
 
+	"git.teich.3nt3.de/3nt3/homework/config"
 	"git.teich.3nt3.de/3nt3/homework/logging"
-	_ "github.com/lib/pq"
-)
-
-const (
-	host   = "db"
-	port   = 5432
-	user   = "homework"
-	dbname = "homework"
+	"github.com/lib/pq"
 )
 
 var database *sql.DB
 
-func InitDatabase(testing bool) error {
-	logging.InfoLogger.Printf("connecting to database...\n")
-
-	password := os.Getenv("DBPASSWORD")
-
-	var psqlconn string
-	if !testing {
-		_, err := os.Stat("/.dockerenv")
-		if os.IsNotExist(err) {
-			logging.InfoLogger.Printf("connecting to db %s@%s", user, "localhost")
-			psqlconn = fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", "localhost", port, user, password, dbname)
-		} else {
-			logging.InfoLogger.Printf("connecting to db %s@%s", user, host)
-			psqlconn = fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, dbname)
-		}
-	} else {
-		psqlconn = "host=localhost port=5432 user=homework_testing password=testing dbname=homework_testing sslmode=disable"
-	}
-
-	foo, err := sql.Open("postgres", psqlconn)
-	if err != nil {
-		return err
-	}
-	database = foo
+// rowScanner is implemented by *sql.Row and *sql.Rows so scan functions can be shared between single and multi row queries
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
-	err = database.Ping()
-	if err != nil {
+// InitDatabase connects to the database and brings the schema up to date.
+// When testing, all tables are dropped first so every test run starts with an empty database.
+func InitDatabase(cfg config.Database, testing bool) error {
+	if err := Connect(cfg); err != nil {
 		return err
 	}
 
-	logging.InfoLogger.Printf("connection to database successful\n")
-
 	if testing {
 		logging.InfoLogger.Printf("dropping tables /bc testing")
 		_ = DropTables()
 	}
 
-	logging.InfoLogger.Printf("creating tables...\n")
-	err = initializeTables()
-	if err != nil {
+	logging.InfoLogger.Printf("running migrations...\n")
+	if err := Migrate(); err != nil {
 		return err
 	}
-	logging.InfoLogger.Printf("tables created successfully")
+	logging.InfoLogger.Printf("database schema is up to date")
 
 	return nil
 }
 
-func initializeTables() error {
-	_, err := database.Exec("CREATE TABLE IF NOT EXISTS users (id text PRIMARY KEY UNIQUE, username text UNIQUE, email text UNIQUE, password_hash text, created_at timestamp, permission int, courses_json text, moodle_url text, moodle_token text, moodle_user_id int)")
+// Connect connects to the database without touching the schema
+func Connect(cfg config.Database) error {
+	logging.InfoLogger.Printf("connecting to %s...\n", cfg)
+
+	foo, err := sql.Open("postgres", cfg.ConnectionString())
 	if err != nil {
 		return err
 	}
+	database = foo
+
+	database.SetMaxOpenConns(cfg.MaxOpenConns)
+	database.SetMaxIdleConns(cfg.MaxIdleConns)
+	database.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 
-	_, err = database.Exec("CREATE TABLE IF NOT EXISTS assignments (id text PRIMARY KEY UNIQUE, content text, course_id int, due_date timestamp, creator_id text, created_at timestamp, from_moodle bool, done_by text[])")
+	err = database.Ping()
 	if err != nil {
 		return err
 	}
 
-	_, err = database.Exec("CREATE TABLE IF NOT EXISTS sessions (uid text PRIMARY KEY UNIQUE, user_id text, created_at timestamp)")
+	logging.InfoLogger.Printf("connection to database successful\n")
+
+	return nil
+}
+
+// DropTables drops every table in the current schema, including the migration bookkeeping
+func DropTables() error {
+	rows, err := database.Query("SELECT tablename FROM pg_tables WHERE schemaname = current_schema()")
 	if err != nil {
 		return err
 	}
+	defer func() { _ = rows.Close() }()
 
-	_, err = database.Exec("CREATE TABLE IF NOT EXISTS moodle_cache (id text PRIMARY KEY UNIQUE, course_json text, moodle_url text, cached_at timestamp, user_id text);")
-	if err != nil {
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return err
+		}
+		tables = append(tables, pq.QuoteIdentifier(table))
+	}
+
+	if err = rows.Err(); err != nil {
 		return err
 	}
 
-	return nil
-}
+	if len(tables) == 0 {
+		return nil
+	}
 
-func DropTables() error {
-	_, err := database.Exec("DROP TABLE users, sessions, assignments, moodle_cache;")
+	_, err = database.Exec("DROP TABLE IF EXISTS " + strings.Join(tables, ", ") + " CASCADE")
 	return err
 }
 
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"github.com/lib/pq"
+)
+
+// testSchema is where the db tests keep their tables. The routes tests drop every table of the testing database and
+// go test runs both packages at the same time, so they can't share a schema.
+const testSchema = "db_test"
+
+// queries counts the statements sent to the database by connectTestDatabase's connections, so tests and benchmarks
+// can check that the number of queries doesn't grow with the amount of data
+var queries uint64
+
+func queryCount() uint64 {
+	return atomic.LoadUint64(&queries)
+}
+
+// connectTestDatabase connects to testSchema of the testing database and migrates it, or skips the test if there is no
+// testing database. Tables are not dropped, tests clean up after themselves.
+func connectTestDatabase(tb testing.TB) {
+	logging.InitLoggers(true, "logs.txt")
+
+	cfg := config.TestingDatabase()
+	if err := Connect(cfg); err != nil {
+		tb.Skipf("no testing database: %v", err)
+	}
+	if _, err := database.Exec("CREATE SCHEMA IF NOT EXISTS " + testSchema); err != nil {
+		tb.Fatalf("error creating schema: %v", err)
+	}
+	_ = database.Close()
+
+	dsn := cfg.ConnectionString()
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		parsed, err := pq.ParseURL(dsn)
+		if err != nil {
+			tb.Fatalf("error parsing dsn: %v", err)
+		}
+		dsn = parsed
+	}
+
+	// unknown keys are sent to postgres as run-time parameters
+	connector, err := pq.NewConnector(dsn + " search_path=" + testSchema)
+	if err != nil {
+		tb.Fatalf("error connecting: %v", err)
+	}
+	database = sql.OpenDB(countingConnector{connector})
+
+	if err := Migrate(); err != nil {
+		tb.Fatalf("error migrating: %v", err)
+	}
+}
+
+// countingConnector hands out connections that count their statements in queries, including those of transactions
+type countingConnector struct {
+	driver.Connector
+}
+
+func (c countingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return countingConn{conn}, nil
+}
+
+// countingConn wraps a connection of lib/pq, which implements all of the optional interfaces forwarded here
+type countingConn struct {
+	driver.Conn
+}
+
+func (c countingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	atomic.AddUint64(&queries, 1)
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c countingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	atomic.AddUint64(&queries, 1)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c countingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c countingConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"fmt"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/envelope"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+)
+
+// keyring encrypts moodle tokens. It is nil if plaintext is allowed and no keys are configured, then they are stored
+// unencrypted.
+var keyring *envelope.Keyring
+
+// InitEncryption sets up the keys moodle tokens are encrypted with
+func InitEncryption(cfg config.Encryption) error {
+	if !cfg.Enabled() {
+		if !cfg.AllowPlaintext {
+			return fmt.Errorf("no encryption keys are configured")
+		}
+
+		logging.WarningLogger.Printf("no encryption keys are configured, moodle tokens are stored unencrypted\n")
+		keyring = nil
+		return nil
+	}
+
+	k, err := envelope.NewKeyring(cfg)
+	if err != nil {
+		return err
+	}
+
+	keyring = k
+	return nil
+}
+
+// encryptSecret encrypts value with the current key. Empty values stay empty, so "not connected" can still be checked
+// in sql.
+func encryptSecret(value string) (string, error) {
+	if value == "" || keyring == nil {
+		return value, nil
+	}
+
+	return keyring.Encrypt(value)
+}
+
+// decryptSecret returns the plaintext of a value stored with encryptSecret. Values stored before encryption was set up
+// are returned as they are.
+func decryptSecret(value string) (string, error) {
+	if !envelope.IsEncrypted(value) {
+		return value, nil
+	}
+	if keyring == nil {
+		return "", envelope.ErrUnknownKey
+	}
+
+	return keyring.Decrypt(value)
+}
+
+// RotateMoodleTokens encrypts every moodle token that isn't encrypted with the current key yet with it and returns how
+// many were changed
+func RotateMoodleTokens() (int, error) {
+	if keyring == nil {
+		return 0, fmt.Errorf("no encryption keys are configured")
+	}
+
+	rows, err := database.Query("SELECT id, moodle_token FROM users WHERE moodle_token != ''")
+	if err != nil {
+		return 0, err
+	}
+
+	tokens := make(map[string]string)
+	for rows.Next() {
+		var id, token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return 0, err
+		}
+
+		if keyring.NeedsRotation(token) {
+			tokens[id] = token
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for id, token := range tokens {
+		newToken, err := keyring.Rotate(token)
+		if err != nil {
+			return rotated, fmt.Errorf("error rotating the moodle token of %s: %v", id, err)
+		}
+
+		// a token that was replaced by a login in the meantime is already encrypted with the current key
+		changed, err := affectsRow(database.Exec("UPDATE users SET moodle_token = $1 WHERE id = $2 AND moodle_token = $3", newToken, id, token))
+		if err != nil {
+			return rotated, err
+		}
+		if changed {
+			rotated++
+		}
+	}
+
+	return rotated, nil
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// errors returned by this package. Callers compare against them instead of the message.
+var (
+	// ErrNotFound is returned when the requested row doesn't exist. It is sql.ErrNoRows, so comparing against either
+	// works.
+	ErrNotFound = sql.ErrNoRows
+
+	// ErrUsernameTaken and ErrEmailTaken are returned by NewUser if another user already has the username or email
+	ErrUsernameTaken = errors.New("username already in use")
+	ErrEmailTaken    = errors.New("email already in use")
+
+	// ErrPasswordResetRequired is returned by Authenticate for accounts whose password has to be reset before they can
+	// log in again, if the password matches the stored hash
+	ErrPasswordResetRequired = errors.New("password reset required")
+
+	// ErrInvalidToken is returned for tokens that don't exist, have expired, were already used or are meant for
+	// something else
+	ErrInvalidToken = errors.New("invalid or expired token")
+
+	// ErrLastAdmin is returned when the role of the only admin would be changed, nobody could manage roles after that
+	ErrLastAdmin = errors.New("the last admin can't be demoted")
+
+	// ErrUnknownRole is returned for roles that aren't in the roles table
+	ErrUnknownRole = errors.New("unknown role")
+
+	// ErrIdentityTaken is returned if the account at a provider is already linked to another user, ErrProviderLinked
+	// if the user already linked another account of the same provider
+	ErrIdentityTaken  = errors.New("identity already linked to another user")
+	ErrProviderLinked = errors.New("an account of this provider is already linked")
+
+	// ErrLastLoginMethod is returned when unlinking the only identity of a user without a password, they couldn't log
+	// in anymore
+	ErrLastLoginMethod = errors.New("the only way to log in can't be removed")
+
+	// ErrTwoFactorEnabled is returned when setting up two-factor authentication for a user who already uses it,
+	// ErrInvalidTwoFactorCode if the code entered to finish the setup is wrong
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+
+	// ErrMoodleNotConnected is returned for moodle requests of users that haven't connected their moodle account
+	ErrMoodleNotConnected = errors.New("no token or moodle url was provided")
+	// ErrMoodleTokenExpired is returned for moodle requests of users whose token was rejected by moodle. They have to
+	// connect moodle again.
+	ErrMoodleTokenExpired = errors.New("the moodle token was rejected")
+)
+
+// uniqueViolation returns the name of the unique constraint err violated or an empty string if it isn't a unique
+// violation
+func uniqueViolation(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return pqErr.Constraint
+	}
+
+	return ""
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/segmentio/ksuid"
+)
+
+// OIDCLogin is a login at a provider that was started but hasn't come back yet
+type OIDCLogin struct {
+	Provider string
+	Nonce    string
+	Verifier string
+	// UserID is the user the identity is linked to, it is empty for logins of users that aren't logged in yet
+	UserID string
+}
+
+// NewOIDCLogin stores a login that was started with state until it expires after lifetime
+func NewOIDCLogin(state string, login OIDCLogin, lifetime time.Duration) error {
+	userID := sql.NullString{String: login.UserID, Valid: login.UserID != ""}
+
+	now := time.Now()
+	_, err := database.Exec("INSERT INTO oidc_logins (state_hash, provider, nonce, code_verifier, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7)", hashToken(state), login.Provider, login.Nonce, login.Verifier, userID, now, now.Add(lifetime))
+	if err != nil {
+		return err
+	}
+
+	go deleteExpiredOIDCLogins()
+
+	return nil
+}
+
+// UseOIDCLogin deletes and returns the login that was started with state at the provider. Like UseUserToken, a login
+// can only be finished once. If there is no such login or it expired, ErrInvalidToken is returned.
+func UseOIDCLogin(state string, provider string) (OIDCLogin, error) {
+	row := database.QueryRow("DELETE FROM oidc_logins WHERE state_hash = $1 AND provider = $2 AND expires_at > $3 RETURNING provider, nonce, code_verifier, user_id", hashToken(state), provider, time.Now())
+	if row.Err() != nil {
+		return OIDCLogin{}, row.Err()
+	}
+
+	var login OIDCLogin
+	var userID sql.NullString
+	if err := row.Scan(&login.Provider, &login.Nonce, &login.Verifier, &userID); err != nil {
+		if err == sql.ErrNoRows {
+			return OIDCLogin{}, ErrInvalidToken
+		}
+		return OIDCLogin{}, err
+	}
+	login.UserID = userID.String
+
+	return login, nil
+}
+
+// GetUserByIdentity returns the user the account at the provider is linked to
+func GetUserByIdentity(provider string, subject string) (structs.User, error) {
+	var userID string
+	if err := database.QueryRow("SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2", provider, subject).Scan(&userID); err != nil {
+		return structs.User{}, err
+	}
+
+	return GetUserById(userID, false)
+}
+
+// GetIdentities returns the accounts the user linked, in the order they were linked
+func GetIdentities(userID string) ([]structs.Identity, error) {
+	rows, err := database.Query("SELECT provider, subject, user_id, email, created_at FROM user_identities WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	identities := make([]structs.Identity, 0)
+	for rows.Next() {
+		var identity structs.Identity
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &identity.UserID, &identity.Email, &identity.Created); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// LinkIdentity links the account at a provider to identity.UserID. It returns ErrIdentityTaken if the account is
+// linked to another user and ErrProviderLinked if the user already linked another account of the provider.
+func LinkIdentity(identity structs.Identity) (structs.Identity, error) {
+	identity.Created = structs.UnixTime(time.Now())
+
+	_, err := database.Exec("INSERT INTO user_identities (provider, subject, user_id, email, created_at) VALUES ($1, $2, $3, $4, $5)", identity.Provider, identity.Subject, identity.UserID.String(), identity.Email, identity.Created.Time())
+	if err != nil {
+		return structs.Identity{}, identityError(err)
+	}
+
+	return identity, nil
+}
+
+// NewUserWithIdentity creates a user without a password who logs in with the account at the provider. Like NewUser,
+// it returns ErrUsernameTaken or ErrEmailTaken if someone else already uses the username or email.
+func NewUserWithIdentity(username string, email string, emailVerified bool, identity structs.Identity) (structs.User, error) {
+	user := structs.User{
+		ID:            ksuid.New(),
+		Username:      username,
+		Email:         email,
+		Created:       structs.UnixTime(time.Now()),
+		Role:          structs.RoleStudent,
+		EmailVerified: emailVerified,
+	}
+
+	tx, err := database.Begin()
+	if err != nil {
+		return structs.User{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// an empty hash never matches a password, see Authenticate
+	_, err = tx.Exec("insert into users (id, username, email, password_hash, role, created_at, courses_json, moodle_url, moodle_user_id, moodle_token, email_verified) VALUES ($1, $2, $3, '', $4, $5, '[]', '', -1, '', $6);", user.ID.String(), username, email, user.Role, user.Created.Time(), emailVerified)
+	if err != nil {
+		switch uniqueViolation(err) {
+		case "users_username_key":
+			return structs.User{}, ErrUsernameTaken
+		case "users_email_key":
+			return structs.User{}, ErrEmailTaken
+		}
+		return structs.User{}, err
+	}
+
+	_, err = tx.Exec("INSERT INTO user_identities (provider, subject, user_id, email, created_at) VALUES ($1, $2, $3, $4, $5)", identity.Provider, identity.Subject, user.ID.String(), identity.Email, user.Created.Time())
+	if err != nil {
+		return structs.User{}, identityError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return structs.User{}, err
+	}
+
+	return user, nil
+}
+
+// UnlinkIdentity removes the account at the provider from the user. If the user has no password and no other
+// identity, ErrLastLoginMethod is returned. If the user hasn't linked an account of the provider, ErrNotFound is
+// returned.
+func UnlinkIdentity(userID string, provider string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// locking the user makes concurrent unlinks wait for each other, so they can't remove the last two identities
+	var hasPassword bool
+	if err := tx.QueryRow("SELECT password_hash <> '' FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&hasPassword); err != nil {
+		return err
+	}
+
+	var identities int
+	if err := tx.QueryRow("SELECT count(*) FROM user_identities WHERE user_id = $1", userID).Scan(&identities); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("DELETE FROM user_identities WHERE user_id = $1 AND provider = $2", userID, provider)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	if !hasPassword && identities <= 1 {
+		return ErrLastLoginMethod
+	}
+
+	return tx.Commit()
+}
+
+// identityError maps unique violations of user_identities to ErrIdentityTaken and ErrProviderLinked
+func identityError(err error) error {
+	switch uniqueViolation(err) {
+	case "user_identities_pkey":
+		return ErrIdentityTaken
+	case "user_identities_provider_user_id_key":
+		return ErrProviderLinked
+	}
+
+	return err
+}
+
+func deleteExpiredOIDCLogins() {
+	_, err := database.Exec("DELETE FROM oidc_logins WHERE expires_at < $1", time.Now())
+	if err != nil {
+		logging.ErrorLogger.Printf("error deleting expired oidc logins: %v\n", err)
+	}
+}
@@ -0,0 +1,28 @@
+package db
+
+import "testing"
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("error loading migrations: %v", err)
+	}
+
+	if len(migrations) == 0 {
+		t.Fatalf("no migrations found")
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %s has version %d, expected %d (versions have to be consecutive)", m.Name, m.Version, i+1)
+		}
+
+		if m.Up == "" || m.Down == "" {
+			t.Errorf("migration %04d_%s is missing its up or down part", m.Version, m.Name)
+		}
+	}
+
+	if migrations[0].Name != "initial" {
+		t.Errorf("first migration is %s, expected initial", migrations[0].Name)
+	}
+}
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS users (id text PRIMARY KEY UNIQUE, username text UNIQUE, email text UNIQUE, password_hash text, created_at timestamp, permission int, courses_json text, moodle_url text, moodle_token text, moodle_user_id int);
+
+CREATE TABLE IF NOT EXISTS assignments (id text PRIMARY KEY UNIQUE, content text, course_id int, due_date timestamp, creator_id text, created_at timestamp, from_moodle bool, done_by text[]);
+
+CREATE TABLE IF NOT EXISTS sessions (uid text PRIMARY KEY UNIQUE, user_id text, created_at timestamp);
+
+CREATE TABLE IF NOT EXISTS moodle_cache (id text PRIMARY KEY UNIQUE, course_json text, moodle_url text, cached_at timestamp, user_id text);
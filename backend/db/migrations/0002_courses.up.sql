@@ -0,0 +1,16 @@
+-- native courses count downwards from -1 so their ids can never collide with moodle course ids, which are always
+-- positive. this way assignments.course_id can keep referring to both kinds of courses.
+CREATE SEQUENCE IF NOT EXISTS courses_id_seq INCREMENT BY -1 MAXVALUE -1 START WITH -1;
+
+CREATE TABLE IF NOT EXISTS courses (id int PRIMARY KEY DEFAULT nextval('courses_id_seq'), name text, teacher_id text, created_at timestamp, archived bool DEFAULT false);
+
+ALTER SEQUENCE courses_id_seq OWNED BY courses.id;
+
+CREATE TABLE IF NOT EXISTS course_members (course_id int REFERENCES courses(id) ON DELETE CASCADE, user_id text, joined_at timestamp, PRIMARY KEY (course_id, user_id));
+
+ALTER TABLE courses ADD COLUMN IF NOT EXISTS invite_code text UNIQUE;
+
+ALTER TABLE course_members ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'student';
+
+-- members enrolled before roles existed: the course's teacher_id is the only one who should be a teacher
+UPDATE course_members SET role = 'teacher' FROM courses WHERE courses.id = course_members.course_id AND courses.teacher_id = course_members.user_id AND course_members.role <> 'teacher';
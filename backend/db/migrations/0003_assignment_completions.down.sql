@@ -0,0 +1,5 @@
+ALTER TABLE assignments ADD COLUMN IF NOT EXISTS done_by text[] DEFAULT '{}';
+
+UPDATE assignments SET done_by = completions.user_ids FROM (SELECT assignment_id, array_agg(user_id ORDER BY completed_at) AS user_ids FROM assignment_completions GROUP BY assignment_id) AS completions WHERE completions.assignment_id = assignments.id;
+
+DROP TABLE IF EXISTS assignment_completions;
@@ -0,0 +1,8 @@
+-- who marked which assignment as done and when. replaces the assignments.done_by array, which had to be read and
+-- written back and therefore lost updates when two people marked the same assignment at once.
+CREATE TABLE IF NOT EXISTS assignment_completions (assignment_id text REFERENCES assignments(id) ON DELETE CASCADE, user_id text, completed_at timestamp NOT NULL, PRIMARY KEY (assignment_id, user_id));
+
+-- the array never recorded when something was done, so existing completions get the time of the migration
+INSERT INTO assignment_completions (assignment_id, user_id, completed_at) SELECT DISTINCT assignments.id, done.user_id, now() FROM assignments, unnest(assignments.done_by) AS done(user_id) WHERE done.user_id IS NOT NULL ON CONFLICT DO NOTHING;
+
+ALTER TABLE assignments DROP COLUMN IF EXISTS done_by;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS sessions_user_id_idx;
+
+ALTER TABLE sessions DROP COLUMN IF EXISTS last_seen_at, DROP COLUMN IF EXISTS last_ip, DROP COLUMN IF EXISTS user_agent, DROP COLUMN IF EXISTS id;
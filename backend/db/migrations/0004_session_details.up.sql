@@ -0,0 +1,11 @@
+-- sessions.uid is the secret cookie value, so sessions are shown to and revoked by their users using a separate id
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS id text UNIQUE;
+UPDATE sessions SET id = md5(uid || random()::text) WHERE id IS NULL;
+ALTER TABLE sessions ALTER COLUMN id SET NOT NULL;
+
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_ip text NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN IF NOT EXISTS last_seen_at timestamp;
+UPDATE sessions SET last_seen_at = created_at WHERE last_seen_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
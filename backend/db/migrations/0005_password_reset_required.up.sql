@@ -0,0 +1,8 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS password_reset_required bool NOT NULL DEFAULT false;
+
+-- registration used to hash the username instead of the password, so every account created until now has the hash of
+-- its username stored. none of them can be allowed to log in with that again.
+UPDATE users SET password_reset_required = true;
+
+-- anyone could log in to those accounts with the username, so none of the sessions can be trusted
+DELETE FROM sessions;
@@ -0,0 +1,7 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified bool NOT NULL DEFAULT false;
+
+-- single use tokens sent to users by mail, e.g. to verify their email address or reset their password. only a hash of
+-- the token is stored so a leaked database can't be used to take over accounts.
+CREATE TABLE IF NOT EXISTS user_tokens (token_hash text PRIMARY KEY, user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE, purpose text NOT NULL, created_at timestamp NOT NULL, expires_at timestamp NOT NULL, used_at timestamp);
+
+CREATE INDEX IF NOT EXISTS user_tokens_user_id_idx ON user_tokens (user_id, purpose);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS role_changes;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS permission int DEFAULT 0;
+UPDATE users SET permission = 1 WHERE role = 'admin';
+
+ALTER TABLE users DROP COLUMN IF EXISTS role;
+
+DROP TABLE IF EXISTS role_permissions, roles;
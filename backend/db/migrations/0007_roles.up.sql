@@ -0,0 +1,28 @@
+-- site wide roles, not to be confused with the roles of course_members. rank orders them from least to most powerful.
+CREATE TABLE IF NOT EXISTS roles (name text PRIMARY KEY, rank int NOT NULL UNIQUE);
+
+CREATE TABLE IF NOT EXISTS role_permissions (role text REFERENCES roles(name) ON DELETE CASCADE, permission text NOT NULL, PRIMARY KEY (role, permission));
+
+INSERT INTO roles (name, rank) VALUES ('student', 0), ('moderator', 1), ('teacher', 2), ('admin', 3) ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('moderator', 'assignments.moderate'),
+    ('moderator', 'contributors.view'),
+    ('teacher', 'contributors.view'),
+    ('admin', 'assignments.moderate'),
+    ('admin', 'contributors.view'),
+    ('admin', 'roles.manage'),
+    ('admin', 'audit_log.view')
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT 'student' REFERENCES roles(name);
+
+-- privilege 1 and above was what admin checks looked for
+UPDATE users SET role = 'admin' WHERE permission >= 1;
+
+ALTER TABLE users DROP COLUMN IF EXISTS permission;
+
+-- every role change, changed_by is null for changes made on the command line
+CREATE TABLE IF NOT EXISTS role_changes (id text PRIMARY KEY, user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE, changed_by text REFERENCES users(id) ON DELETE SET NULL, old_role text NOT NULL, new_role text NOT NULL, reason text NOT NULL DEFAULT '', changed_at timestamp NOT NULL);
+
+CREATE INDEX IF NOT EXISTS role_changes_user_id_idx ON role_changes (user_id);
@@ -0,0 +1,5 @@
+-- personal access tokens for scripts and bots, sent as `Authorization: Bearer <token>`. like user_tokens only a hash of
+-- the token is stored. scopes limit which routes the token may be used for.
+CREATE TABLE IF NOT EXISTS api_tokens (id text PRIMARY KEY, user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE, name text NOT NULL, token_hash text NOT NULL UNIQUE, scopes text[] NOT NULL, created_at timestamp NOT NULL, last_used_at timestamp);
+
+CREATE INDEX IF NOT EXISTS api_tokens_user_id_idx ON api_tokens (user_id);
@@ -0,0 +1,9 @@
+-- accounts at openid connect providers that users log in with. subject is the provider's id of the account, unlike
+-- the email address it never changes. a user can link one account per provider.
+CREATE TABLE IF NOT EXISTS user_identities (provider text NOT NULL, subject text NOT NULL, user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE, email text NOT NULL, created_at timestamp NOT NULL, PRIMARY KEY (provider, subject), UNIQUE (provider, user_id));
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+-- logins that were sent to a provider and haven't come back yet. like user_tokens only a hash of the state is stored.
+-- user_id is set if the identity is linked to an account that is already logged in.
+CREATE TABLE IF NOT EXISTS oidc_logins (state_hash text PRIMARY KEY, provider text NOT NULL, nonce text NOT NULL, code_verifier text NOT NULL, user_id text REFERENCES users(id) ON DELETE CASCADE, created_at timestamp NOT NULL, expires_at timestamp NOT NULL);
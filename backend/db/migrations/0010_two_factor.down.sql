@@ -0,0 +1,4 @@
+ALTER TABLE roles DROP COLUMN IF EXISTS two_factor_required;
+
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_two_factor;
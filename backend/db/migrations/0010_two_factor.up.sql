@@ -0,0 +1,11 @@
+-- totp secrets of users. enabled_at is null until the user proved that their authenticator app works by entering a
+-- code. last_used_counter is the time step of the last accepted code, so no code can be used twice.
+CREATE TABLE IF NOT EXISTS user_two_factor (user_id text PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE, secret text NOT NULL, created_at timestamp NOT NULL, enabled_at timestamp, last_used_counter bigint NOT NULL DEFAULT 0);
+
+-- single use codes to log in without the authenticator app. like user_tokens only a hash of the code is stored.
+CREATE TABLE IF NOT EXISTS recovery_codes (code_hash text PRIMARY KEY, user_id text NOT NULL REFERENCES users(id) ON DELETE CASCADE, created_at timestamp NOT NULL, used_at timestamp);
+
+CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes (user_id);
+
+-- users with these roles can't do anything but set up two-factor authentication until they did
+ALTER TABLE roles ADD COLUMN IF NOT EXISTS two_factor_required bool NOT NULL DEFAULT false;
@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS moodle_checked_at;
+ALTER TABLE users DROP COLUMN IF EXISTS moodle_status;
@@ -0,0 +1,4 @@
+-- whether the moodle token of a user still works: '' until it was checked, 'connected', 'expired' (moodle rejected it)
+-- or 'error' (moodle couldn't be asked). moodle_checked_at is when the token was last checked.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS moodle_status text NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS moodle_checked_at timestamp;
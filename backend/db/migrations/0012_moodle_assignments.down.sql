@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS assignments_moodle_assignment_idx;
+ALTER TABLE assignments DROP COLUMN IF EXISTS moodle_assignment_id;
+ALTER TABLE assignments DROP COLUMN IF EXISTS moodle_url;
@@ -0,0 +1,6 @@
+-- assignments imported from moodle are identified by the moodle instance and the id of the assignment there, so
+-- importing them again updates them instead of creating duplicates. both are NULL for assignments created by users.
+ALTER TABLE assignments ADD COLUMN IF NOT EXISTS moodle_url text;
+ALTER TABLE assignments ADD COLUMN IF NOT EXISTS moodle_assignment_id int;
+
+CREATE UNIQUE INDEX IF NOT EXISTS assignments_moodle_assignment_idx ON assignments (moodle_url, moodle_assignment_id);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS moodle_submissions;
+
+ALTER TABLE assignment_completions DROP COLUMN IF EXISTS auto_completed;
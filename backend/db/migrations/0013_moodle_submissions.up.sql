@@ -0,0 +1,6 @@
+-- completions of assignments the user submitted on moodle are marked, unlike the ones the user marked as done
+ALTER TABLE assignment_completions ADD COLUMN IF NOT EXISTS auto_completed bool NOT NULL DEFAULT false;
+
+-- the moodle assignments each user submitted, so they are only marked as done once. if the user marks them as not done
+-- afterwards, that isn't undone by the next import.
+CREATE TABLE IF NOT EXISTS moodle_submissions (assignment_id text REFERENCES assignments(id) ON DELETE CASCADE, user_id text REFERENCES users(id) ON DELETE CASCADE, submitted_at timestamp NOT NULL, PRIMARY KEY (assignment_id, user_id));
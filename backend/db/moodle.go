@@ -1,37 +1,28 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"net/http"
-	"strconv"
 	"time"
 
+	"git.teich.3nt3.de/3nt3/homework/config"
 	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/moodle"
 	"git.teich.3nt3.de/3nt3/homework/structs"
 	"github.com/segmentio/ksuid"
 )
 
-type moodleCourse struct {
-	ID          int    `json:"id"`
-	DisplayName string `json:"displayname"`
-	FullName    string `json:"fullname"`
-}
-
 func GetMoodleUserCourses(user structs.User) ([]structs.Course, error) {
 	baseURL := user.MoodleURL
 	token := user.MoodleToken
 	var courses []structs.Course
 
 	if baseURL == "" || token == "" {
-		return courses, errors.New("no token or moodle url was provided")
+		return courses, ErrMoodleNotConnected
+	}
+	if user.MoodleStatus == structs.MoodleExpired {
+		return courses, ErrMoodleTokenExpired
 	}
-
-	/*
-		$ curl "https://your.site.com/moodle/webservice/rest/server.php?wstoken=...&wsfunction=...&moodlewsrestformat=json"
-	*/
 
 	cacheObjs, err := GetUserCachedCourses(user)
 	if err != nil {
@@ -44,8 +35,8 @@ func GetMoodleUserCourses(user structs.User) ([]structs.Course, error) {
 
 	expired := false
 	for _, cacheObj := range cacheObjs {
-		// if the cached object is older than (7 * 24 hours = 7 days), set as expired
-		if time.Since(time.Time(cacheObj.CachedAt)).Hours() > (7 * 24) {
+		// if the cached object is older than the configured ttl (7 days by default), set as expired
+		if time.Since(time.Time(cacheObj.CachedAt)) > config.Get().Cache.MoodleCourses {
 			expired = true
 			break
 		}
@@ -77,29 +68,26 @@ func GetMoodleUserCourses(user structs.User) ([]structs.Course, error) {
 	}
 
 	if getFreshData {
-		resp, err := getUserCoursesReq(user.MoodleURL, user.MoodleToken, user.MoodleUserID)
+		mCourses, err := getMoodleCourses(user.MoodleURL, user.MoodleToken, user.MoodleUserID)
 		if err != nil {
+			if err == ErrMoodleTokenExpired {
+				moodleTokenRejected(user)
+			}
 			return nil, err
 		}
 
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("http request not ok. status %d", resp.StatusCode)
+		var courseIDs []int
+		for _, mCourse := range mCourses {
+			courseIDs = append(courseIDs, mCourse.ID)
 		}
 
-		var mCourses []moodleCourse
-		err = json.NewDecoder(resp.Body).Decode(&mCourses)
+		assignmentsByCourse, err := GetAssignmentsByCourses(user.MoodleURL, courseIDs)
 		if err != nil {
 			return nil, err
 		}
 
 		for _, mCourse := range mCourses {
-			assignments, err := GetAssignmentsByCourse(mCourse.ID)
-			if err != nil {
-				if err != sql.ErrNoRows {
-					return nil, err
-				}
-			}
-
+			assignments := assignmentsByCourse[mCourse.ID]
 			if assignments == nil {
 				assignments = make([]structs.Assignment, 0)
 			}
@@ -123,6 +111,10 @@ func GetMoodleUserCourses(user structs.User) ([]structs.Course, error) {
 	// update cache
 	go func() {
 		if err := updateCache(baseURL, user.MoodleToken, user.ID, user.MoodleUserID); err != nil {
+			if err == ErrMoodleTokenExpired {
+				moodleTokenRejected(user)
+				return
+			}
 			logging.WarningLogger.Printf("error updating course cache: %v\n", err)
 		}
 	}()
@@ -134,40 +126,42 @@ func GetMoodleUserCourses(user structs.User) ([]structs.Course, error) {
 	return courses, nil
 }
 
-func getUserCoursesReq(baseURL string, token string, moodleUserID int) (*http.Response, error) {
-	r, err := http.NewRequest(http.MethodGet, baseURL+"/webservice/rest/server.php", nil)
-	if err != nil {
-		return nil, err
+// moodleClient fetches the courses from moodle, see SetMoodleClient
+var moodleClient = moodle.NewClient(config.Default().Moodle.Timeout, nil)
+
+// SetMoodleClient sets the client used for requests to moodle instances
+func SetMoodleClient(c *moodle.Client) {
+	moodleClient = c
+}
+
+// getMoodleCourses returns the courses the moodle user is enrolled in. If moodle rejects the token,
+// ErrMoodleTokenExpired is returned.
+func getMoodleCourses(baseURL string, token string, moodleUserID int) ([]moodle.Course, error) {
+	courses, err := moodleClient.UserCourses(context.Background(), baseURL, token, moodleUserID)
+	if moodle.TokenRejected(err) {
+		return nil, ErrMoodleTokenExpired
 	}
 
-	q := r.URL.Query()
-	q.Add("wstoken", token)
-	q.Add("wsfunction", "core_enrol_get_users_courses")
+	return courses, err
+}
 
-	q.Add("userid", strconv.Itoa(moodleUserID))
-	q.Add("moodlewsrestformat", "json")
-	r.URL.RawQuery = q.Encode()
+// moodleTokenRejected marks the moodle token of the user as expired, so moodle isn't asked again until the user
+// connected moodle again
+func moodleTokenRejected(user structs.User) {
+	logging.InfoLogger.Printf("moodle rejected the token of %s\n", user.Username)
 
-	client := &http.Client{}
-	return client.Do(r)
+	if err := SetMoodleStatus(user.ID.String(), structs.MoodleExpired); err != nil {
+		logging.ErrorLogger.Printf("error updating moodle status: %v\n", err)
+	}
 }
 
 func updateCache(baseURL string, token string, userID ksuid.KSUID, moodleUserID int) error {
-	resp, err := getUserCoursesReq(baseURL, token, moodleUserID)
+	mCourses, err := getMoodleCourses(baseURL, token, moodleUserID)
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("http request not ok. status %d", resp.StatusCode)
-	}
-
-	var mCourses []moodleCourse
 	var cacheObjs []structs.CachedCourse
-	err = json.NewDecoder(resp.Body).Decode(&mCourses)
-	if err != nil {
-		return err
-	}
 
 	now := time.Now()
 
@@ -206,3 +200,79 @@ func updateCache(baseURL string, token string, userID ksuid.KSUID, moodleUserID
 
 	return nil
 }
+
+// SetMoodleStatus records the result of checking the moodle token of the user
+func SetMoodleStatus(userID string, status string) error {
+	_, err := database.Exec("UPDATE users SET moodle_status = $1, moodle_checked_at = $2 WHERE id = $3", status, time.Now(), userID)
+	return err
+}
+
+// GetUsersToCheckMoodle returns up to limit users with a moodle token that wasn't checked since before. Tokens that
+// were rejected already aren't checked again.
+func GetUsersToCheckMoodle(before time.Time, limit int) ([]structs.User, error) {
+	rows, err := database.Query("SELECT "+userColumns+" FROM users WHERE moodle_token != '' AND moodle_url != '' AND moodle_status != $1 AND (moodle_checked_at IS NULL OR moodle_checked_at < $2) ORDER BY moodle_checked_at NULLS FIRST LIMIT $3", structs.MoodleExpired, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	users := make([]structs.User, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// GetMoodleUsers returns all users with a moodle token that wasn't rejected
+func GetMoodleUsers() ([]structs.User, error) {
+	rows, err := database.Query("SELECT "+userColumns+" FROM users WHERE moodle_token != '' AND moodle_url != '' AND moodle_status != $1", structs.MoodleExpired)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	users := make([]structs.User, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// DisconnectMoodle removes the moodle account and its cached courses from the user. Logging in with moodle still
+// works if the moodle identity is linked, that connects it again.
+func DisconnectMoodle(userID string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE users SET moodle_url = '', moodle_token = '', moodle_user_id = -1, moodle_status = '', moodle_checked_at = NULL WHERE id = $1 AND moodle_url != ''", userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrMoodleNotConnected
+	}
+
+	if _, err := tx.Exec("DELETE FROM moodle_cache WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
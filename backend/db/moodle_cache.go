@@ -41,16 +41,25 @@ func GetUserCachedCourses(user structs.User) ([]structs.CachedCourse, error) {
 			return nil, err
 		}
 
-		// get assignments
-		newCourse.Course.Assignments, err = GetAssignmentsByCourse(int(newCourse.Course.ID.(float64)))
-		if err != nil {
-			return nil, err
-		}
-
 		// append to array
 		courses = append(courses, newCourse)
 	}
 
+	// get assignments of all courses at once
+	var courseIDs []int
+	for _, c := range courses {
+		courseIDs = append(courseIDs, moodleCourseID(c.Course.ID))
+	}
+
+	assignmentsByCourse, err := GetAssignmentsByCourses(user.MoodleURL, courseIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range courses {
+		courses[i].Course.Assignments = assignmentsByCourse[moodleCourseID(courses[i].Course.ID)]
+	}
+
 	// return
 	return courses, nil
 }
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/lib/pq"
+	"github.com/segmentio/ksuid"
+)
+
+// GetRoles returns all roles with their permissions, least powerful first
+func GetRoles() ([]structs.Role, error) {
+	rows, err := database.Query("SELECT roles.name, roles.rank, coalesce(array_agg(role_permissions.permission ORDER BY role_permissions.permission) FILTER (WHERE role_permissions.permission IS NOT NULL), '{}'), roles.two_factor_required FROM roles LEFT JOIN role_permissions ON role_permissions.role = roles.name GROUP BY roles.name, roles.rank ORDER BY roles.rank")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	roles := make([]structs.Role, 0)
+	for rows.Next() {
+		var role structs.Role
+		if err := rows.Scan(&role.Name, &role.Rank, pq.Array(&role.Permissions), &role.TwoFactorRequired); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+// SetRoleTwoFactorRequired changes whether users with the role have to use two-factor authentication. If the role
+// doesn't exist, ErrUnknownRole is returned.
+func SetRoleTwoFactorRequired(role string, required bool) error {
+	res, err := database.Exec("UPDATE roles SET two_factor_required = $1 WHERE name = $2", required, role)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUnknownRole
+	}
+
+	return nil
+}
+
+// HasPermission returns true if the role of the user grants the permission
+func HasPermission(user structs.User, permission string) (bool, error) {
+	row := database.QueryRow("SELECT exists(SELECT 1 FROM role_permissions WHERE role = $1 AND permission = $2)", user.Role, permission)
+	if row.Err() != nil {
+		return false, row.Err()
+	}
+
+	var allowed bool
+	if err := row.Scan(&allowed); err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
+
+// SetUserRole changes the role of the user and records the change in the audit trail. changedBy is the id of the user
+// making the change or empty if it was made on the command line. If the user doesn't exist, ErrNotFound is returned.
+func SetUserRole(userID string, role string, changedBy string, reason string) (structs.RoleChange, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return structs.RoleChange{}, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT exists(SELECT 1 FROM roles WHERE name = $1)", role).Scan(&exists); err != nil {
+		return structs.RoleChange{}, err
+	}
+	if !exists {
+		return structs.RoleChange{}, ErrUnknownRole
+	}
+
+	// locking the admins (and the user) makes concurrent demotions wait for each other, so they can't demote the
+	// last two admins at the same time
+	if _, err := tx.Exec("SELECT 1 FROM users WHERE role = $1 OR id = $2 FOR UPDATE", structs.RoleAdmin, userID); err != nil {
+		return structs.RoleChange{}, err
+	}
+
+	var oldRole string
+	if err := tx.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&oldRole); err != nil {
+		return structs.RoleChange{}, err
+	}
+
+	if oldRole == structs.RoleAdmin && role != structs.RoleAdmin {
+		var admins int
+		if err := tx.QueryRow("SELECT count(*) FROM users WHERE role = $1", structs.RoleAdmin).Scan(&admins); err != nil {
+			return structs.RoleChange{}, err
+		}
+		if admins <= 1 {
+			return structs.RoleChange{}, ErrLastAdmin
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE users SET role = $1 WHERE id = $2", role, userID); err != nil {
+		return structs.RoleChange{}, err
+	}
+
+	change := structs.RoleChange{
+		ID:        ksuid.New(),
+		ChangedBy: changedBy,
+		OldRole:   oldRole,
+		NewRole:   role,
+		Reason:    reason,
+		Changed:   structs.UnixTime(time.Now()),
+	}
+	if change.UserID, err = ksuid.Parse(userID); err != nil {
+		return structs.RoleChange{}, err
+	}
+
+	_, err = tx.Exec("INSERT INTO role_changes (id, user_id, changed_by, old_role, new_role, reason, changed_at) VALUES ($1, $2, $3, $4, $5, $6, $7)", change.ID.String(), userID, sql.NullString{String: changedBy, Valid: changedBy != ""}, oldRole, role, reason, change.Changed.Time())
+	if err != nil {
+		return structs.RoleChange{}, err
+	}
+
+	return change, tx.Commit()
+}
+
+// GetRoleChanges returns the audit trail of role changes, newest first. If userID is not empty, only changes of that
+// user's role are returned.
+func GetRoleChanges(userID string) ([]structs.RoleChange, error) {
+	rows, err := database.Query("SELECT id, user_id, coalesce(changed_by, ''), old_role, new_role, reason, changed_at FROM role_changes WHERE $1 = '' OR user_id = $1 ORDER BY changed_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	changes := make([]structs.RoleChange, 0)
+	for rows.Next() {
+		var change structs.RoleChange
+		if err := rows.Scan(&change.ID, &change.UserID, &change.ChangedBy, &change.OldRole, &change.NewRole, &change.Reason, &change.Changed); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, rows.Err()
+}
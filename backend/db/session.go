@@ -3,13 +3,19 @@ package db
 import (
 	"time"
 
+	"git.teich.3nt3.de/3nt3/homework/config"
 	"git.teich.3nt3.de/3nt3/homework/logging"
 	"git.teich.3nt3.de/3nt3/homework/structs"
 	"github.com/segmentio/ksuid"
 )
 
-func deleteOldSessions(maxAgeDays int) {
-	oldestPossible := time.Now().AddDate(0, 0, -maxAgeDays)
+const sessionColumns = "uid, id, user_id, created_at, user_agent, last_ip, coalesce(last_seen_at, created_at)"
+
+// how often last_seen_at is updated at most, so not every request has to write to the database
+const sessionTouchInterval = time.Minute
+
+func deleteOldSessions(maxAge time.Duration) {
+	oldestPossible := time.Now().Add(-maxAge)
 
 	_, err := database.Exec("DELETE FROM sessions WHERE created_at < $1", oldestPossible)
 	if err != nil {
@@ -18,29 +24,113 @@ func deleteOldSessions(maxAgeDays int) {
 	}
 }
 
-func NewSession(user structs.User) (structs.Session, error) {
+// NewSession creates a session for the user. userAgent and ip are only stored so the user can recognize the session
+// when listing them.
+func NewSession(user structs.User, userAgent string, ip string) (structs.Session, error) {
 	now := time.Now()
 	uid := ksuid.New()
+	id := ksuid.New()
 
-	_, err := database.Exec("INSERT INTO sessions (uid, user_id, created_at) VALUES ($1, $2, $3)", uid.String(), user.ID.String(), now)
+	_, err := database.Exec("INSERT INTO sessions (uid, id, user_id, created_at, user_agent, last_ip, last_seen_at) VALUES ($1, $2, $3, $4, $5, $6, $4)", uid.String(), id.String(), user.ID.String(), now, userAgent, ip)
 
-	go deleteOldSessions(structs.MaxSessionAge)
+	go deleteOldSessions(config.Get().Session.Lifetime)
 
 	return structs.Session{
-		UID:     uid,
-		UserID:  user.ID,
-		Created: structs.UnixTime(now),
+		UID:       uid,
+		ID:        id.String(),
+		UserID:    user.ID,
+		Created:   structs.UnixTime(now),
+		UserAgent: userAgent,
+		LastIP:    ip,
+		LastSeen:  structs.UnixTime(now),
 	}, err
 }
 
 func GetSessionById(uid string) (structs.Session, error) {
-	row := database.QueryRow("SELECT * FROM sessions WHERE uid = $1", uid)
+	row := database.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE uid = $1", uid)
 	if row.Err() != nil {
 		return structs.Session{}, row.Err()
 	}
 
+	return scanSession(row)
+}
+
+// GetUserSessions returns all sessions of the user that haven't expired yet, most recently used first
+func GetUserSessions(userID string) ([]structs.Session, error) {
+	oldestPossible := time.Now().Add(-config.Get().Session.Lifetime)
+
+	rows, err := database.Query("SELECT "+sessionColumns+" FROM sessions WHERE user_id = $1 AND created_at >= $2 ORDER BY coalesce(last_seen_at, created_at) DESC", userID, oldestPossible)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	sessions := make([]structs.Session, 0)
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// TouchSession records that the session was just used from ip. To keep the number of writes down, nothing is written
+// if the ip didn't change and the session was already used recently.
+func TouchSession(uid string, ip string) error {
+	now := time.Now()
+	_, err := database.Exec("UPDATE sessions SET last_seen_at = $1, last_ip = $2 WHERE uid = $3 AND (last_ip <> $2 OR last_seen_at IS NULL OR last_seen_at < $4)", now, ip, uid, now.Add(-sessionTouchInterval))
+	return err
+}
+
+// DeleteSession deletes the session with the given uid (the cookie value), e.g. when logging out
+func DeleteSession(uid string) error {
+	_, err := database.Exec("DELETE FROM sessions WHERE uid = $1", uid)
+	return err
+}
+
+// DeleteUserSession deletes the session with the given public id if it belongs to the user.
+// If there is no such session, ErrNotFound is returned.
+func DeleteUserSession(userID string, id string) error {
+	res, err := database.Exec("DELETE FROM sessions WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// DeleteOtherSessions deletes all sessions of the user except the one with the uid keepUID and returns how many were
+// deleted
+func DeleteOtherSessions(userID string, keepUID string) (int64, error) {
+	res, err := database.Exec("DELETE FROM sessions WHERE user_id = $1 AND uid <> $2", userID, keepUID)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// DeleteUserSessions deletes all sessions of the user, e.g. after the password was reset
+func DeleteUserSessions(userID string) error {
+	_, err := database.Exec("DELETE FROM sessions WHERE user_id = $1", userID)
+	return err
+}
+
+func scanSession(row rowScanner) (structs.Session, error) {
 	var session structs.Session
-	if err := row.Scan(&session.UID, &session.UserID, &session.Created); err != nil {
+	if err := row.Scan(&session.UID, &session.ID, &session.UserID, &session.Created, &session.UserAgent, &session.LastIP, &session.LastSeen); err != nil {
 		return structs.Session{}, err
 	}
 
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/logging"
+)
+
+// what a user token may be used for
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+	// TokenPurposeTwoFactor finishes a login with an identity provider once the user entered their two-factor code
+	TokenPurposeTwoFactor = "two_factor"
+)
+
+// NewUserToken creates a single use token for the user that expires after lifetime. Tokens the user was given for the
+// same purpose before stop working.
+func NewUserToken(userID string, purpose string, lifetime time.Duration) (string, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := database.Exec("DELETE FROM user_tokens WHERE user_id = $1 AND purpose = $2", userID, purpose); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	_, err = database.Exec("INSERT INTO user_tokens (token_hash, user_id, purpose, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)", hashToken(token), userID, purpose, now, now.Add(lifetime))
+	if err != nil {
+		return "", err
+	}
+
+	go deleteExpiredTokens()
+
+	return token, nil
+}
+
+// CheckUserToken returns the id of the user the token belongs to without using it up
+func CheckUserToken(token string, purpose string) (string, error) {
+	row := database.QueryRow("SELECT user_id FROM user_tokens WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > $3", hashToken(token), purpose, time.Now())
+	if row.Err() != nil {
+		return "", row.Err()
+	}
+
+	var userID string
+	if err := row.Scan(&userID); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrInvalidToken
+		}
+		return "", err
+	}
+
+	return userID, nil
+}
+
+// UseUserToken marks the token as used and returns the id of the user it belongs to. This is a single statement, so
+// a token can't be used twice even by concurrent requests.
+func UseUserToken(token string, purpose string) (string, error) {
+	now := time.Now()
+	row := database.QueryRow("UPDATE user_tokens SET used_at = $1 WHERE token_hash = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1 RETURNING user_id", now, hashToken(token), purpose)
+	if row.Err() != nil {
+		return "", row.Err()
+	}
+
+	var userID string
+	if err := row.Scan(&userID); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrInvalidToken
+		}
+		return "", err
+	}
+
+	return userID, nil
+}
+
+func deleteExpiredTokens() {
+	_, err := database.Exec("DELETE FROM user_tokens WHERE expires_at < $1", time.Now())
+	if err != nil {
+		logging.ErrorLogger.Printf("error deleting expired tokens: %v\n", err)
+	}
+}
+
+// newToken returns a random token that can't be guessed
+func newToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
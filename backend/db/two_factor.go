@@ -0,0 +1,202 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"git.teich.3nt3.de/3nt3/homework/totp"
+)
+
+// how many recovery codes a user gets
+const recoveryCodeCount = 10
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GetTwoFactorStatus returns whether the user enabled two-factor authentication and whether their role requires it
+func GetTwoFactorStatus(user structs.User) (structs.TwoFactorStatus, error) {
+	var status structs.TwoFactorStatus
+	err := database.QueryRow(`SELECT
+		exists(SELECT 1 FROM user_two_factor WHERE user_id = $1 AND enabled_at IS NOT NULL),
+		coalesce((SELECT two_factor_required FROM roles WHERE name = $2), false),
+		(SELECT count(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL)`, user.ID.String(), user.Role).Scan(&status.Enabled, &status.Required, &status.RecoveryCodesLeft)
+	if err != nil {
+		return structs.TwoFactorStatus{}, err
+	}
+
+	return status, nil
+}
+
+// NewTwoFactorSecret generates the totp secret of the user. It isn't used until EnableTwoFactor was called with a code
+// for it, setting up again before that replaces it. If the user already enabled two-factor authentication,
+// ErrTwoFactorEnabled is returned.
+func NewTwoFactorSecret(userID string) (string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	res, err := database.Exec("INSERT INTO user_two_factor (user_id, secret, created_at) VALUES ($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at, last_used_counter = 0 WHERE user_two_factor.enabled_at IS NULL", userID, secret, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if affected == 0 {
+		return "", ErrTwoFactorEnabled
+	}
+
+	return secret, nil
+}
+
+// EnableTwoFactor turns on two-factor authentication if code is valid for the secret from NewTwoFactorSecret and
+// returns the recovery codes of the user. It returns ErrNotFound if there is no secret, ErrTwoFactorEnabled if it is
+// already enabled and ErrInvalidTwoFactorCode if the code is wrong.
+func EnableTwoFactor(userID string, code string) ([]string, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var secret string
+	var enabledAt sql.NullTime
+	if err := tx.QueryRow("SELECT secret, enabled_at FROM user_two_factor WHERE user_id = $1 FOR UPDATE", userID).Scan(&secret, &enabledAt); err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	counter, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	if _, err := tx.Exec("UPDATE user_two_factor SET enabled_at = $1, last_used_counter = $2 WHERE user_id = $3", time.Now(), counter, userID); err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// CheckTwoFactorCode returns true if code is the current totp code or an unused recovery code of the user. Either can
+// only be used once.
+func CheckTwoFactorCode(userID string, code string) (bool, error) {
+	code = strings.ReplaceAll(code, " ", "")
+
+	if len(code) == totp.Digits {
+		var secret string
+		err := database.QueryRow("SELECT secret FROM user_two_factor WHERE user_id = $1 AND enabled_at IS NOT NULL", userID).Scan(&secret)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return false, nil
+			}
+			return false, err
+		}
+
+		counter, ok := totp.Validate(secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+
+		// the code is only accepted if no code of the same or a later time step was used
+		return affectsRow(database.Exec("UPDATE user_two_factor SET last_used_counter = $1 WHERE user_id = $2 AND last_used_counter < $1", counter, userID))
+	}
+
+	return affectsRow(database.Exec("UPDATE recovery_codes SET used_at = $1 WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL", time.Now(), userID, hashToken(normalizeRecoveryCode(code))))
+}
+
+// NewRecoveryCodes replaces the recovery codes of the user
+func NewRecoveryCodes(userID string) ([]string, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, tx.Commit()
+}
+
+// DisableTwoFactor removes the totp secret and the recovery codes of the user
+func DisableTwoFactor(userID string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec("DELETE FROM user_two_factor WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.Exec("INSERT INTO recovery_codes (code_hash, user_id, created_at) VALUES ($1, $2, $3)", hashToken(normalizeRecoveryCode(code)), userID, now); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+// newRecoveryCode returns a random code like "abcd-efgh-ijkl-mnop". It has 80 bits, so storing a plain sha256 hash
+// is enough.
+func newRecoveryCode() (string, error) {
+	raw := make([]byte, 10)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	encoded := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw))
+	return encoded[0:4] + "-" + encoded[4:8] + "-" + encoded[8:12] + "-" + encoded[12:16], nil
+}
+
+// normalizeRecoveryCode makes codes match however they were typed in
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// affectsRow returns true if the statement changed a row
+func affectsRow(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
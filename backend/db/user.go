@@ -5,12 +5,17 @@ import (
 	"encoding/json"
 	"time"
 
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/logging"
 	"git.teich.3nt3.de/3nt3/homework/structs"
 	"github.com/lib/pq"
 	"github.com/segmentio/ksuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// userColumns are the columns scanUser expects, in that order
+const userColumns = "id, username, email, password_hash, created_at, role, courses_json, moodle_url, moodle_token, moodle_user_id, moodle_status, password_reset_required, email_verified"
+
 func NewUser(username string, email string, password string) (structs.User, error) {
 	id := ksuid.New()
 
@@ -20,8 +25,14 @@ func NewUser(username string, email string, password string) (structs.User, erro
 	}
 
 	now := time.Now()
-	_, err = database.Exec("insert into users (id, username, email, password_hash, permission, created_at, courses_json, moodle_url, moodle_user_id, moodle_token) VALUES ($1, $2, $3, $4, 0, $5, '[]', '', -1, '');", id.String(), username, email, hash, now)
+	_, err = database.Exec("insert into users (id, username, email, password_hash, role, created_at, courses_json, moodle_url, moodle_user_id, moodle_token) VALUES ($1, $2, $3, $4, $5, $6, '[]', '', -1, '');", id.String(), username, email, hash, structs.RoleStudent, now)
 	if err != nil {
+		switch uniqueViolation(err) {
+		case "users_username_key":
+			return structs.User{}, ErrUsernameTaken
+		case "users_email_key":
+			return structs.User{}, ErrEmailTaken
+		}
 		return structs.User{}, err
 	}
 
@@ -31,12 +42,12 @@ func NewUser(username string, email string, password string) (structs.User, erro
 		Email:        email,
 		PasswordHash: hash,
 		Created:      structs.UnixTime(now),
-		Privilege:    0,
+		Role:         structs.RoleStudent,
 	}, nil
 }
 
 func GetUserByUsername(username string, getCourses bool) (structs.User, error) {
-	row := database.QueryRow("select * from users where username = $1;", username)
+	row := database.QueryRow("SELECT "+userColumns+" FROM users WHERE username = $1", username)
 	if row.Err() != nil {
 		return structs.User{}, row.Err()
 	}
@@ -44,26 +55,18 @@ func GetUserByUsername(username string, getCourses bool) (structs.User, error) {
 	return scanUserRow(row, getCourses)
 }
 
-/*
-func GetUserByEmail(email string ) (structs.User, error) {
-	row := database.QueryRow("select * from users where email = $1;", email)
+// GetUserByEmail returns the user with the email address, ignoring case
+func GetUserByEmail(email string, getCourses bool) (structs.User, error) {
+	row := database.QueryRow("SELECT "+userColumns+" FROM users WHERE lower(email) = lower($1)", email)
 	if row.Err() != nil {
 		return structs.User{}, row.Err()
 	}
 
-	var user structs.User
-	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Created, &user.Privilege)
-	if err != nil {
-		return structs.User{}, err
-	}
-
-	return user, nil
+	return scanUserRow(row, getCourses)
 }
 
-*/
-
 func GetUserById(id string, getCourses bool) (structs.User, error) {
-	row := database.QueryRow("SELECT * FROM users WHERE id = $1", id)
+	row := database.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id)
 	if row.Err() != nil {
 		return structs.User{}, row.Err()
 	}
@@ -81,6 +84,11 @@ func Authenticate(username string, password string) (structs.User, bool, error)
 		return user, false, err
 	}
 
+	// users who signed up with an identity provider have no password until they set one
+	if user.PasswordHash == "" {
+		return structs.User{}, false, nil
+	}
+
 	// check password
 	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
 	if err != nil {
@@ -93,42 +101,71 @@ func Authenticate(username string, password string) (structs.User, bool, error)
 		return structs.User{}, false, err
 	}
 
+	// the stored hash of these accounts is worthless, see migration 0005_password_reset_required. only checked after
+	// the password, so it doesn't tell who has such an account.
+	if user.PasswordResetRequired {
+		return structs.User{}, false, ErrPasswordResetRequired
+	}
+
 	// if no error, return authenticated
 	return user, true, nil
 }
 
 func GetUserBySession(sessionId string, getCourses bool) (structs.User, bool, error) {
-	row := database.QueryRow("SELECT * FROM sessions WHERE uid = $1", sessionId)
-	if row.Err() != nil {
-		return structs.User{}, false, row.Err()
-	}
-
-	session := structs.Session{}
-	err := row.Scan(&session.UID, &session.UserID, &session.Created)
+	session, err := GetSessionById(sessionId)
 	if err != nil {
 		return structs.User{}, false, err
 	}
 
-	oldestPossible := time.Now().AddDate(0, 0, -structs.MaxSessionAge)
+	oldestPossible := time.Now().Add(-config.Get().Session.Lifetime)
 	if !session.Created.After(oldestPossible) {
 		return structs.User{}, false, nil
 	}
 
 	user, err := GetUserById(session.UserID.String(), getCourses)
 
-	go deleteOldSessions(structs.MaxSessionAge)
+	go deleteOldSessions(config.Get().Session.Lifetime)
 
 	return user, true, err
 }
 
+// SetPassword replaces the password of the user and clears a pending password reset
+func SetPassword(userID string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.Exec("UPDATE users SET password_hash = $1, password_reset_required = false WHERE id = $2", hash, userID)
+	return err
+}
+
+// SetEmailVerified marks the email address of the user as verified
+func SetEmailVerified(userID string) error {
+	_, err := database.Exec("UPDATE users SET email_verified = true WHERE id = $1", userID)
+	return err
+}
+
+// RequirePasswordReset makes the user unable to log in until the password has been reset
+func RequirePasswordReset(userID string) error {
+	_, err := database.Exec("UPDATE users SET password_reset_required = true WHERE id = $1", userID)
+	return err
+}
+
 func hashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	return string(bytes), err
 }
 
+// UpdateMoodleData connects the moodle account to the user. The token is stored encrypted.
 func UpdateMoodleData(user structs.User, moodleURL string, token string, moodleUserID int, getCourses bool) (structs.User, error) {
-	_, err := database.Exec("UPDATE users SET moodle_url = $1, moodle_token = $2, moodle_user_id = $3 WHERE id = $4", moodleURL, token, moodleUserID, user.ID.String())
+	encryptedToken, err := encryptSecret(token)
+	if err != nil {
+		return structs.User{}, err
+	}
 
+	// the token was just handed out by moodle, so it works
+	_, err = database.Exec("UPDATE users SET moodle_url = $1, moodle_token = $2, moodle_user_id = $3, moodle_status = $4, moodle_checked_at = $5 WHERE id = $6", moodleURL, encryptedToken, moodleUserID, structs.MoodleConnected, time.Now(), user.ID.String())
 	if err != nil {
 		return structs.User{}, err
 	}
@@ -137,12 +174,13 @@ func UpdateMoodleData(user structs.User, moodleURL string, token string, moodleU
 	return GetUserById(user.ID.String(), getCourses)
 }
 
-func scanUserRow(row *sql.Row, getCourses bool) (structs.User, error) {
+// scanUser scans a row selected with userColumns. Courses are not loaded.
+func scanUser(row rowScanner) (structs.User, error) {
 	var courseIds []int
 	var coursesJson string
 	var user structs.User
 
-	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Created, &user.Privilege, &coursesJson, &user.MoodleURL, &user.MoodleToken, &user.MoodleUserID)
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Created, &user.Role, &coursesJson, &user.MoodleURL, &user.MoodleToken, &user.MoodleUserID, &user.MoodleStatus, &user.PasswordResetRequired, &user.EmailVerified)
 	if err != nil {
 		return structs.User{}, err
 	}
@@ -151,8 +189,23 @@ func scanUserRow(row *sql.Row, getCourses bool) (structs.User, error) {
 		return structs.User{}, err
 	}
 
-	if user.MoodleToken != "" && user.MoodleURL != "" && getCourses {
-		user.Courses, err = GetMoodleUserCourses(user)
+	// if the key is missing, the user is treated as not connected to moodle instead of not being able to log in
+	if user.MoodleToken, err = decryptSecret(user.MoodleToken); err != nil {
+		logging.ErrorLogger.Printf("error decrypting the moodle token of %s: %v\n", user.ID, err)
+		user.MoodleToken = ""
+	}
+
+	return user, nil
+}
+
+func scanUserRow(row *sql.Row, getCourses bool) (structs.User, error) {
+	user, err := scanUser(row)
+	if err != nil {
+		return structs.User{}, err
+	}
+
+	if getCourses {
+		user.Courses, err = GetUserCourses(user)
 		if err != nil {
 			return user, err
 		}
@@ -161,6 +214,26 @@ func scanUserRow(row *sql.Row, getCourses bool) (structs.User, error) {
 	return user, nil
 }
 
+// GetUserCourses returns the moodle courses (if the user has connected moodle) and the native courses of the user
+func GetUserCourses(user structs.User) ([]structs.Course, error) {
+	var courses []structs.Course
+	if user.MoodleToken != "" && user.MoodleURL != "" {
+		moodleCourses, err := GetMoodleUserCourses(user)
+		if err != nil && err != ErrMoodleTokenExpired {
+			return nil, err
+		}
+		// without a working token there are only native courses, the user sees that moodle has to be connected again
+		courses = moodleCourses
+	}
+
+	nativeCourses, err := GetNativeUserCourses(user, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(courses, nativeCourses...), nil
+}
+
 // UsernameTaken returns true if there is a row with the username provided as an argument and false if there isn't
 func UsernameTaken(username string) (bool, error) {
 	row := database.QueryRow("select exists(select 1 from users where username = $1)", username)
@@ -192,21 +265,19 @@ func EmailTaken(email string) (bool, error) {
 }
 
 func getUsersFromIDs(ids []string) ([]structs.User, error) {
-	rows, err := database.Query("SELECT * FROM users WHERE id =ANY ($1::text[])", pq.Array(ids))
-	defer func() { _ = rows.Close() }()
+	if len(ids) == 0 {
+		return make([]structs.User, 0), nil
+	}
 
+	rows, err := database.Query("SELECT "+userColumns+" FROM users WHERE id = ANY($1::text[])", pq.Array(ids))
 	if err != nil {
 		return nil, err
 	}
+	defer func() { _ = rows.Close() }()
 
 	var users []structs.User = make([]structs.User, 0)
 	for rows.Next() {
-		var user structs.User
-
-		var coursesJson string
-
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.Created, &user.Privilege, &coursesJson, &user.MoodleURL, &user.MoodleToken, &user.MoodleUserID)
-
+		user, err := scanUser(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -217,5 +288,5 @@ func getUsersFromIDs(ids []string) ([]structs.User, error) {
 		users = append(users, user)
 	}
 
-	return users, nil
+	return users, rows.Err()
 }
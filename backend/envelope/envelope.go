@@ -0,0 +1,203 @@
+// Package envelope encrypts secrets that have to be stored, like moodle tokens. Every value is encrypted with its own
+// random data key (AES-256-GCM) and the data key is encrypted with a key encryption key from the configuration. Rotating
+// the key encryption key only re-encrypts the data keys.
+//
+// Encrypted values look like "enc:v1:<key id>:<encrypted data key>:<encrypted value>", both parts base64 encoded.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+)
+
+const prefix = "enc:v1:"
+
+var (
+	// ErrUnknownKey is returned for values encrypted with a key that isn't configured anymore
+	ErrUnknownKey = errors.New("the value was encrypted with an unknown key")
+	// ErrInvalidValue is returned for values that were changed or aren't encrypted values at all
+	ErrInvalidValue = errors.New("invalid encrypted value")
+)
+
+// Keyring encrypts values with the current key and decrypts values encrypted with any of the keys
+type Keyring struct {
+	keys    map[string]cipher.AEAD
+	current string
+}
+
+// NewKeyring returns a keyring with the keys of the configuration, which has to be validated
+func NewKeyring(cfg config.Encryption) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD), current: cfg.CurrentKey}
+
+	for id, key := range cfg.DecodedKeys() {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		k.keys[id] = aead
+	}
+
+	if _, ok := k.keys[k.current]; !ok {
+		return nil, fmt.Errorf("the current key %q is not configured", k.current)
+	}
+
+	return k, nil
+}
+
+// IsEncrypted returns true if value was returned by Encrypt. Anything else is a value stored before encryption was
+// set up.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt encrypts plaintext with a new data key, which is encrypted with the current key
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(data, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := seal(k.keys[k.current], dataKey, []byte(k.current))
+	if err != nil {
+		return "", err
+	}
+
+	return format(k.current, wrapped, ciphertext), nil
+}
+
+// Decrypt returns the plaintext of a value returned by Encrypt
+func (k *Keyring) Decrypt(value string) (string, error) {
+	id, dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(data, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("key %s: %v", id, err)
+	}
+
+	return string(plaintext), nil
+}
+
+// NeedsRotation returns true if value isn't encrypted or not encrypted with the current key
+func (k *Keyring) NeedsRotation(value string) bool {
+	if !IsEncrypted(value) {
+		return true
+	}
+
+	id, _, _, ok := split(value)
+	return !ok || id != k.current
+}
+
+// Rotate returns value with its data key encrypted with the current key. Values that aren't encrypted yet are
+// encrypted.
+func (k *Keyring) Rotate(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return k.Encrypt(value)
+	}
+
+	_, dataKey, ciphertext, err := k.unwrap(value)
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := seal(k.keys[k.current], dataKey, []byte(k.current))
+	if err != nil {
+		return "", err
+	}
+
+	return format(k.current, wrapped, ciphertext), nil
+}
+
+// unwrap decrypts the data key of value
+func (k *Keyring) unwrap(value string) (string, []byte, []byte, error) {
+	id, wrapped, ciphertext, ok := split(value)
+	if !ok {
+		return "", nil, nil, ErrInvalidValue
+	}
+
+	key, ok := k.keys[id]
+	if !ok {
+		return "", nil, nil, ErrUnknownKey
+	}
+
+	// the key id is authenticated, so a data key can't be passed off as encrypted with another key
+	dataKey, err := open(key, wrapped, []byte(id))
+	if err != nil {
+		return "", nil, nil, ErrInvalidValue
+	}
+
+	return id, dataKey, ciphertext, nil
+}
+
+func split(value string) (string, []byte, []byte, bool) {
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if !IsEncrypted(value) || len(parts) != 3 {
+		return "", nil, nil, false
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, false
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, false
+	}
+
+	return parts[0], wrapped, ciphertext, true
+}
+
+func format(id string, wrapped []byte, ciphertext []byte) string {
+	return prefix + id + ":" + base64.RawStdEncoding.EncodeToString(wrapped) + ":" + base64.RawStdEncoding.EncodeToString(ciphertext)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which is put in front of the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrInvalidValue
+	}
+
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], additionalData)
+}
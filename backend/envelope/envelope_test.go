@@ -0,0 +1,93 @@
+package envelope
+
+import (
+	"strings"
+	"testing"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+)
+
+const (
+	oldKey = "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+	newKey = "HxweHRwbGhkYFxYVFBMSERAPDg0MCwoJCAcGBQQDAgE="
+)
+
+func newTestKeyring(t *testing.T, current string, keys map[string]string) *Keyring {
+	k, err := NewKeyring(config.Encryption{Keys: keys, CurrentKey: current})
+	if err != nil {
+		t.Fatalf("error creating keyring: %v", err)
+	}
+
+	return k
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	k := newTestKeyring(t, "old", map[string]string{"old": oldKey})
+
+	encrypted, err := k.Encrypt("moodle token")
+	if err != nil {
+		t.Fatalf("error encrypting: %v", err)
+	}
+	if !IsEncrypted(encrypted) || strings.Contains(encrypted, "moodle token") {
+		t.Errorf("unexpected encrypted value %q", encrypted)
+	}
+
+	again, err := k.Encrypt("moodle token")
+	if err != nil {
+		t.Fatalf("error encrypting: %v", err)
+	}
+	if again == encrypted {
+		t.Errorf("encrypting the same value twice returned the same result")
+	}
+
+	decrypted, err := k.Decrypt(encrypted)
+	if err != nil || decrypted != "moodle token" {
+		t.Errorf("decrypting returned %q, %v", decrypted, err)
+	}
+
+	// flipping a character of the value must be noticed
+	tampered := encrypted[:len(encrypted)-2] + "A" + encrypted[len(encrypted)-1:]
+	if tampered == encrypted {
+		tampered = encrypted[:len(encrypted)-2] + "B" + encrypted[len(encrypted)-1:]
+	}
+	if _, err := k.Decrypt(tampered); err == nil {
+		t.Errorf("a changed value was decrypted")
+	}
+
+	if _, err := k.Decrypt("plain token"); err != ErrInvalidValue {
+		t.Errorf("decrypting a plain value returned %v, expected %v", err, ErrInvalidValue)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	old := newTestKeyring(t, "old", map[string]string{"old": oldKey})
+	encrypted, err := old.Encrypt("moodle token")
+	if err != nil {
+		t.Fatalf("error encrypting: %v", err)
+	}
+
+	k := newTestKeyring(t, "new", map[string]string{"old": oldKey, "new": newKey})
+	if !k.NeedsRotation(encrypted) || !k.NeedsRotation("plain token") {
+		t.Errorf("values that aren't encrypted with the current key should need rotation")
+	}
+
+	for _, value := range []string{encrypted, "plain token"} {
+		rotated, err := k.Rotate(value)
+		if err != nil {
+			t.Fatalf("error rotating: %v", err)
+		}
+		if k.NeedsRotation(rotated) {
+			t.Errorf("%q still needs rotation", rotated)
+		}
+
+		// after the rotation, the old key isn't needed anymore
+		decrypted, err := newTestKeyring(t, "new", map[string]string{"new": newKey}).Decrypt(rotated)
+		if err != nil || (decrypted != "moodle token" && decrypted != "plain token") {
+			t.Errorf("decrypting the rotated value returned %q, %v", decrypted, err)
+		}
+	}
+
+	if _, err := newTestKeyring(t, "new", map[string]string{"new": newKey}).Decrypt(encrypted); err != ErrUnknownKey {
+		t.Errorf("decrypting with a missing key returned %v, expected %v", err, ErrUnknownKey)
+	}
+}
@@ -16,21 +16,22 @@ var (
 	DebugLogger   *log.Logger
 )
 
-func InitLoggers(debug bool) {
+func InitLoggers(debug bool, logFile string) {
 	// logging
-	file, err := os.OpenFile("logs.txt", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	mw := io.MultiWriter(file, os.Stdout)
+	// secrets are removed before anything is written, whatever logged them
+	mw := redactingWriter{io.MultiWriter(file, os.Stdout)}
 	WarningLogger = log.New(mw, color.Yellow+"[WARNING] "+color.Reset, log.Ldate|log.Ltime|log.Lshortfile)
 	InfoLogger = log.New(mw, color.Cyan+"[INFO] "+color.Reset, log.Ldate|log.Ltime|log.Lshortfile)
 	ErrorLogger = log.New(mw, color.Red+"[ERROR] "+color.Reset, log.Ldate|log.Ltime|log.Lshortfile)
 
 	var debuggingWriter io.Writer
 	if debug {
-		debuggingWriter = os.Stdout
+		debuggingWriter = redactingWriter{os.Stdout}
 	} else {
 		debuggingWriter = ioutil.Discard
 	}
@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"io"
+	"regexp"
+)
+
+const redacted = "[REDACTED]"
+
+// parameters whose values are secrets, in query strings, form data and json
+const secretNames = `(?:wstoken|token|moodle_token|two_factor_token|password|current_password|secret|client_secret|code|code_verifier|state|recovery_codes)`
+
+var redactions = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// ?token=... and token=... in form data
+	{regexp.MustCompile(`\b(` + secretNames + `=)[^&\s"']+`), "${1}" + redacted},
+	// "token": "..." in json
+	{regexp.MustCompile(`("` + secretNames + `"\s*:\s*)"(?:[^"\\]|\\.)*"`), "${1}\"" + redacted + "\""},
+	// Authorization: Bearer ... and Basic ...
+	{regexp.MustCompile(`(?i)\b((?:bearer|basic) )[A-Za-z0-9._~+/=-]+`), "${1}" + redacted},
+	// personal access tokens, wherever they end up
+	{regexp.MustCompile(`\bhw_[A-Za-z0-9_-]{16,}`), "hw_" + redacted},
+	// encrypted values are safe to log, but there is no reason to
+	{regexp.MustCompile(`\benc:v1:[A-Za-z0-9_-]+:[A-Za-z0-9+/]+:[A-Za-z0-9+/]+`), "enc:v1:" + redacted},
+}
+
+// Redact replaces secrets like tokens and passwords in s
+func Redact(s string) string {
+	for _, r := range redactions {
+		s = r.pattern.ReplaceAllString(s, r.replacement)
+	}
+
+	return s
+}
+
+// redactingWriter redacts everything written to it before passing it on
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write([]byte(Redact(string(p)))); err != nil {
+		return 0, err
+	}
+
+	// the caller only cares whether all of p was handled, not how long the redacted version is
+	return len(p), nil
+}
@@ -0,0 +1,37 @@
+package logging
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	for _, line := range []string{
+		"POST request to /webservice/rest/server.php?wstoken=0123456789abcdef&wsfunction=core_user_get_users_by_field",
+		"GET request to /auth/oidc/school/callback?code=0123456789abcdef&state=0123456789abcdef",
+		"GET request to /verify-email?token=0123456789abcdef",
+		`error decoding {"username": "someone", "password": "0123456789abcdef"}`,
+		`moodle returned {"token":"0123456789abcdef","privatetoken":null}`,
+		"Authorization: Bearer 0123456789abcdef",
+		"unknown token hw_0123456789abcdef0123456789abcdef",
+		"stored enc:v1:2026:MDEyMzQ1Njc4OWFiY2RlZg:MDEyMzQ1Njc4OWFiY2RlZg",
+	} {
+		redactedLine := Redact(line)
+		if strings.Contains(redactedLine, "0123456789abcdef") || strings.Contains(redactedLine, "MDEyMzQ1Njc4OWFiY2RlZg") {
+			t.Errorf("secret was not redacted: %s", redactedLine)
+		}
+		if !strings.Contains(redactedLine, redacted) {
+			t.Errorf("%q is missing %s", redactedLine, redacted)
+		}
+	}
+
+	for _, line := range []string{
+		"GET request to /assignments?course=12",
+		"changed the role of someone from student to admin",
+		"two-factor code accepted",
+	} {
+		if got := Redact(line); got != line {
+			t.Errorf("%q was changed to %q", line, got)
+		}
+	}
+}
@@ -1,7 +1,120 @@
 package mail
 
-import "git.teich.3nt3.de/3nt3/homework/structs"
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
 
-func WelcomeMail(user structs.User) error {
-	return nil
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+)
+
+// templates are written like a mail: a Subject header, an empty line and the body
+//
+//go:embed templates/*.txt
+var templateFiles embed.FS
+
+var templates = template.Must(template.ParseFS(templateFiles, "templates/*.txt"))
+
+// Message is a plain text mail
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+var sender Sender
+
+// SetSender sets the Sender used for all mails. Until it is called, sending fails.
+func SetSender(s Sender) {
+	sender = s
+}
+
+type templateData struct {
+	User     structs.User
+	Link     string
+	ValidFor string
+}
+
+// WelcomeMail greets a new user and asks them to verify their email address with the token
+func WelcomeMail(user structs.User, verifyToken string) error {
+	return sendTemplate("welcome.txt", user, link("/verify-email", verifyToken), config.Get().Mail.VerifyEmailTokenLifetime)
+}
+
+// VerifyEmailMail asks the user to verify their email address with the token
+func VerifyEmailMail(user structs.User, verifyToken string) error {
+	return sendTemplate("verify_email.txt", user, link("/verify-email", verifyToken), config.Get().Mail.VerifyEmailTokenLifetime)
+}
+
+// ResetPasswordMail sends the user a link to choose a new password with the token
+func ResetPasswordMail(user structs.User, resetToken string) error {
+	return sendTemplate("reset_password.txt", user, link("/reset-password", resetToken), config.Get().Mail.ResetPasswordTokenLifetime)
+}
+
+func sendTemplate(name string, user structs.User, link string, validFor time.Duration) error {
+	if sender == nil {
+		return errors.New("no mail sender configured")
+	}
+
+	msg, err := render(name, user.Email, templateData{User: user, Link: link, ValidFor: formatDuration(validFor)})
+	if err != nil {
+		return err
+	}
+
+	return sender.Send(msg)
+}
+
+// render executes the template and splits the result into subject and body
+func render(name string, to string, data templateData) (Message, error) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		return Message{}, err
+	}
+
+	parsed, err := netmail.ReadMessage(&buf)
+	if err != nil {
+		return Message{}, fmt.Errorf("template %s is not a valid mail: %v", name, err)
+	}
+
+	body, err := ioutil.ReadAll(parsed.Body)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		To:      to,
+		Subject: parsed.Header.Get("Subject"),
+		Body:    string(body),
+	}, nil
+}
+
+// link returns the frontend url at path with the token as query parameter
+func link(path string, token string) string {
+	return strings.TrimSuffix(config.Get().Server.FrontendURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// formatDuration formats token lifetimes for humans, e.g. "7 days" or "1 hour"
+func formatDuration(d time.Duration) string {
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s", unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		return plural(int64(d/(24*time.Hour)), "day")
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int64(d/time.Hour), "hour")
+	default:
+		return plural(int64(d/time.Minute), "minute")
+	}
 }
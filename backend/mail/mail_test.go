@@ -0,0 +1,96 @@
+package mail
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/structs"
+)
+
+func TestTemplates(t *testing.T) {
+	user := structs.User{Username: "jane", Email: "jane@example.com"}
+
+	sent := NewMemorySender()
+	SetSender(sent)
+	defer SetSender(nil)
+
+	send := map[string]func(structs.User, string) error{
+		"welcome":        WelcomeMail,
+		"verify email":   VerifyEmailMail,
+		"reset password": ResetPasswordMail,
+	}
+
+	for name, f := range send {
+		if err := f(user, "s3cr3t-token"); err != nil {
+			t.Fatalf("error sending %s mail: %v", name, err)
+		}
+
+		msg, ok := sent.LastTo("jane@example.com")
+		if !ok {
+			t.Fatalf("%s mail was not sent", name)
+		}
+
+		if msg.Subject == "" || strings.Contains(msg.Body, "Subject:") {
+			t.Errorf("%s mail was not split into subject and body: %+v", name, msg)
+		}
+		if !strings.Contains(msg.Body, "jane") || !strings.Contains(msg.Body, "?token=s3cr3t-token") {
+			t.Errorf("%s mail is missing the user or the link: %s", name, msg.Body)
+		}
+	}
+
+	if len(sent.Messages()) != len(send) {
+		t.Errorf("%d mails were sent, expected %d", len(sent.Messages()), len(send))
+	}
+}
+
+func TestSendWithoutSender(t *testing.T) {
+	SetSender(nil)
+
+	if err := WelcomeMail(structs.User{Email: "jane@example.com"}, "token"); err == nil {
+		t.Errorf("sending without a sender should fail")
+	}
+}
+
+func TestFileSender(t *testing.T) {
+	dir := t.TempDir()
+	s := &FileSender{Directory: filepath.Join(dir, "mails"), From: "homework <noreply@example.com>"}
+
+	err := s.Send(Message{To: "../jane@example.com", Subject: "Hi\r\nBcc: everyone@example.com", Body: "line one\nline two"})
+	if err != nil {
+		t.Fatalf("error sending: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "mails", "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected exactly one mail in the directory, got %v (%v)", files, err)
+	}
+
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("error reading mail: %v", err)
+	}
+
+	if strings.Contains(string(content), "\r\nBcc:") {
+		t.Errorf("line breaks in the subject must not add headers:\n%s", content)
+	}
+	if !strings.Contains(string(content), "line one\r\nline two") {
+		t.Errorf("body is missing or has the wrong line endings:\n%s", content)
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		7 * 24 * time.Hour: "7 days",
+		24 * time.Hour:     "1 day",
+		time.Hour:          "1 hour",
+		36 * time.Hour:     "36 hours",
+		90 * time.Minute:   "90 minutes",
+	} {
+		if formatDuration(d) != expected {
+			t.Errorf("formatDuration(%v) = %q, expected %q", d, formatDuration(d), expected)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+)
+
+// Sender delivers mails
+type Sender interface {
+	Send(msg Message) error
+}
+
+// NewSender returns the Sender configured in the [mail] table of the config
+func NewSender(cfg config.Mail) (Sender, error) {
+	switch cfg.Sender {
+	case "smtp":
+		return &SMTPSender{
+			Host:     cfg.SMTP.Host,
+			Port:     cfg.SMTP.Port,
+			Username: cfg.SMTP.Username,
+			Password: cfg.SMTP.Password,
+			From:     cfg.From,
+		}, nil
+	case "file":
+		return &FileSender{Directory: cfg.Directory, From: cfg.From}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail sender %q", cfg.Sender)
+	}
+}
+
+// SMTPSender sends mails through an SMTP server. If Username is set, it authenticates with PLAIN auth, which net/smtp
+// only allows over TLS or to localhost.
+type SMTPSender struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPSender) Send(msg Message) error {
+	from, err := netmail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address %q: %v", s.From, err)
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	addr := s.Host + ":" + strconv.Itoa(s.Port)
+	return smtp.SendMail(addr, auth, from.Address, []string{msg.To}, msg.bytes(s.From))
+}
+
+// FileSender writes every mail to its own file in Directory instead of sending it. Useful for development.
+type FileSender struct {
+	Directory string
+	From      string
+}
+
+func (s *FileSender) Send(msg Message) error {
+	if err := os.MkdirAll(s.Directory, 0700); err != nil {
+		return err
+	}
+
+	// the recipient is part of the name so mails are easy to find, but it must not be able to escape the directory
+	recipient := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, msg.To)
+
+	name := fmt.Sprintf("%s_%s.eml", time.Now().Format("20060102-150405.000000000"), recipient)
+	return ioutil.WriteFile(filepath.Join(s.Directory, name), msg.bytes(s.From), 0600)
+}
+
+// MemorySender keeps all mails in memory, tests use it to look at what would have been sent
+type MemorySender struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemorySender() *MemorySender {
+	return &MemorySender{}
+}
+
+func (s *MemorySender) Send(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+// Messages returns all mails sent so far, oldest first
+func (s *MemorySender) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Message(nil), s.messages...)
+}
+
+// LastTo returns the last mail sent to the address
+func (s *MemorySender) LastTo(address string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].To == address {
+			return s.messages[i], true
+		}
+	}
+
+	return Message{}, false
+}
+
+// bytes formats the message as an RFC 5322 mail
+func (m Message) bytes(from string) []byte {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&buf, "To: %s\r\n", headerValue(m.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(m.Subject)))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(m.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return buf.Bytes()
+}
+
+// headerValue removes line breaks so values can't add headers of their own
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
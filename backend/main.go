@@ -1,84 +1,175 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
+	"flag"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/pelletier/go-toml"
-
+	"git.teich.3nt3.de/3nt3/homework/config"
 	"git.teich.3nt3.de/3nt3/homework/db"
 	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/mail"
 	"git.teich.3nt3.de/3nt3/homework/routes"
+	"git.teich.3nt3.de/3nt3/homework/structs"
 	"github.com/gorilla/mux"
 )
 
 func main() {
-
-	port := 8005
-	// test
+	configPath := flag.String("config", "config.toml", "path to the config file")
+	flag.Parse()
 
 	// configuration
-	bytes, err := ioutil.ReadFile("config.toml")
+	// the config file only has to exist if it was explicitly specified
+	configRequired := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configRequired = true
+		}
+	})
+
+	cfg, err := config.Load(*configPath, configRequired)
 	if err != nil {
-		logging.ErrorLogger.Printf("error reading config.toml: %s\n", err.Error())
+		// the loggers can't be set up without a config, so this is all we can do
+		log.Fatalf("error loading config: %v\n", err)
+	}
+	config.Set(cfg)
+
+	logging.InitLoggers(cfg.Debugging, cfg.LogFile)
+	logging.DebugLogger.Printf("debugging mode activated (debug = true in config.toml)")
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(cfg.Database, flag.Args()[1:]); err != nil {
+			logging.ErrorLogger.Printf("error migrating: %v\n", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	config, err := toml.Load(string(bytes))
-	if err != nil {
-		logging.ErrorLogger.Printf("error reading config.toml: %s\n", err.Error())
+	if flag.Arg(0) == "set-role" {
+		if err := runSetRoleCommand(cfg.Database, flag.Args()[1:]); err != nil {
+			logging.ErrorLogger.Printf("error setting role: %v\n", err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	logging.InitLoggers(config.Get("debugging").(bool))
-	logging.DebugLogger.Printf("debugging mode activated (debug = true in config.toml)")
+	if flag.Arg(0) == "rotate-keys" {
+		if err := runRotateKeysCommand(cfg.Database, cfg.Encryption); err != nil {
+			logging.ErrorLogger.Printf("error rotating keys: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := db.InitEncryption(cfg.Encryption); err != nil {
+		logging.ErrorLogger.Printf("error setting up encryption: %v\n", err)
+		os.Exit(1)
+	}
+
+	sender, err := mail.NewSender(cfg.Mail)
+	if err != nil {
+		logging.ErrorLogger.Printf("error setting up mail: %v\n", err)
+		os.Exit(1)
+	}
+	mail.SetSender(sender)
 
-	err = db.InitDatabase(false)
+	routes.InitRateLimits(cfg.RateLimit)
+	routes.InitOIDC(cfg.OIDC)
+	routes.InitMoodle(cfg.Moodle, nil)
+
+	err = db.InitDatabase(cfg.Database, false)
 
 	if err != nil {
 		logging.ErrorLogger.Printf("error connecting to db: %v\n", err)
 		return
 	}
 
+	routes.StartMoodleTokenChecks(cfg.Moodle)
+	routes.StartMoodleAssignmentSync(cfg.Moodle)
+
 	InterruptHandler()
 
 	r := mux.NewRouter()
 	r.Methods("OPTIONS").HandlerFunc(handlePreflight)
 
+	// routes are public, routes.Authenticated (a valid session is required, handlers get the user from the request
+	// context), routes.Scoped (like Authenticated, but personal access tokens with the scope work as well) or
+	// routes.RequirePermission (the user's role also has to grant a permission, e.g. for admin routes)
+
 	// /user routes
-	r.HandleFunc("/user/register", routes.NewUser).Methods("POST")
-	r.HandleFunc("/user", routes.GetUser).Methods("GET")
-	r.HandleFunc("/user/login", routes.Login).Methods("POST")
+	r.HandleFunc("/user/register", routes.RateLimited(routes.NewUser)).Methods("POST")
+	r.HandleFunc("/user", routes.TwoFactorSetup(routes.GetUser)).Methods("GET")
+	r.HandleFunc("/user/login", routes.RateLimited(routes.Login)).Methods("POST")
 	r.HandleFunc("/user/online-users", routes.OnlineUsers).Methods("GET")
+	r.HandleFunc("/user/logout", routes.Logout).Methods("POST")
+	r.HandleFunc("/user/password", routes.Authenticated(routes.ChangePassword)).Methods("PUT")
+	r.HandleFunc("/user/password-reset", routes.RateLimited(routes.PasswordReset)).Methods("POST")
+	r.HandleFunc("/user/verify-email", routes.RateLimited(routes.VerifyEmail)).Methods("POST")
+	r.HandleFunc("/user/sessions", routes.Authenticated(routes.GetSessions)).Methods("GET")
+	r.HandleFunc("/user/sessions", routes.Authenticated(routes.RevokeOtherSessions)).Methods("DELETE")
+	r.HandleFunc("/user/sessions/{id}", routes.Authenticated(routes.RevokeSession)).Methods("DELETE")
+	r.HandleFunc("/user/tokens", routes.Authenticated(routes.GetAPITokens)).Methods("GET")
+	r.HandleFunc("/user/tokens", routes.Authenticated(routes.CreateAPIToken)).Methods("POST")
+	r.HandleFunc("/user/tokens/{id}", routes.Authenticated(routes.RevokeAPIToken)).Methods("DELETE")
+	r.HandleFunc("/user/identities", routes.Authenticated(routes.GetIdentities)).Methods("GET")
+	r.HandleFunc("/user/identities/{provider}", routes.Authenticated(routes.LinkIdentity)).Methods("POST")
+	r.HandleFunc("/user/identities/{provider}", routes.Authenticated(routes.UnlinkIdentity)).Methods("DELETE")
+	r.HandleFunc("/user/two-factor", routes.TwoFactorSetup(routes.GetTwoFactor)).Methods("GET")
+	r.HandleFunc("/user/two-factor", routes.RateLimited(routes.TwoFactorSetup(routes.SetUpTwoFactor))).Methods("POST")
+	r.HandleFunc("/user/two-factor", routes.RateLimited(routes.Authenticated(routes.DisableTwoFactor))).Methods("DELETE")
+	r.HandleFunc("/user/two-factor/enable", routes.TwoFactorSetup(routes.EnableTwoFactor)).Methods("POST")
+	r.HandleFunc("/user/two-factor/recovery-codes", routes.RateLimited(routes.Authenticated(routes.RegenerateRecoveryCodes))).Methods("POST")
 	r.HandleFunc("/user/{id}", routes.GetUserById).Methods("GET")
 
+	// /auth routes, logging in with an identity provider
+	r.HandleFunc("/auth/oidc/providers", routes.GetIdentityProviders).Methods("GET")
+	r.HandleFunc("/auth/oidc/{provider}/login", routes.RateLimited(routes.OIDCLogin)).Methods("GET")
+	r.HandleFunc("/auth/oidc/{provider}/callback", routes.RateLimited(routes.OIDCCallback)).Methods("GET")
+
 	// misc
-	r.HandleFunc("/username-taken/{username}", routes.UsernameTaken)
-	r.HandleFunc("/email-taken/{email}", routes.EmailTaken)
+	r.HandleFunc("/username-taken/{username}", routes.RateLimited(routes.UsernameTaken))
+	r.HandleFunc("/email-taken/{email}", routes.RateLimited(routes.EmailTaken))
 
 	// /assignment routes
-	r.HandleFunc("/assignment/{id}", routes.GetAssignment).Methods("GET")
-	r.HandleFunc("/assignment", routes.CreateAssignment).Methods("POST")
-	r.HandleFunc("/assignment", routes.DeleteAssignment).Methods("DELETE")
-	r.HandleFunc("/assignment/{id}", routes.UpdateAssignment).Methods("PUT")
-	r.HandleFunc("/assignment/{id}/done", func(w http.ResponseWriter, r *http.Request) { routes.AssignmentDone(w, r, true) }).Methods("POST")
-	r.HandleFunc("/assignment/{id}/undone", func(w http.ResponseWriter, r *http.Request) { routes.AssignmentDone(w, r, false) }).Methods("POST")
-	r.HandleFunc("/assignments", routes.GetAssignments).Methods("GET")
-	r.HandleFunc("/assignments/contributors", routes.GetContributors).Methods("GET")
-	r.HandleFunc("/assignments/contributors/all", routes.GetContributorsAdmin).Methods("GET")
+	r.HandleFunc("/assignment/{id}", routes.Scoped(structs.ScopeAssignmentsRead, routes.GetAssignment)).Methods("GET")
+	r.HandleFunc("/assignment", routes.Scoped(structs.ScopeAssignmentsWrite, routes.CreateAssignment)).Methods("POST")
+	r.HandleFunc("/assignment", routes.Scoped(structs.ScopeAssignmentsWrite, routes.DeleteAssignment)).Methods("DELETE")
+	r.HandleFunc("/assignment/{id}", routes.Scoped(structs.ScopeAssignmentsWrite, routes.UpdateAssignment)).Methods("PUT")
+	r.HandleFunc("/assignment/{id}/done", routes.Scoped(structs.ScopeAssignmentsWrite, func(w http.ResponseWriter, r *http.Request) { routes.AssignmentDone(w, r, true) })).Methods("POST")
+	r.HandleFunc("/assignment/{id}/undone", routes.Scoped(structs.ScopeAssignmentsWrite, func(w http.ResponseWriter, r *http.Request) { routes.AssignmentDone(w, r, false) })).Methods("POST")
+	r.HandleFunc("/assignments", routes.Scoped(structs.ScopeAssignmentsRead, routes.GetAssignments)).Methods("GET")
+	r.HandleFunc("/assignments/contributors", routes.Authenticated(routes.GetContributors)).Methods("GET")
+	r.HandleFunc("/assignments/contributors/all", routes.RequirePermission(structs.PermissionViewContributors, routes.GetContributorsAdmin)).Methods("GET")
+
+	// /admin routes
+	r.HandleFunc("/admin/roles", routes.RequirePermission(structs.PermissionManageRoles, routes.GetRoles)).Methods("GET")
+	r.HandleFunc("/admin/roles/{role}", routes.RequirePermission(structs.PermissionManageRoles, routes.UpdateRole)).Methods("PUT")
+	r.HandleFunc("/admin/users/{id}/role", routes.RequirePermission(structs.PermissionManageRoles, routes.SetUserRole)).Methods("PUT")
+	r.HandleFunc("/admin/role-changes", routes.RequirePermission(structs.PermissionViewAuditLog, routes.GetRoleChanges)).Methods("GET")
 
 	// /courses routes
-	r.HandleFunc("/courses/active", routes.GetActiveCourses)
-	r.HandleFunc("/courses/search/{searchterm}", routes.SearchCourses)
-	r.HandleFunc("/courses/stats", routes.GetCourseStats).Methods("GET")
+	r.HandleFunc("/courses", routes.Scoped(structs.ScopeCoursesRead, routes.GetAllCourses)).Methods("GET")
+	r.HandleFunc("/courses", routes.Authenticated(routes.CreateCourse)).Methods("POST")
+	r.HandleFunc("/courses/{id:-[0-9]+}", routes.Scoped(structs.ScopeCoursesRead, routes.GetCourse)).Methods("GET")
+	r.HandleFunc("/courses/{id:-[0-9]+}", routes.Authenticated(routes.UpdateCourse)).Methods("PUT")
+	r.HandleFunc("/courses/join", routes.Authenticated(routes.JoinCourse)).Methods("POST")
+	r.HandleFunc("/courses/{id:-[0-9]+}/leave", routes.Authenticated(routes.LeaveCourse)).Methods("POST")
+	r.HandleFunc("/courses/{id:-[0-9]+}/invite-code", routes.Authenticated(routes.RegenerateInviteCode)).Methods("POST")
+	r.HandleFunc("/courses/{id:-[0-9]+}/members", routes.Authenticated(routes.GetCourseMembers)).Methods("GET")
+	r.HandleFunc("/courses/{id:-[0-9]+}/members/{user_id}", routes.Authenticated(routes.UpdateCourseMember)).Methods("PUT")
+	r.HandleFunc("/courses/{id:-[0-9]+}/members/{user_id}", routes.Authenticated(routes.RemoveCourseMember)).Methods("DELETE")
+	r.HandleFunc("/courses/active", routes.Scoped(structs.ScopeCoursesRead, routes.GetActiveCourses))
+	r.HandleFunc("/courses/search/{searchterm}", routes.Scoped(structs.ScopeCoursesRead, routes.SearchCourses))
+	r.HandleFunc("/courses/stats", routes.Authenticated(routes.GetCourseStats)).Methods("GET")
 
 	// /moodle routes
-	r.HandleFunc("/moodle/authenticate", routes.MoodleAuthenticate).Methods("POST")
+	r.HandleFunc("/moodle/authenticate", routes.Authenticated(routes.MoodleAuthenticate)).Methods("POST")
+	r.HandleFunc("/moodle/authenticate", routes.Authenticated(routes.MoodleDisconnect)).Methods("DELETE")
+	r.HandleFunc("/moodle/login", routes.RateLimited(routes.MoodleLogin)).Methods("POST")
 	r.HandleFunc("/moodle/get-school-info", routes.MoodleGetSchoolInfo).Methods("POST")
 	// TODO: /moodle/get-courses
 
@@ -87,8 +178,8 @@ func main() {
 	r.Use(loggingMiddleware)
 	r.Use(corsMiddleware)
 
-	logging.InfoLogger.Printf("started server on port %d", port)
-	logging.ErrorLogger.Fatalln(http.ListenAndServe(fmt.Sprintf(":%d", port), r).Error())
+	logging.InfoLogger.Printf("started server on %s", cfg.Server.ListenAddress)
+	logging.ErrorLogger.Fatalln(http.ListenAndServe(cfg.Server.ListenAddress, r).Error())
 }
 
 func InterruptHandler() {
@@ -133,10 +224,15 @@ func corsMiddleware(h http.Handler) http.Handler {
 }
 
 func handlePreflight(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if !config.Get().Server.OriginAllowed(origin) {
+		return
+	}
+
 	// set cors headers
-	// very secure lol
-	w.Header().Add("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+	w.Header().Add("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
 	w.Header().Add("Access-Control-Allow-Credentials", "true")
-	w.Header().Add("Access-Control-Allow-Headers", "Content-Type, x-requested-with, Origin")
+	w.Header().Add("Access-Control-Allow-Headers", "Content-Type, Authorization, x-requested-with, Origin")
 	w.Header().Add("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE, OPTIONS")
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+)
+
+// runMigrateCommand handles `homework migrate [up|down [steps]|status]`
+func runMigrateCommand(dbConfig config.Database, args []string) error {
+	if err := db.Connect(dbConfig); err != nil {
+		return fmt.Errorf("error connecting to db: %v", err)
+	}
+	defer db.CloseConnection()
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		if err := db.Migrate(); err != nil {
+			return err
+		}
+		logging.InfoLogger.Printf("all migrations applied")
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps: %s", args[1])
+			}
+		}
+
+		if err := db.MigrateDown(steps); err != nil {
+			return err
+		}
+	case "status":
+		states, err := db.GetMigrationStates()
+		if err != nil {
+			return err
+		}
+
+		for _, state := range states {
+			if state.Applied {
+				fmt.Printf("%04d_%s\tapplied at %s\n", state.Version, state.Name, state.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("%04d_%s\tpending\n", state.Version, state.Name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", command)
+	}
+
+	return nil
+}
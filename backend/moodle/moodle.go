@@ -0,0 +1,370 @@
+// Package moodle calls the web service API of moodle instances with the token of the moodle mobile app.
+package moodle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidLogin is returned by Token if moodle rejects the username or password
+var ErrInvalidLogin = errors.New("invalid moodle username or password")
+
+// Exception is what moodle responds with instead of the result if a request fails
+type Exception struct {
+	Exception string `json:"exception"`
+	ErrorCode string `json:"errorcode"`
+	Message   string `json:"message"`
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("moodle returned %s: %s", e.ErrorCode, e.Message)
+}
+
+// TokenRejected returns true if the request failed because the token doesn't work (anymore)
+func (e *Exception) TokenRejected() bool {
+	return e.ErrorCode == "invalidtoken" || e.ErrorCode == "accessexception"
+}
+
+// TokenRejected returns true if err is an Exception because moodle rejected the token
+func TokenRejected(err error) bool {
+	var e *Exception
+	return errors.As(err, &e) && e.TokenRejected()
+}
+
+// User is a moodle account
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// SiteInfo describes the moodle instance and who the token belongs to
+type SiteInfo struct {
+	SiteName string `json:"sitename"`
+	UserID   int    `json:"userid"`
+	Username string `json:"username"`
+}
+
+// Course is a course a moodle user is enrolled in
+type Course struct {
+	ID          int    `json:"id"`
+	ShortName   string `json:"shortname"`
+	FullName    string `json:"fullname"`
+	DisplayName string `json:"displayname"`
+}
+
+// Assignment is an assignment activity of a moodle course
+type Assignment struct {
+	ID int `json:"id"`
+	// CourseModuleID identifies the activity in the course, e.g. in links to it
+	CourseModuleID int    `json:"cmid"`
+	Course         int    `json:"course"`
+	Name           string `json:"name"`
+	// DueDate is a unix timestamp, 0 if the assignment has no due date
+	DueDate int64 `json:"duedate"`
+}
+
+// Event is an action event of the calendar of a moodle user, like an assignment that is due
+type Event struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	ModuleName string `json:"modulename"`
+	// Instance is the id of the activity in its module, e.g. the assignment id of events of "assign"
+	Instance int `json:"instance"`
+	// TimeSort is when the action is due as a unix timestamp
+	TimeSort int64 `json:"timesort"`
+	Course   struct {
+		ID int `json:"id"`
+	} `json:"course"`
+}
+
+// SubmissionSubmitted is the status of submissions that were submitted for grading
+const SubmissionSubmitted = "submitted"
+
+// Submission is the latest attempt of a moodle user at an assignment
+type Submission struct {
+	// Status is e.g. "new" if nothing was handed in yet, "draft" or SubmissionSubmitted
+	Status string `json:"status"`
+	// TimeModified is a unix timestamp
+	TimeModified int64 `json:"timemodified"`
+}
+
+// actionEventsPage is how many events moodle returns at most for one request
+const actionEventsPage = 50
+
+// Client sends requests to moodle instances. The address of an instance is passed to every call, it has to be
+// normalized with NormalizeURL.
+type Client struct {
+	http *http.Client
+}
+
+// NewClient returns a client whose requests time out after timeout. A nil transport is http.DefaultTransport.
+func NewClient(timeout time.Duration, transport http.RoundTripper) *Client {
+	return &Client{http: &http.Client{Timeout: timeout, Transport: transport}}
+}
+
+// NormalizeURL returns the address of a moodle instance the way it is stored, always with https and without a trailing
+// slash, so the same instance isn't stored in different ways
+func NormalizeURL(rawURL string) (string, bool) {
+	rawURL = strings.TrimSpace(rawURL)
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "https://" + rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", false
+	}
+
+	u.Scheme = "https"
+	u.Host = strings.ToLower(u.Host)
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return strings.TrimSuffix(u.String(), "/"), true
+}
+
+// Token exchanges the credentials of a moodle user for a token of the mobile app. Wrong credentials return
+// ErrInvalidLogin.
+func (c *Client) Token(ctx context.Context, baseURL string, username string, password string) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+		// the token endpoint calls the message error
+		Error     string `json:"error"`
+		ErrorCode string `json:"errorcode"`
+	}
+	err := c.post(ctx, baseURL+"/login/token.php?service=moodle_mobile_app", url.Values{
+		"username": {username},
+		"password": {password},
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case resp.ErrorCode == "invalidlogin":
+		return "", ErrInvalidLogin
+	case resp.ErrorCode != "":
+		return "", &Exception{ErrorCode: resp.ErrorCode, Message: resp.Error}
+	case resp.Token == "":
+		return "", errors.New("moodle returned no token")
+	}
+
+	return resp.Token, nil
+}
+
+// Call calls the web service function with the token and decodes the result into result. If moodle fails, an
+// *Exception is returned.
+func (c *Client) Call(ctx context.Context, baseURL string, token string, function string, params url.Values, result interface{}) error {
+	form := url.Values{}
+	for key, values := range params {
+		form[key] = values
+	}
+	form.Set("wstoken", token)
+	form.Set("wsfunction", function)
+	form.Set("moodlewsrestformat", "json")
+
+	return c.post(ctx, baseURL+"/webservice/rest/server.php", form, result)
+}
+
+// SiteInfo returns the site info, which also tells who the token belongs to
+func (c *Client) SiteInfo(ctx context.Context, baseURL string, token string) (SiteInfo, error) {
+	var info SiteInfo
+	err := c.Call(ctx, baseURL, token, "core_webservice_get_site_info", nil, &info)
+	return info, err
+}
+
+// UserByUsername returns the moodle user with the username. If there is none, the returned user has the id 0.
+func (c *Client) UserByUsername(ctx context.Context, baseURL string, token string, username string) (User, error) {
+	var users []User
+	err := c.Call(ctx, baseURL, token, "core_user_get_users_by_field", url.Values{
+		"field":     {"username"},
+		"values[0]": {username},
+	}, &users)
+	if err != nil || len(users) == 0 {
+		return User{}, err
+	}
+
+	return users[0], nil
+}
+
+// UserCourses returns the courses the moodle user is enrolled in
+func (c *Client) UserCourses(ctx context.Context, baseURL string, token string, userID int) ([]Course, error) {
+	var courses []Course
+	err := c.Call(ctx, baseURL, token, "core_enrol_get_users_courses", url.Values{
+		"userid": {strconv.Itoa(userID)},
+	}, &courses)
+	return courses, err
+}
+
+// Assignments returns the assignments of the courses the token can see
+func (c *Client) Assignments(ctx context.Context, baseURL string, token string, courseIDs []int) ([]Assignment, error) {
+	if len(courseIDs) == 0 {
+		return nil, nil
+	}
+
+	params := url.Values{}
+	for i, id := range courseIDs {
+		params.Set("courseids["+strconv.Itoa(i)+"]", strconv.Itoa(id))
+	}
+
+	var result struct {
+		Courses []struct {
+			ID          int          `json:"id"`
+			Assignments []Assignment `json:"assignments"`
+		} `json:"courses"`
+	}
+	if err := c.Call(ctx, baseURL, token, "mod_assign_get_assignments", params, &result); err != nil {
+		return nil, err
+	}
+
+	var assignments []Assignment
+	for _, course := range result.Courses {
+		assignments = append(assignments, course.Assignments...)
+	}
+
+	return assignments, nil
+}
+
+// ActionEvents returns the action events of the calendar of the token's user that are due after from, ordered by when
+// they are due
+func (c *Client) ActionEvents(ctx context.Context, baseURL string, token string, from time.Time) ([]Event, error) {
+	var events []Event
+	afterEventID := 0
+	for {
+		var result struct {
+			Events []Event `json:"events"`
+			LastID int     `json:"lastid"`
+		}
+		err := c.Call(ctx, baseURL, token, "core_calendar_get_action_events_by_timesort", url.Values{
+			"timesortfrom": {strconv.FormatInt(from.Unix(), 10)},
+			"aftereventid": {strconv.Itoa(afterEventID)},
+			"limitnum":     {strconv.Itoa(actionEventsPage)},
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, result.Events...)
+		// moodle doesn't say whether there are more, only a full page might be followed by another one
+		if len(result.Events) < actionEventsPage || result.LastID == 0 || result.LastID == afterEventID {
+			return events, nil
+		}
+		afterEventID = result.LastID
+	}
+}
+
+// SubmissionStatus returns the latest submission of the token's user for the assignment. For group assignments, it is
+// the submission of the group. Users who never opened the assignment have no submission, its Status is empty.
+func (c *Client) SubmissionStatus(ctx context.Context, baseURL string, token string, assignmentID int) (Submission, error) {
+	var result struct {
+		LastAttempt struct {
+			Submission     *Submission `json:"submission"`
+			TeamSubmission *Submission `json:"teamsubmission"`
+		} `json:"lastattempt"`
+	}
+	err := c.Call(ctx, baseURL, token, "mod_assign_get_submission_status", url.Values{
+		"assignid": {strconv.Itoa(assignmentID)},
+	}, &result)
+	if err != nil {
+		return Submission{}, err
+	}
+
+	switch {
+	case result.LastAttempt.TeamSubmission != nil:
+		return *result.LastAttempt.TeamSubmission, nil
+	case result.LastAttempt.Submission != nil:
+		return *result.LastAttempt.Submission, nil
+	default:
+		return Submission{}, nil
+	}
+}
+
+// PublicConfig returns the public configuration of the moodle instance, like its name and logo. It doesn't need a
+// token.
+func (c *Client) PublicConfig(ctx context.Context, baseURL string) (json.RawMessage, error) {
+	args, err := json.Marshal([]map[string]interface{}{{
+		"index":      0,
+		"methodname": "tool_mobile_get_public_config",
+		"args":       map[string]interface{}{},
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/lib/ajax/service-nologin.php?"+url.Values{"args": {string(args)}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the ajax service answers with one result per method
+	var results []struct {
+		Error     bool            `json:"error"`
+		Data      json.RawMessage `json:"data"`
+		Exception *Exception      `json:"exception"`
+	}
+	if err := c.do(req, &results); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(results) == 0:
+		return nil, errors.New("moodle returned no public config")
+	case results[0].Error && results[0].Exception != nil:
+		return nil, results[0].Exception
+	case results[0].Error || len(results[0].Data) == 0:
+		return nil, errors.New("moodle returned no public config")
+	}
+
+	return results[0].Data, nil
+}
+
+func (c *Client) post(ctx context.Context, endpoint string, form url.Values, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return c.do(req, result)
+}
+
+// do sends the request and decodes the response into result, unless moodle responded with an exception
+func (c *Client) do(req *http.Request, result interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("moodle responded with status %d", resp.StatusCode)
+	}
+
+	// limited, so a broken instance can't fill the memory
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return err
+	}
+
+	// exceptions are objects with an errorcode, even where the result is an array
+	var exception Exception
+	if err := json.Unmarshal(body, &exception); err == nil && exception.Exception != "" && exception.ErrorCode != "" {
+		return &exception
+	}
+
+	if err := json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("error decoding moodle response: %v", err)
+	}
+
+	return nil
+}
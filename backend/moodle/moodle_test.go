@@ -0,0 +1,189 @@
+package moodle_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/moodle"
+	"git.teich.3nt3.de/3nt3/homework/moodle/moodletest"
+)
+
+func newTestServer(t *testing.T) (*moodletest.Server, *moodle.Client) {
+	server := moodletest.NewServer(moodletest.User{
+		ID:       3,
+		Username: "jane",
+		Password: "moodle password",
+		Email:    "jane@example.com",
+		Courses:  []moodle.Course{{ID: 12, ShortName: "ma", FullName: "Mathematics", DisplayName: "Maths"}},
+	})
+	t.Cleanup(server.Close)
+
+	return server, moodle.NewClient(5*time.Second, server.Transport())
+}
+
+func TestClient(t *testing.T) {
+	server, client := newTestServer(t)
+	ctx := context.Background()
+
+	if _, err := client.Token(ctx, server.URL, "jane", "wrong password"); err != moodle.ErrInvalidLogin {
+		t.Errorf("getting a token with a wrong password returned %v, expected %v", err, moodle.ErrInvalidLogin)
+	}
+
+	token, err := client.Token(ctx, server.URL, "jane", "moodle password")
+	if err != nil {
+		t.Fatalf("error getting token: %v", err)
+	}
+
+	info, err := client.SiteInfo(ctx, server.URL, token)
+	if err != nil || info.UserID != 3 || info.Username != "jane" {
+		t.Errorf("getting the site info returned %+v, %v", info, err)
+	}
+
+	user, err := client.UserByUsername(ctx, server.URL, token, "jane")
+	if err != nil || user.ID != 3 || user.Email != "jane@example.com" {
+		t.Errorf("getting the user returned %+v, %v", user, err)
+	}
+	if user, err := client.UserByUsername(ctx, server.URL, token, "nobody"); err != nil || user.ID != 0 {
+		t.Errorf("getting a user that doesn't exist returned %+v, %v", user, err)
+	}
+
+	courses, err := client.UserCourses(ctx, server.URL, token, 3)
+	if err != nil || len(courses) != 1 || courses[0].ID != 12 || courses[0].DisplayName != "Maths" {
+		t.Errorf("getting the courses returned %+v, %v", courses, err)
+	}
+
+	publicConfig, err := client.PublicConfig(ctx, server.URL)
+	if err != nil {
+		t.Fatalf("error getting public config: %v", err)
+	}
+	var site struct {
+		SiteName string `json:"sitename"`
+	}
+	if err := json.Unmarshal(publicConfig, &site); err != nil || site.SiteName != server.SiteName {
+		t.Errorf("unexpected public config %s", publicConfig)
+	}
+}
+
+func TestAssignmentsAndEvents(t *testing.T) {
+	server, client := newTestServer(t)
+	ctx := context.Background()
+
+	server.SetAssignments(
+		moodle.Assignment{ID: 1, Course: 12, Name: "Essay", DueDate: 1700000000},
+		moodle.Assignment{ID: 2, Course: 13, Name: "Not enrolled"},
+	)
+
+	// more events than fit on one page
+	var events []moodle.Event
+	for i := 1; i <= 60; i++ {
+		e := moodle.Event{ID: i, ModuleName: "assign", Instance: 1, TimeSort: 1700000000 + int64(i)}
+		e.Course.ID = 12
+		events = append(events, e)
+	}
+	server.SetEvents(events...)
+
+	token, err := client.Token(ctx, server.URL, "jane", "moodle password")
+	if err != nil {
+		t.Fatalf("error getting token: %v", err)
+	}
+
+	assignments, err := client.Assignments(ctx, server.URL, token, []int{12, 13})
+	if err != nil || len(assignments) != 1 || assignments[0].Name != "Essay" || assignments[0].DueDate != 1700000000 {
+		t.Errorf("getting the assignments returned %+v, %v", assignments, err)
+	}
+
+	got, err := client.ActionEvents(ctx, server.URL, token, time.Unix(1700000000, 0))
+	if err != nil || len(got) != len(events) {
+		t.Fatalf("getting the events returned %d events, %v, expected %d", len(got), err, len(events))
+	}
+	for i, e := range got {
+		if e.ID != i+1 {
+			t.Fatalf("event %d has the id %d, expected %d", i, e.ID, i+1)
+		}
+	}
+}
+
+func TestSubmissionStatus(t *testing.T) {
+	server, client := newTestServer(t)
+	ctx := context.Background()
+
+	server.SetAssignments(moodle.Assignment{ID: 1, Course: 12, Name: "Essay"}, moodle.Assignment{ID: 2, Course: 12, Name: "Poster"})
+	server.SetSubmission("jane", 1, moodle.Submission{Status: moodle.SubmissionSubmitted, TimeModified: 1700000000})
+
+	token, err := client.Token(ctx, server.URL, "jane", "moodle password")
+	if err != nil {
+		t.Fatalf("error getting token: %v", err)
+	}
+
+	if submission, err := client.SubmissionStatus(ctx, server.URL, token, 1); err != nil || submission.Status != moodle.SubmissionSubmitted || submission.TimeModified != 1700000000 {
+		t.Errorf("getting the submitted submission returned %+v, %v", submission, err)
+	}
+	if submission, err := client.SubmissionStatus(ctx, server.URL, token, 2); err != nil || submission.Status != "" {
+		t.Errorf("getting a submission that doesn't exist returned %+v, %v", submission, err)
+	}
+	if _, err := client.SubmissionStatus(ctx, server.URL, token, 3); err == nil || moodle.TokenRejected(err) {
+		t.Errorf("getting the submission of an assignment that can't be seen returned %v", err)
+	}
+}
+
+func TestClientExceptions(t *testing.T) {
+	server, client := newTestServer(t)
+	ctx := context.Background()
+
+	token, err := client.Token(ctx, server.URL, "jane", "moodle password")
+	if err != nil {
+		t.Fatalf("error getting token: %v", err)
+	}
+
+	// the courses of other users can't be seen
+	_, err = client.UserCourses(ctx, server.URL, token, 4)
+	if e, ok := err.(*moodle.Exception); !ok || e.ErrorCode != "accessexception" {
+		t.Errorf("getting the courses of someone else returned %v, expected an accessexception", err)
+	}
+
+	err = client.Call(ctx, server.URL, token, "core_unknown_function", nil, &struct{}{})
+	if e, ok := err.(*moodle.Exception); !ok || e.ErrorCode != "invalidrecord" || moodle.TokenRejected(err) {
+		t.Errorf("calling an unknown function returned %v, expected an invalidrecord exception", err)
+	}
+
+	server.RevokeTokens("jane")
+	if _, err := client.SiteInfo(ctx, server.URL, token); !moodle.TokenRejected(err) {
+		t.Errorf("using a revoked token returned %v, expected the token to be rejected", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := moodle.NewClient(5*time.Second, server.Transport()).SiteInfo(ctx, server.URL, "token"); err == nil {
+		t.Errorf("a canceled request should fail")
+	}
+
+	if _, err := moodle.NewClient(time.Nanosecond, server.Transport()).SiteInfo(context.Background(), server.URL, "token"); err == nil {
+		t.Errorf("a request that timed out should fail")
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"https://moodle.example.com":        "https://moodle.example.com",
+		"http://Moodle.Example.com/":        "https://moodle.example.com",
+		"moodle.example.com/school/":        "https://moodle.example.com/school",
+		" https://moodle.example.com?x=1 ":  "https://moodle.example.com",
+		"https://moodle.example.com/school": "https://moodle.example.com/school",
+	} {
+		if normalized, ok := moodle.NormalizeURL(raw); !ok || normalized != expected {
+			t.Errorf("normalizing %q returned %q, expected %q", raw, normalized, expected)
+		}
+	}
+
+	for _, raw := range []string{"", "ftp://moodle.example.com", "https://"} {
+		if _, ok := moodle.NormalizeURL(raw); ok {
+			t.Errorf("%q should not be a valid moodle url", raw)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+// Package moodletest provides a fake moodle instance so everything that talks to moodle can be tested without a real
+// one.
+package moodletest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+
+	"git.teich.3nt3.de/3nt3/homework/moodle"
+)
+
+// User is an account of the fake moodle instance
+type User struct {
+	ID       int
+	Username string
+	Password string
+	Email    string
+	// Courses are the courses the user is enrolled in
+	Courses []moodle.Course
+}
+
+// Server is a fake moodle instance. It serves the token endpoint of the mobile app, the web service functions the
+// moodle package calls and the public config. Like moodle URLs after moodle.NormalizeURL, it uses https, so requests
+// have to be sent with Client or Transport.
+type Server struct {
+	*httptest.Server
+
+	// SiteName is returned in the site info and the public config
+	SiteName string
+
+	mu sync.Mutex
+	// users by username
+	users map[string]User
+	// tokens are the usernames by token
+	tokens map[string]string
+	// assignments of all courses
+	assignments []moodle.Assignment
+	// events are the calendar action events of all courses, ordered by TimeSort
+	events []moodle.Event
+	// submissions by username and assignment id
+	submissions map[string]map[int]moodle.Submission
+}
+
+// NewServer starts a fake moodle instance with the users. It has to be closed after use.
+func NewServer(users ...User) *Server {
+	s := &Server{
+		SiteName:    "moodletest",
+		users:       make(map[string]User),
+		tokens:      make(map[string]string),
+		submissions: make(map[string]map[int]moodle.Submission),
+	}
+	for _, user := range users {
+		s.users[user.Username] = user
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/token.php", s.token)
+	mux.HandleFunc("/webservice/rest/server.php", s.webService)
+	mux.HandleFunc("/lib/ajax/service-nologin.php", s.publicConfig)
+	s.Server = httptest.NewTLSServer(mux)
+
+	return s
+}
+
+// Transport is the transport to send requests to the server with, it trusts its certificate
+func (s *Server) Transport() http.RoundTripper {
+	return s.Client().Transport
+}
+
+// AddUser adds or replaces the user
+func (s *Server) AddUser(user User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[user.Username] = user
+}
+
+// RevokeTokens makes every token of the user invalid, like a password change in moodle would
+func (s *Server) RevokeTokens(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, owner := range s.tokens {
+		if owner == username {
+			delete(s.tokens, token)
+		}
+	}
+}
+
+// SetAssignments replaces the assignments of all courses. Users see the assignments of the courses they are enrolled
+// in.
+func (s *Server) SetAssignments(assignments ...moodle.Assignment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assignments = assignments
+}
+
+// SetEvents replaces the calendar action events of all courses. Users see the events of the courses they are enrolled
+// in.
+func (s *Server) SetEvents(events ...moodle.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append([]moodle.Event(nil), events...)
+	sort.SliceStable(s.events, func(i, j int) bool { return s.events[i].TimeSort < s.events[j].TimeSort })
+}
+
+// SetSubmission sets the submission of the user for the assignment
+func (s *Server) SetSubmission(username string, assignmentID int, submission moodle.Submission) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.submissions[username] == nil {
+		s.submissions[username] = make(map[int]moodle.Submission)
+	}
+	s.submissions[username][assignmentID] = submission
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[r.PostFormValue("username")]
+	if !ok || user.Password != r.PostFormValue("password") {
+		writeJSON(w, map[string]string{"error": "Invalid login, please try again", "errorcode": "invalidlogin"})
+		return
+	}
+	if r.URL.Query().Get("service") != "moodle_mobile_app" {
+		writeJSON(w, map[string]string{"error": "Web service is not available", "errorcode": "servicenotavailable"})
+		return
+	}
+
+	// every login gets a new token, like with moodle
+	token := "token-" + strconv.Itoa(user.ID) + "-" + strconv.Itoa(len(s.tokens))
+	s.tokens[token] = user.Username
+	writeJSON(w, map[string]string{"token": token})
+}
+
+func (s *Server) webService(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.PostFormValue("moodlewsrestformat") != "json" {
+		http.Error(w, "<?xml version=\"1.0\" encoding=\"UTF-8\" ?><EXCEPTION/>", http.StatusOK)
+		return
+	}
+
+	username, ok := s.tokens[r.PostFormValue("wstoken")]
+	if !ok {
+		writeException(w, "invalidtoken", "Invalid token - token not found")
+		return
+	}
+	user := s.users[username]
+
+	switch r.PostFormValue("wsfunction") {
+	case "core_webservice_get_site_info":
+		writeJSON(w, map[string]interface{}{"sitename": s.SiteName, "userid": user.ID, "username": user.Username})
+	case "core_user_get_users_by_field":
+		found, ok := s.users[r.PostFormValue("values[0]")]
+		if r.PostFormValue("field") != "username" || !ok {
+			writeJSON(w, []interface{}{})
+			return
+		}
+		writeJSON(w, []map[string]interface{}{{"id": found.ID, "username": found.Username, "email": found.Email}})
+	case "core_enrol_get_users_courses":
+		// only the own courses can be seen
+		if r.PostFormValue("userid") != strconv.Itoa(user.ID) {
+			writeException(w, "accessexception", "Access control exception")
+			return
+		}
+		courses := user.Courses
+		if courses == nil {
+			courses = []moodle.Course{}
+		}
+		writeJSON(w, courses)
+	case "mod_assign_get_assignments":
+		writeJSON(w, map[string]interface{}{"courses": s.assignmentsOf(user, r), "warnings": []interface{}{}})
+	case "core_calendar_get_action_events_by_timesort":
+		writeJSON(w, s.eventsOf(user, r))
+	case "mod_assign_get_submission_status":
+		s.submissionStatus(w, user, r)
+	default:
+		writeException(w, "invalidrecord", "Can't find data record in database table external_functions.")
+	}
+}
+
+// assignmentsOf returns the assignments of the requested courses the user is enrolled in, grouped by course like
+// mod_assign_get_assignments
+func (s *Server) assignmentsOf(user User, r *http.Request) []map[string]interface{} {
+	courses := make([]map[string]interface{}, 0)
+	for i := 0; r.PostFormValue("courseids["+strconv.Itoa(i)+"]") != ""; i++ {
+		id, _ := strconv.Atoi(r.PostFormValue("courseids[" + strconv.Itoa(i) + "]"))
+		if !enrolled(user, id) {
+			continue
+		}
+
+		assignments := make([]moodle.Assignment, 0)
+		for _, a := range s.assignments {
+			if a.Course == id {
+				assignments = append(assignments, a)
+			}
+		}
+		courses = append(courses, map[string]interface{}{"id": id, "assignments": assignments})
+	}
+
+	return courses
+}
+
+// eventsOf returns a page of the events of the user's courses like core_calendar_get_action_events_by_timesort
+func (s *Server) eventsOf(user User, r *http.Request) map[string]interface{} {
+	from, _ := strconv.ParseInt(r.PostFormValue("timesortfrom"), 10, 64)
+	afterEventID, _ := strconv.Atoi(r.PostFormValue("aftereventid"))
+	limit, err := strconv.Atoi(r.PostFormValue("limitnum"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+
+	// the page starts after the event with afterEventID, or at the start without one
+	found := afterEventID == 0
+	events := make([]moodle.Event, 0)
+	for _, e := range s.events {
+		if !found {
+			found = e.ID == afterEventID
+			continue
+		}
+		if e.TimeSort >= from && enrolled(user, e.Course.ID) && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+
+	firstID, lastID := 0, 0
+	if len(events) > 0 {
+		firstID, lastID = events[0].ID, events[len(events)-1].ID
+	}
+
+	return map[string]interface{}{"events": events, "firstid": firstID, "lastid": lastID}
+}
+
+// submissionStatus responds like mod_assign_get_submission_status with the submission of the user
+func (s *Server) submissionStatus(w http.ResponseWriter, user User, r *http.Request) {
+	id, _ := strconv.Atoi(r.PostFormValue("assignid"))
+
+	visible := false
+	for _, a := range s.assignments {
+		visible = visible || (a.ID == id && enrolled(user, a.Course))
+	}
+	if !visible {
+		writeException(w, "nopermissions", "Sorry, but you do not currently have permissions to do that.")
+		return
+	}
+
+	lastAttempt := map[string]interface{}{"submissionsenabled": true}
+	if submission, ok := s.submissions[user.Username][id]; ok {
+		lastAttempt["submission"] = submission
+	}
+	writeJSON(w, map[string]interface{}{"lastattempt": lastAttempt, "warnings": []interface{}{}})
+}
+
+func enrolled(user User, courseID int) bool {
+	for _, c := range user.Courses {
+		if c.ID == courseID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) publicConfig(w http.ResponseWriter, r *http.Request) {
+	var calls []struct {
+		MethodName string `json:"methodname"`
+	}
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("args")), &calls); err != nil || len(calls) == 0 || calls[0].MethodName != "tool_mobile_get_public_config" {
+		writeJSON(w, []map[string]interface{}{{"error": true, "exception": map[string]string{"exception": "invalid_parameter_exception", "errorcode": "invalidparameter", "message": "Invalid parameter value detected"}}})
+		return
+	}
+
+	writeJSON(w, []map[string]interface{}{{"error": false, "data": map[string]interface{}{"sitename": s.SiteName, "wwwroot": s.URL}}})
+}
+
+func writeException(w http.ResponseWriter, errorCode string, message string) {
+	writeJSON(w, map[string]string{"exception": "moodle_exception", "errorcode": errorCode, "message": message})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	// moodle responds with 200 even for errors
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
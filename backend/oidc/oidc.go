@@ -0,0 +1,266 @@
+// Package oidc logs users in with OpenID Connect identity providers using the authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+)
+
+// DefaultScopes are requested if a provider doesn't configure its own
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// ErrInvalidIDToken is returned by Exchange if the id token of the provider can't be trusted
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+// Provider is an identity provider users can log in with
+type Provider struct {
+	Name        string
+	DisplayName string
+	// LinkByEmail is config.OIDCProvider.LinkByEmail
+	LinkByEmail bool
+
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       []string
+	client       *http.Client
+
+	// mu protects the discovered metadata and the signing keys, both are fetched when they are first needed
+	mu       sync.Mutex
+	metadata *metadata
+	keys     map[string]*rsa.PublicKey
+}
+
+// metadata is the part of the discovery document that is used
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Login contains the secrets of one login attempt. They have to be kept until the provider redirects back.
+type Login struct {
+	// State ties the redirect back to the login that was started
+	State string
+	// Nonce ties the id token to the login
+	Nonce string
+	// Verifier is the PKCE code verifier, only its hash is sent to the provider before the code is exchanged
+	Verifier string
+}
+
+// Identity is the account at the provider a user logged in with
+type Identity struct {
+	// Subject identifies the account at the provider, unlike the email address it never changes
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// NewProvider creates a provider that redirects back to redirectURL. Nothing is requested until it is used.
+func NewProvider(cfg config.OIDCProvider, redirectURL string, client *http.Client) *Provider {
+	displayName := cfg.DisplayName
+	if displayName == "" {
+		displayName = cfg.Name
+	}
+
+	scopes := cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = DefaultScopes
+	}
+	if !contains(scopes, "openid") {
+		scopes = append([]string{"openid"}, scopes...)
+	}
+
+	return &Provider{
+		Name:         cfg.Name,
+		DisplayName:  displayName,
+		LinkByEmail:  cfg.LinkByEmail,
+		issuer:       strings.TrimSuffix(cfg.Issuer, "/"),
+		clientID:     cfg.ClientID,
+		clientSecret: cfg.ClientSecret,
+		redirectURL:  redirectURL,
+		scopes:       scopes,
+		client:       client,
+	}
+}
+
+// NewLogin generates the secrets for a new login attempt
+func NewLogin() (Login, error) {
+	var login Login
+	for _, field := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		value, err := randomString()
+		if err != nil {
+			return Login{}, err
+		}
+		*field = value
+	}
+
+	return login, nil
+}
+
+// AuthCodeURL returns the url of the provider the user has to be sent to
+func (p *Provider) AuthCodeURL(ctx context.Context, login Login) (string, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(m.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %v", err)
+	}
+
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientID)
+	query.Set("redirect_uri", p.redirectURL)
+	query.Set("scope", strings.Join(p.scopes, " "))
+	query.Set("state", login.State)
+	query.Set("nonce", login.Nonce)
+	query.Set("code_challenge", codeChallenge(login.Verifier))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems the code the provider redirected back with and returns the identity from the verified id token
+func (p *Provider) Exchange(ctx context.Context, code string, login Login) (Identity, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("client_id", p.clientID)
+	form.Set("code_verifier", login.Verifier)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		// client_secret_basic, both parts are form encoded first (RFC 6749 section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.getJSON(req, &token)
+	if err != nil {
+		return Identity{}, fmt.Errorf("error exchanging code: %v", err)
+	}
+	if status != http.StatusOK || token.Error != "" {
+		return Identity{}, fmt.Errorf("error exchanging code: status %d: %s %s", status, token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return Identity{}, fmt.Errorf("%w: the token response contains no id token", ErrInvalidIDToken)
+	}
+
+	return p.verify(ctx, token.IDToken, login.Nonce)
+}
+
+// discover fetches the metadata of the provider the first time it is needed
+func (p *Provider) discover(ctx context.Context) (metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return *p.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", p.issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return metadata{}, err
+	}
+
+	var m metadata
+	status, err := p.getJSON(req, &m)
+	if err != nil {
+		return metadata{}, fmt.Errorf("error discovering %s: %v", p.issuer, err)
+	}
+	if status != http.StatusOK {
+		return metadata{}, fmt.Errorf("error discovering %s: status %d", p.issuer, status)
+	}
+
+	// the issuer in the metadata has to be exactly the one that was configured (OpenID Connect Discovery section 4.3)
+	if strings.TrimSuffix(m.Issuer, "/") != p.issuer {
+		return metadata{}, fmt.Errorf("error discovering %s: metadata is for issuer %q", p.issuer, m.Issuer)
+	}
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return metadata{}, fmt.Errorf("error discovering %s: endpoints are missing", p.issuer)
+	}
+
+	p.metadata = &m
+	return m, nil
+}
+
+// getJSON sends the request and decodes the response into v, whatever its status is
+func (p *Provider) getJSON(req *http.Request, v interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	// responses are small, anything larger isn't what we asked for
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return resp.StatusCode, fmt.Errorf("invalid json (status %d): %v", resp.StatusCode, err)
+	}
+
+	return resp.StatusCode, nil
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func randomString() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
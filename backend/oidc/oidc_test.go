@@ -0,0 +1,119 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/oidc/oidctest"
+)
+
+const redirectURL = "https://api.example.com/auth/oidc/test/callback"
+
+func TestLogin(t *testing.T) {
+	server := oidctest.NewServer()
+	defer server.Close()
+
+	server.SetIdentity(oidctest.Identity{Subject: "42", Email: "someone@example.com", EmailVerified: true, PreferredUsername: "someone"})
+
+	provider := newTestProvider(server)
+	login, callback := authorize(t, server, provider)
+
+	if callback.Query().Get("state") != login.State {
+		t.Errorf("the provider redirected back with state %q, expected %q", callback.Query().Get("state"), login.State)
+	}
+
+	identity, err := provider.Exchange(context.Background(), callback.Query().Get("code"), login)
+	if err != nil {
+		t.Fatalf("error exchanging code: %v", err)
+	}
+
+	expected := Identity{Subject: "42", Email: "someone@example.com", EmailVerified: true, PreferredUsername: "someone"}
+	if identity != expected {
+		t.Errorf("got identity %+v, expected %+v", identity, expected)
+	}
+}
+
+func TestExchangeWithWrongVerifier(t *testing.T) {
+	server := oidctest.NewServer()
+	defer server.Close()
+
+	provider := newTestProvider(server)
+	login, callback := authorize(t, server, provider)
+
+	// e.g. a code that was intercepted and is redeemed by someone else
+	login.Verifier = "not the verifier"
+	if _, err := provider.Exchange(context.Background(), callback.Query().Get("code"), login); err == nil {
+		t.Errorf("exchanging a code with the wrong code verifier should fail")
+	}
+}
+
+func TestExchangeRejectsInvalidIDTokens(t *testing.T) {
+	server := oidctest.NewServer()
+	defer server.Close()
+
+	for name, modify := range map[string]func(map[string]interface{}){
+		"another issuer":          func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" },
+		"another client":          func(c map[string]interface{}) { c["aud"] = "someone-else" },
+		"multiple audiences":      func(c map[string]interface{}) { c["aud"] = []string{server.ClientID, "someone-else"} },
+		"an expired token":        func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"another nonce":           func(c map[string]interface{}) { c["nonce"] = "replayed" },
+		"a token without subject": func(c map[string]interface{}) { delete(c, "sub") },
+	} {
+		server.ModifyClaims = modify
+
+		provider := newTestProvider(server)
+		login, callback := authorize(t, server, provider)
+
+		_, err := provider.Exchange(context.Background(), callback.Query().Get("code"), login)
+		if !errors.Is(err, ErrInvalidIDToken) {
+			t.Errorf("exchanging a code for %s returned %v, expected ErrInvalidIDToken", name, err)
+		}
+	}
+}
+
+func TestVerifyRejectsUnsignedTokens(t *testing.T) {
+	server := oidctest.NewServer()
+	defer server.Close()
+
+	provider := newTestProvider(server)
+
+	// {"alg":"none"}.{"sub":"1"}.
+	token := "eyJhbGciOiJub25lIn0.eyJzdWIiOiIxIn0."
+	if _, err := provider.verify(context.Background(), token, ""); !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("verifying an unsigned token returned %v, expected ErrInvalidIDToken", err)
+	}
+}
+
+func newTestProvider(server *oidctest.Server) *Provider {
+	return NewProvider(config.OIDCProvider{
+		Name:         "test",
+		Issuer:       server.Issuer(),
+		ClientID:     server.ClientID,
+		ClientSecret: server.ClientSecret,
+	}, redirectURL, http.DefaultClient)
+}
+
+// authorize starts a login and returns it with the url the provider redirected back to
+func authorize(t *testing.T, server *oidctest.Server, provider *Provider) (Login, *url.URL) {
+	login, err := NewLogin()
+	if err != nil {
+		t.Fatalf("error creating login: %v", err)
+	}
+
+	authURL, err := provider.AuthCodeURL(context.Background(), login)
+	if err != nil {
+		t.Fatalf("error getting auth code url: %v", err)
+	}
+
+	callback, err := server.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("error authorizing: %v", err)
+	}
+
+	return login, callback
+}
@@ -0,0 +1,186 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clockSkew is how far the clocks of the provider and the server may differ
+const clockSkew = time.Minute
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type claims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	Name              string   `json:"name"`
+}
+
+// audience is either a single string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = multiple
+	return nil
+}
+
+// verify checks the signature and the claims of an id token (OpenID Connect Core section 3.1.3.7) and returns the
+// identity it is about. Only RS256, which every provider has to support, is accepted.
+func (p *Provider) verify(ctx context.Context, idToken string, nonce string) (Identity, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return Identity{}, fmt.Errorf("%w: malformed token", ErrInvalidIDToken)
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return Identity{}, fmt.Errorf("%w: malformed header: %v", ErrInvalidIDToken, err)
+	}
+	if h.Alg != "RS256" {
+		return Identity{}, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidIDToken, h.Alg)
+	}
+
+	key, err := p.key(ctx, h.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: malformed signature", ErrInvalidIDToken)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return Identity{}, fmt.Errorf("%w: wrong signature", ErrInvalidIDToken)
+	}
+
+	var c claims
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return Identity{}, fmt.Errorf("%w: malformed claims: %v", ErrInvalidIDToken, err)
+	}
+
+	if strings.TrimSuffix(c.Issuer, "/") != p.issuer {
+		return Identity{}, fmt.Errorf("%w: issued by %q", ErrInvalidIDToken, c.Issuer)
+	}
+	if !contains(c.Audience, p.clientID) || (len(c.Audience) > 1 && c.AuthorizedParty != p.clientID) {
+		return Identity{}, fmt.Errorf("%w: issued for %v", ErrInvalidIDToken, c.Audience)
+	}
+	if time.Unix(c.Expiry, 0).Add(clockSkew).Before(time.Now()) {
+		return Identity{}, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	}
+	if c.Nonce != nonce {
+		return Identity{}, fmt.Errorf("%w: wrong nonce", ErrInvalidIDToken)
+	}
+	if c.Subject == "" {
+		return Identity{}, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+
+	return Identity{
+		Subject:           c.Subject,
+		Email:             c.Email,
+		EmailVerified:     c.EmailVerified,
+		PreferredUsername: c.PreferredUsername,
+		Name:              c.Name,
+	}, nil
+}
+
+// key returns the signing key with the id. The keys are fetched again if it isn't known, providers rotate them.
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", m.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	status, err := p.getJSON(req, &set)
+	if err != nil {
+		return nil, fmt.Errorf("error getting signing keys: %v", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("error getting signing keys: status %d", status)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			continue
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, kid)
+	}
+
+	return key, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,184 @@
+// Package ratelimit limits how often something may happen per key, e.g. per ip address or per account.
+// Everything is kept in memory, so limits only apply per process.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter allows bursts of up to Burst events per key and refills them evenly over Window (a token bucket)
+type Limiter struct {
+	Burst  int
+	Window time.Duration
+	// Now returns the current time, tests replace it
+	Now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewLimiter returns a Limiter that allows burst events per window and key
+func NewLimiter(burst int, window time.Duration) *Limiter {
+	return &Limiter{
+		Burst:   burst,
+		Window:  window,
+		Now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow records an event for key. If the key has exceeded its limit, false is returned together with how long to wait
+// until the next event is allowed.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Now()
+	l.sweep(now)
+
+	// tokens per nanosecond
+	rate := float64(l.Burst) / float64(l.Window)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), updated: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens += float64(now.Sub(b.updated)) * rate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets buckets that are full again, they behave exactly like new ones
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.Window {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= l.Window {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Lockout locks keys out after too many failures, e.g. wrong passwords. After Attempts failures a key is locked for
+// Base, every further failure doubles that up to Max.
+type Lockout struct {
+	Attempts int
+	Base     time.Duration
+	Max      time.Duration
+	// Now returns the current time, tests replace it
+	Now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*lockoutEntry
+	lastSweep time.Time
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// NewLockout returns a Lockout that locks keys out after attempts failures for base, doubling up to max
+func NewLockout(attempts int, base time.Duration, max time.Duration) *Lockout {
+	return &Lockout{
+		Attempts: attempts,
+		Base:     base,
+		Max:      max,
+		Now:      time.Now,
+		entries:  make(map[string]*lockoutEntry),
+	}
+}
+
+// Locked returns how long the key is still locked out, 0 if it isn't
+func (l *Lockout) Locked(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[key]
+	if !ok {
+		return 0
+	}
+
+	if remaining := e.lockedUntil.Sub(l.Now()); remaining > 0 {
+		return remaining
+	}
+
+	return 0
+}
+
+// Fail records a failure for key and returns how long it is locked out now, 0 if it isn't
+func (l *Lockout) Fail(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Now()
+	l.sweep(now)
+
+	e, ok := l.entries[key]
+	if !ok {
+		e = &lockoutEntry{}
+		l.entries[key] = e
+	}
+
+	e.failures++
+	e.lastFailure = now
+
+	if e.failures < l.Attempts {
+		return 0
+	}
+
+	duration := l.Base
+	for i := l.Attempts; i < e.failures && duration < l.Max; i++ {
+		duration *= 2
+	}
+	if duration > l.Max {
+		duration = l.Max
+	}
+
+	e.lockedUntil = now.Add(duration)
+	return duration
+}
+
+// Reset forgets all failures of key, e.g. after a successful login
+func (l *Lockout) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.entries, key)
+}
+
+// sweep forgets keys that haven't failed for Max and aren't locked anymore
+func (l *Lockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.Max {
+		return
+	}
+	l.lastSweep = now
+
+	for key, e := range l.entries {
+		if now.Sub(e.lastFailure) >= l.Max && now.After(e.lockedUntil) {
+			delete(l.entries, key)
+		}
+	}
+}
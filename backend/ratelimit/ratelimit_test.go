@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a fake time source for Limiter.Now and Lockout.Now
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestLimiter(t *testing.T) {
+	c := &clock{now: time.Date(2021, 11, 16, 0, 0, 0, 0, time.UTC)}
+	l := NewLimiter(3, time.Minute)
+	l.Now = c.Now
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("192.0.2.1"); !ok {
+			t.Fatalf("request %d within the burst was not allowed", i+1)
+		}
+	}
+
+	ok, retryAfter := l.Allow("192.0.2.1")
+	if ok {
+		t.Fatalf("request exceeding the burst was allowed")
+	}
+	if retryAfter != 20*time.Second {
+		t.Errorf("retry after %v, expected 20s (one request every 20s)", retryAfter)
+	}
+
+	if ok, _ := l.Allow("192.0.2.2"); !ok {
+		t.Errorf("keys should be limited independently")
+	}
+
+	c.Advance(20 * time.Second)
+	if ok, _ := l.Allow("192.0.2.1"); !ok {
+		t.Errorf("request after waiting for retry after was not allowed")
+	}
+	if ok, _ := l.Allow("192.0.2.1"); ok {
+		t.Errorf("only one request should have been refilled")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	c := &clock{now: time.Date(2021, 11, 16, 0, 0, 0, 0, time.UTC)}
+	l := NewLockout(3, time.Minute, 10*time.Minute)
+	l.Now = c.Now
+
+	for i := 0; i < 2; i++ {
+		if locked := l.Fail("jane"); locked != 0 {
+			t.Fatalf("locked out for %v after %d failures, expected no lockout before 3", locked, i+1)
+		}
+	}
+
+	// every failure after the third one doubles the lockout up to the maximum
+	for _, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		if locked := l.Fail("jane"); locked != expected {
+			t.Errorf("locked out for %v, expected %v", locked, expected)
+		}
+	}
+
+	if locked := l.Locked("jane"); locked != 10*time.Minute {
+		t.Errorf("Locked returned %v, expected 10m", locked)
+	}
+	if locked := l.Locked("john"); locked != 0 {
+		t.Errorf("keys without failures should not be locked, got %v", locked)
+	}
+
+	c.Advance(10 * time.Minute)
+	if locked := l.Locked("jane"); locked != 0 {
+		t.Errorf("lockout should be over, got %v", locked)
+	}
+
+	l.Reset("jane")
+	if locked := l.Fail("jane"); locked != 0 {
+		t.Errorf("failures should be forgotten after Reset, got lockout of %v", locked)
+	}
+}
@@ -0,0 +1,102 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/gorilla/mux"
+)
+
+const maxAPITokenNameLength = 64
+
+// GetAPITokens returns the personal access tokens of the user, without the tokens themselves
+func GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	tokens, err := db.GetAPITokens(user.ID.String())
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting api tokens: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: tokens, Errors: []apiError{}}, http.StatusOK)
+}
+
+// CreateAPIToken creates a personal access token with a `name` and `scopes`. The token is only part of this response,
+// it can't be retrieved later.
+func CreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	type tokenData struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	var data tokenData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" || utf8.RuneCountInString(data.Name) > maxAPITokenNameLength {
+		respondError(w, errBadRequest.withMessage("the name has to be between 1 and 64 characters long"))
+		return
+	}
+
+	scopes, ok := cleanScopes(data.Scopes)
+	if !ok {
+		respondError(w, errBadRequest.withMessage("scopes have to be one or more of "+strings.Join([]string{structs.ScopeAssignmentsRead, structs.ScopeAssignmentsWrite, structs.ScopeCoursesRead}, ", ")))
+		return
+	}
+
+	token, err := db.NewAPIToken(user.ID.String(), data.Name, scopes)
+	if err != nil {
+		logging.ErrorLogger.Printf("error creating api token: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: token, Errors: []apiError{}}, http.StatusOK)
+}
+
+// RevokeAPIToken deletes one of the user's personal access tokens by its id
+func RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	if err := db.DeleteAPIToken(user.ID.String(), mux.Vars(r)["id"]); err != nil {
+		if err == db.ErrNotFound {
+			respondError(w, errAPITokenNotFound)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error deleting api token: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// cleanScopes removes duplicate scopes. It returns false if there are none or some are unknown.
+func cleanScopes(scopes []string) ([]string, bool) {
+	seen := make(map[string]bool)
+	cleaned := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if !structs.ValidScope(scope) {
+			return nil, false
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			cleaned = append(cleaned, scope)
+		}
+	}
+
+	return cleaned, len(cleaned) > 0
+}
@@ -0,0 +1,143 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/gorilla/mux"
+)
+
+func TestAPIToken(t *testing.T) {
+	cookie := registerTestUser(t, "api_token")
+
+	token := createAPIToken(t, cookie, "discord bot", []string{structs.ScopeAssignmentsRead})
+	if !strings.HasPrefix(token.Token, "hw_") {
+		t.Fatalf("created token %q doesn't have the hw_ prefix", token.Token)
+	}
+
+	readAssignments := Scoped(structs.ScopeAssignmentsRead, GetAssignments)
+	writeAssignments := Scoped(structs.ScopeAssignmentsWrite, CreateAssignment)
+
+	for _, c := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		token    string
+		expected int
+	}{
+		{"a route with the scope", readAssignments, token.Token, http.StatusOK},
+		{"a route with another scope", writeAssignments, token.Token, http.StatusForbidden},
+		{"a session only route", Authenticated(GetSessions), token.Token, http.StatusForbidden},
+		{"an invalid token", readAssignments, "hw_not_a_token", http.StatusUnauthorized},
+	} {
+		if status := bearerStatus(t, c.handler, c.token); status != c.expected {
+			t.Errorf("requesting %s returned status code %d, expected %d", c.name, status, c.expected)
+		}
+	}
+
+	// the token must not be retrievable after creating it
+	req, err := http.NewRequest("GET", "http://localhost:8000/user/tokens", nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+
+	Authenticated(GetAPITokens)(rr, req)
+
+	var list struct {
+		Content []structs.APIToken `json:"content"`
+	}
+	if err := json.NewDecoder(rr.Result().Body).Decode(&list); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+	if len(list.Content) != 1 || list.Content[0].Token != "" || list.Content[0].LastUsed == nil {
+		t.Errorf("unexpected token list: %+v", list.Content)
+	}
+
+	// revoke it
+	req, err = http.NewRequest("DELETE", "http://localhost:8000/user/tokens/"+token.ID.String(), nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	req = mux.SetURLVars(req, map[string]string{"id": token.ID.String()})
+	rr = httptest.NewRecorder()
+
+	Authenticated(RevokeAPIToken)(rr, req)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("revoking the token returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	if status := bearerStatus(t, readAssignments, token.Token); status != http.StatusUnauthorized {
+		t.Errorf("using a revoked token returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestCreateAPITokenWithInvalidScopes(t *testing.T) {
+	cookie := registerTestUser(t, "api_token_scopes")
+
+	for _, scopes := range [][]string{nil, {}, {"admin"}, {structs.ScopeAssignmentsRead, "everything"}} {
+		body, _ := json.Marshal(map[string]interface{}{"name": "bot", "scopes": scopes})
+
+		req, err := http.NewRequest("POST", "http://localhost:8000/user/tokens", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("error requesting: %v", err)
+		}
+		req.AddCookie(cookie)
+		rr := httptest.NewRecorder()
+
+		Authenticated(CreateAPIToken)(rr, req)
+
+		if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+			t.Errorf("creating a token with scopes %v returned status code %d, expected %d", scopes, status, http.StatusBadRequest)
+		}
+	}
+}
+
+// createAPIToken creates a personal access token as the user the cookie belongs to
+func createAPIToken(t *testing.T, cookie *http.Cookie, name string, scopes []string) structs.APIToken {
+	body, _ := json.Marshal(map[string]interface{}{"name": name, "scopes": scopes})
+
+	req, err := http.NewRequest("POST", "http://localhost:8000/user/tokens", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+
+	Authenticated(CreateAPIToken)(rr, req)
+
+	result := rr.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("creating token failed with status code %d", result.StatusCode)
+	}
+
+	var resp struct {
+		Content structs.APIToken `json:"content"`
+	}
+	if err := json.NewDecoder(result.Body).Decode(&resp); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+
+	return resp.Content
+}
+
+// bearerStatus requests the handler with the personal access token and returns the status code of the response
+func bearerStatus(t *testing.T, handler http.HandlerFunc, token string) int {
+	req, err := http.NewRequest("GET", "http://localhost:8000", nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+
+	handler(rr, req)
+
+	return rr.Result().StatusCode
+}
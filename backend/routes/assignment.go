@@ -1,10 +1,10 @@
 package routes
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
 
 	"git.teich.3nt3.de/3nt3/homework/db"
 	"git.teich.3nt3.de/3nt3/homework/logging"
@@ -13,54 +13,58 @@ import (
 )
 
 func CreateAssignment(w http.ResponseWriter, r *http.Request) {
-	user, authenticated, err := getUserBySession(r, false)
+	user := currentUser(r)
 
+	var assignment structs.Assignment
+	err := json.NewDecoder(r.Body).Decode(&assignment)
 	if err != nil {
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
+		logging.WarningLogger.Printf("error decoding: %v\n", err)
+		respondError(w, errBadRequest)
 		return
 	}
 
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
+	if !requireCourseAccess(w, user, assignment.Course) {
 		return
 	}
 
-	var assignment structs.Assignment
-	err = json.NewDecoder(r.Body).Decode(&assignment)
-	if err != nil {
-		logging.WarningLogger.Printf("error decoding: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"bad request"},
-		}, http.StatusBadRequest)
-		return
+	if assignment.Course < 0 {
+		archived, err := db.IsCourseArchived(assignment.Course)
+		if err != nil {
+			if err == db.ErrNotFound {
+				respondError(w, errCourseNotFound)
+				return
+			}
+			logging.ErrorLogger.Printf("error getting course: %v\n", err)
+			respondError(w, errInternal)
+			return
+		}
+
+		if archived {
+			respondError(w, errCourseArchived)
+			return
+		}
 	}
 
 	assignment.User = user
+	// only assignments imported from moodle count as from moodle, and they are never created here
+	assignment.Created = structs.UnixTime(time.Now())
+	assignment.FromMoodle = false
 
 	assignment, err = db.CreateAssignment(assignment)
 	if err != nil {
 		logging.ErrorLogger.Printf("error creating assignment: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, http.StatusInternalServerError)
+		respondError(w, errInternal)
 		return
 	}
 
 	assignment.DoneBy = []string{}
 	assignment.DoneByUsers = make([]structs.User, 0)
+	assignment.DoneAt = make(map[string]structs.UnixTime)
+	assignment.AutoDoneBy = []string{}
 
 	_ = returnApiResponse(w, apiResponse{
 		Content: assignment.GetClean(),
-		Errors:  []string{},
+		Errors:  []apiError{},
 	}, http.StatusOK)
 }
 
@@ -68,114 +72,64 @@ func DeleteAssignment(w http.ResponseWriter, r *http.Request) {
 
 	id := r.URL.Query().Get("id")
 	if id == "" {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"bad request"},
-		}, http.StatusBadRequest)
+		respondError(w, errBadRequest)
 		return
 	}
 
-	user, authenticated, err := getUserBySession(r, false)
-
-	if err != nil {
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
-		return
-	}
+	user := currentUser(r)
 
 	assignment, err := db.GetAssignmentByID(id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"not found"},
-			}, http.StatusNotFound)
+		if err == db.ErrNotFound {
+			respondError(w, errAssignmentNotFound)
 			return
 		}
 
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, http.StatusInternalServerError)
+		respondError(w, errInternal)
 		return
 	}
 
-	if assignment.User.ID != user.ID {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"you are not the creator of this assignment"},
-		}, http.StatusForbidden)
+	if !requireAssignmentAccess(w, user, assignment) {
+		return
+	}
+
+	if !requireAssignmentManager(w, user, assignment) {
 		return
 	}
 
 	err = db.DeleteAssignment(assignment.UID.String())
 	if err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, http.StatusInternalServerError)
+		respondError(w, errInternal)
 		return
 	}
 
 	_ = returnApiResponse(w, apiResponse{
 		Content: assignment.GetClean(),
-		Errors:  []string{},
+		Errors:  []apiError{},
 	}, http.StatusOK)
 }
 
 func GetAssignments(w http.ResponseWriter, r *http.Request) {
 
-	user, authenticated, err := getUserBySession(r, false)
-	if err != nil {
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
-		return
-	}
+	user := currentUser(r)
 
 	var days int
 	daysString := r.URL.Query().Get("days")
 	if daysString == "" {
 		days = -1
 	} else {
+		var err error
 		days, err = strconv.Atoi(daysString)
 		if err != nil {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"?days is not a valid integer"},
-			}, 400)
+			respondError(w, errBadRequest.withMessage("?days is not a valid integer"))
 			return
 		}
 	}
 
 	assignments, err := db.GetAssignments(user, days)
-	if err != nil && err != sql.ErrNoRows {
+	if err != nil && err != db.ErrNotFound {
 		logging.ErrorLogger.Printf("error getting assignments session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
+		respondError(w, errInternal)
 		return
 	}
 
@@ -194,55 +148,27 @@ func GetAssignments(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetAssignment(w http.ResponseWriter, r *http.Request) {
-	_, authenticated, err := getUserBySession(r, false)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"not authenticated"},
-			}, 401)
-			return
-		}
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
-		return
-	}
+	user := currentUser(r)
 
 	id, ok := mux.Vars(r)["id"]
 	if id == "" || !ok {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"no id provided"},
-		}, 404)
+		respondError(w, errBadRequest.withMessage("no id provided"))
 		return
 	}
 
 	assignment, err := db.GetAssignmentByID(id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"assignment not found"},
-			}, 404)
+		if err == db.ErrNotFound {
+			respondError(w, errAssignmentNotFound)
 			return
 		}
 
 		logging.ErrorLogger.Printf("error getting assignment: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
+		respondError(w, errInternal)
+		return
+	}
+
+	if !requireAssignmentAccess(w, user, assignment) {
 		return
 	}
 
@@ -253,58 +179,31 @@ func GetAssignment(w http.ResponseWriter, r *http.Request) {
 
 // UpdateAssignment updates the assignment lol
 func UpdateAssignment(w http.ResponseWriter, r *http.Request) {
-	user, authenticated, err := getUserBySession(r, false)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"not authenticated"},
-			}, 401)
-			return
-		}
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
-		return
-	}
+	user := currentUser(r)
 
 	id, ok := mux.Vars(r)["id"]
 	if id == "" || !ok {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"no id provided"},
-		}, 404)
+		respondError(w, errBadRequest.withMessage("no id provided"))
 		return
 	}
 
 	assignment, err := db.GetAssignmentByID(id)
 	if err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"no id provided"},
-		}, 404)
-
-		if err != sql.ErrNoRows {
-			logging.WarningLogger.Printf("error getting assignment: %v\n", err)
+		if err == db.ErrNotFound {
+			respondError(w, errAssignmentNotFound)
+			return
 		}
+
+		logging.ErrorLogger.Printf("error getting assignment: %v\n", err)
+		respondError(w, errInternal)
 		return
 	}
 
-	if assignment.User.ID != user.ID {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"you are not the creator of this assignment"},
-		}, http.StatusForbidden)
+	if !requireAssignmentAccess(w, user, assignment) {
+		return
+	}
+
+	if !requireAssignmentManager(w, user, assignment) {
 		return
 	}
 
@@ -317,9 +216,7 @@ func UpdateAssignment(w http.ResponseWriter, r *http.Request) {
 	var updateData updateDataStruct
 	err = json.NewDecoder(r.Body).Decode(&updateData)
 	if err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Errors: []string{"bad request"},
-		}, 400)
+		respondError(w, errBadRequest)
 		return
 	}
 
@@ -332,11 +229,8 @@ func UpdateAssignment(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := db.UpdateAssignment(id, assignment); err != nil {
-		logging.WarningLogger.Printf("error updating assignment: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
+		logging.ErrorLogger.Printf("error updating assignment: %v\n", err)
+		respondError(w, errInternal)
 		return
 	}
 
@@ -346,28 +240,8 @@ func UpdateAssignment(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetContributors(w http.ResponseWriter, r *http.Request) {
-	user, authenticated, err := getUserBySession(r, true)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"not authenticated"},
-			}, 401)
-			return
-		}
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
+	user, ok := currentUserWithCourses(w, r)
+	if !ok {
 		return
 	}
 
@@ -405,54 +279,20 @@ func GetContributors(w http.ResponseWriter, r *http.Request) {
 
 	_ = returnApiResponse(w, apiResponse{
 		Content: contributorThings,
+		Errors:  []apiError{},
 	}, 200)
 }
 
 func GetContributorsAdmin(w http.ResponseWriter, r *http.Request) {
-	user, authenticated, err := getUserBySession(r, true)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"not authenticated"},
-			}, 401)
-			return
-		}
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
-		return
-	}
-
-	if user.Privilege < 1 {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"permission denied"},
-		}, 403)
-		return
-	}
-
 	var contributorThings map[string]int = make(map[string]int)
 
 	allAssignments, err := db.GetAllAssignments()
 	if err != nil {
-		// ignore sql.ErrNoRows
-		if err != sql.ErrNoRows {
-			logging.WarningLogger.Printf("error getting all assignments from db: %v\n", err)
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"internal server error"},
-			}, 500)
+		// ignore db.ErrNotFound
+		if err != db.ErrNotFound {
+			logging.ErrorLogger.Printf("error getting all assignments from db: %v\n", err)
+			respondError(w, errInternal)
+			return
 		}
 	}
 
@@ -466,140 +306,73 @@ func GetContributorsAdmin(w http.ResponseWriter, r *http.Request) {
 
 	_ = returnApiResponse(w, apiResponse{
 		Content: contributorThings,
+		Errors:  []apiError{},
 	}, 200)
 }
 
 func AssignmentDone(w http.ResponseWriter, r *http.Request, done bool) {
-	user, authenticated, err := getUserBySession(r, true)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"not authenticated"},
-			}, 401)
-			return
-		}
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"authentication required"},
-		}, 401)
-		return
-	}
+	user := currentUser(r)
 
 	id, ok := mux.Vars(r)["id"]
 	if !ok {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"provide an assignment id plz"},
-		}, 400)
+		respondError(w, errBadRequest.withMessage("no id provided"))
 		return
 	}
 
 	a, err := db.GetAssignmentByID(id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"specified assignment does not exist :("},
-			}, 404)
+		if err == db.ErrNotFound {
+			respondError(w, errAssignmentNotFound)
 			return
 		}
 
 		logging.ErrorLogger.Printf("error getting assignment: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	courses, err := db.GetMoodleUserCourses(user)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"you do not have access to the specified assignment"},
-			}, 403)
-			return
-		}
-
-		logging.ErrorLogger.Printf("error getting user courses: %v\n", err)
-
-		if err.Error() == "no token or moodle url was provided" {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"you do not have access to the specified assignment", "you have not connected your moodle account yet"},
-			}, 403)
-			return
-		}
-
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
+		respondError(w, errInternal)
 		return
 	}
 
-	// check if assignment is in one of the user's courses
-	var inUserCourse bool
-	for _, c := range courses {
-		if c.FromMoodle {
-			if int(c.ID.(float64)) == a.Course {
-				inUserCourse = true
-				break
-			}
-		}
-		// FIXME: assignments not from moodle aren't checked?
-		// not sure if this is relevant since there *are* no non-moodle courses currently
-		// would probably be relevant after summer break when moodle stops being utilized
-	}
-
-	if !inUserCourse {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"you do not have access to the specified assignment"},
-		}, 403)
+	if !requireAssignmentAccess(w, user, a) {
 		return
 	}
 
 	if err = db.AssignmentDone(id, user.ID.String(), done); err != nil {
 		logging.ErrorLogger.Printf("error updating assignment: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
+		respondError(w, errInternal)
 		return
 	}
 
 	assignment, err := db.GetAssignmentByID(id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"specified assignment does not exist :("},
-			}, 404)
+		if err == db.ErrNotFound {
+			respondError(w, errAssignmentNotFound)
 			return
 		}
 
 		logging.ErrorLogger.Printf("error getting assignment: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
+		respondError(w, errInternal)
 		return
 	}
 
 	_ = returnApiResponse(w, apiResponse{
 		Content: assignment.GetClean(),
-		Errors:  []string{},
+		Errors:  []apiError{},
 	}, 200)
 }
+
+// requireAssignmentManager responds with 403 if the user may not edit or delete the assignment.
+// It returns true if the request may continue.
+func requireAssignmentManager(w http.ResponseWriter, user structs.User, assignment structs.Assignment) bool {
+	canManage, err := canManageAssignment(user, assignment)
+	if err != nil {
+		logging.ErrorLogger.Printf("error checking assignment permissions: %v\n", err)
+		respondError(w, errInternal)
+		return false
+	}
+
+	if !canManage {
+		respondError(w, errNotCreator)
+		return false
+	}
+
+	return true
+}
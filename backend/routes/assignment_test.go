@@ -6,18 +6,22 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"git.teich.3nt3.de/3nt3/homework/db"
 	"git.teich.3nt3.de/3nt3/homework/logging"
 	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
 )
 
 func TestCreateAssignment(t *testing.T) {
 	a := structs.Assignment{
 		Title:      "test assignment",
 		DueDate:    (structs.UnixTime)(time.Date(2021, 11, 16, 0, 0, 0, 0, time.UTC)),
-		Course:     123,
+		Course:     createTestCourse(t, sessionCookie(), "create assignment"),
 		FromMoodle: false,
 	}
 	body, _ := json.Marshal(a)
@@ -30,7 +34,7 @@ func TestCreateAssignment(t *testing.T) {
 
 	arr := httptest.NewRecorder()
 
-	CreateAssignment(arr, req)
+	Authenticated(CreateAssignment)(arr, req)
 
 	aResult := arr.Result()
 	if aResult.StatusCode != http.StatusOK {
@@ -51,7 +55,7 @@ func TestDeleteAssignment(t *testing.T) {
 	a := structs.Assignment{
 		Title:      "test assignment",
 		DueDate:    (structs.UnixTime)(time.Date(2021, 11, 16, 0, 0, 0, 0, time.UTC)),
-		Course:     123,
+		Course:     createTestCourse(t, sessionCookie(), "delete assignment"),
 		FromMoodle: false,
 	}
 	body, _ := json.Marshal(a)
@@ -64,7 +68,7 @@ func TestDeleteAssignment(t *testing.T) {
 
 	arr := httptest.NewRecorder()
 
-	CreateAssignment(arr, req)
+	Authenticated(CreateAssignment)(arr, req)
 
 	aResult := arr.Result()
 
@@ -99,7 +103,7 @@ func TestDeleteAssignment(t *testing.T) {
 
 	rr := httptest.NewRecorder()
 
-	DeleteAssignment(rr, req)
+	Authenticated(DeleteAssignment)(rr, req)
 
 	result := rr.Result()
 	if result.StatusCode != http.StatusOK {
@@ -116,3 +120,215 @@ func TestDeleteAssignment(t *testing.T) {
 		t.Errorf("request failed with status code %d %v", result.StatusCode, resp.Errors)
 	}
 }
+
+func TestCreateAssignmentIgnoresServerFields(t *testing.T) {
+	courseID := createTestCourse(t, sessionCookie(), "server fields")
+
+	// clients can't pretend an assignment was imported from moodle or created at some other time
+	a := structs.Assignment{
+		Title:      "test assignment",
+		DueDate:    (structs.UnixTime)(time.Date(2021, 11, 16, 0, 0, 0, 0, time.UTC)),
+		Course:     courseID,
+		Created:    (structs.UnixTime)(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)),
+		FromMoodle: true,
+	}
+	rr := request(t, "POST", Authenticated(CreateAssignment), sessionCookie(), nil, a)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("creating assignment failed with status code %d", rr.Code)
+	}
+
+	var resp struct {
+		Content structs.Assignment `json:"content"`
+	}
+	if err := json.NewDecoder(rr.Result().Body).Decode(&resp); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+
+	created, err := db.GetAssignmentByID(resp.Content.UID.String())
+	if err != nil {
+		t.Fatalf("error getting assignment: %v", err)
+	}
+	if created.FromMoodle {
+		t.Errorf("assignment created by a user is from moodle")
+	}
+	if time.Since(created.Created.Time()) > time.Minute {
+		t.Errorf("assignment was created at %v, expected now", created.Created.Time())
+	}
+}
+
+func TestCreateAssignmentInArchivedCourse(t *testing.T) {
+	courseID := createTestCourse(t, sessionCookie(), "archived course")
+	if err := db.UpdateCourse(courseID, structs.Course{Name: "archived course", Archived: true}); err != nil {
+		t.Fatalf("error archiving course: %v", err)
+	}
+
+	if status := createAssignmentStatus(t, sessionCookie(), courseID); status != http.StatusForbidden {
+		t.Errorf("creating an assignment in an archived course returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+}
+
+func TestCreateAssignmentInForeignCourse(t *testing.T) {
+	otherCookie := registerTestUser(t, "foreign_create")
+	courseID := createTestCourse(t, otherCookie, "foreign course")
+
+	status := createAssignmentStatus(t, sessionCookie(), courseID)
+	if status != http.StatusForbidden {
+		t.Errorf("creating an assignment in a foreign course returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	// the owner of the course is allowed to
+	status = createAssignmentStatus(t, otherCookie, courseID)
+	if status != http.StatusOK {
+		t.Errorf("creating an assignment in an own course returned status code %d, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestCreateAssignmentInMoodleCourseWithoutMoodle(t *testing.T) {
+	// the test user has not connected a moodle account, so they can't be in any moodle course
+	status := createAssignmentStatus(t, sessionCookie(), 123)
+	if status != http.StatusForbidden {
+		t.Errorf("creating an assignment in a moodle course without moodle returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+}
+
+func TestCreateAssignmentInNonexistentCourse(t *testing.T) {
+	status := createAssignmentStatus(t, sessionCookie(), -999999)
+	if status != http.StatusForbidden {
+		t.Errorf("creating an assignment in a nonexistent course returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+}
+
+func TestGetAssignmentFromForeignCourse(t *testing.T) {
+	otherCookie := registerTestUser(t, "foreign_get")
+	courseID := createTestCourse(t, otherCookie, "foreign course")
+	assignment := createTestAssignment(t, otherCookie, courseID)
+
+	if status := getAssignmentStatus(t, sessionCookie(), assignment.UID.String()); status != http.StatusForbidden {
+		t.Errorf("getting an assignment from a foreign course returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	if status := getAssignmentStatus(t, otherCookie, assignment.UID.String()); status != http.StatusOK {
+		t.Errorf("getting an assignment from an own course returned status code %d, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestMarkAssignmentFromForeignCourseDone(t *testing.T) {
+	otherCookie := registerTestUser(t, "foreign_done")
+	courseID := createTestCourse(t, otherCookie, "foreign course")
+	assignment := createTestAssignment(t, otherCookie, courseID)
+
+	req, err := http.NewRequest("POST", "http://localhost:8000/assignment/"+assignment.UID.String()+"/done", nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(sessionCookie())
+	req = mux.SetURLVars(req, map[string]string{"id": assignment.UID.String()})
+
+	rr := httptest.NewRecorder()
+	Authenticated(func(w http.ResponseWriter, r *http.Request) { AssignmentDone(w, r, true) })(rr, req)
+
+	if status := rr.Result().StatusCode; status != http.StatusForbidden {
+		t.Errorf("marking an assignment from a foreign course as done returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+}
+
+func TestMarkAssignmentDone(t *testing.T) {
+	cookie := registerTestUser(t, "done_twice")
+	courseID := createTestCourse(t, cookie, "done course")
+	assignment := createTestAssignment(t, cookie, courseID)
+
+	// marking the same assignment from several requests at once must neither fail nor record it twice
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status := markAssignmentDoneStatus(t, cookie, assignment.UID.String(), true); status != http.StatusOK {
+				t.Errorf("marking an assignment as done returned status code %d, expected %d", status, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+
+	a, err := db.GetAssignmentByID(assignment.UID.String())
+	if err != nil {
+		t.Fatalf("error getting assignment: %v", err)
+	}
+
+	if len(a.DoneBy) != 1 {
+		t.Fatalf("assignment is done by %v, expected exactly one user", a.DoneBy)
+	}
+
+	if doneAt, ok := a.DoneAt[a.DoneBy[0]]; !ok || time.Since(doneAt.Time()) > time.Minute {
+		t.Errorf("assignment has done_at %v, expected the time it was marked as done", a.DoneAt)
+	}
+
+	if status := markAssignmentDoneStatus(t, cookie, assignment.UID.String(), false); status != http.StatusOK {
+		t.Errorf("marking an assignment as not done returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	a, err = db.GetAssignmentByID(assignment.UID.String())
+	if err != nil {
+		t.Fatalf("error getting assignment: %v", err)
+	}
+
+	if len(a.DoneBy) != 0 || len(a.DoneAt) != 0 {
+		t.Errorf("assignment is still done by %v after marking it as not done", a.DoneBy)
+	}
+}
+
+func TestUpdateNonexistentAssignment(t *testing.T) {
+	status := updateAssignmentStatus(t, sessionCookie(), ksuid.New().String(), map[string]string{"title": "updated"})
+	if status != http.StatusNotFound {
+		t.Errorf("updating a nonexistent assignment returned status code %d, expected %d", status, http.StatusNotFound)
+	}
+}
+
+// updateAssignmentStatus updates the assignment with data and returns the status code of the response
+func updateAssignmentStatus(t *testing.T, cookie *http.Cookie, id string, data interface{}) int {
+	return requestStatus(t, "PUT", Authenticated(UpdateAssignment), cookie, map[string]string{"id": id}, data)
+}
+
+// markAssignmentDoneStatus marks the assignment as (not) done and returns the status code of the response
+func markAssignmentDoneStatus(t *testing.T, cookie *http.Cookie, id string, done bool) int {
+	handler := func(w http.ResponseWriter, r *http.Request) { AssignmentDone(w, r, done) }
+	return requestStatus(t, "POST", Authenticated(handler), cookie, map[string]string{"id": id}, nil)
+}
+
+// createAssignmentStatus tries to create an assignment in the course and returns the status code of the response
+func createAssignmentStatus(t *testing.T, cookie *http.Cookie, courseID int) int {
+	return createAssignment(t, cookie, courseID).Code
+}
+
+// createTestAssignment creates an assignment in the course and fails the test if that doesn't work
+func createTestAssignment(t *testing.T, cookie *http.Cookie, courseID int) structs.Assignment {
+	result := createAssignment(t, cookie, courseID).Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("creating assignment failed with status code %d", result.StatusCode)
+	}
+
+	var resp struct {
+		Content structs.Assignment `json:"content"`
+	}
+	if err := json.NewDecoder(result.Body).Decode(&resp); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+
+	return resp.Content
+}
+
+// createAssignment sends a test assignment in the course to CreateAssignment
+func createAssignment(t *testing.T, cookie *http.Cookie, courseID int) *httptest.ResponseRecorder {
+	a := structs.Assignment{
+		Title:   "test assignment",
+		DueDate: (structs.UnixTime)(time.Date(2021, 11, 16, 0, 0, 0, 0, time.UTC)),
+		Course:  courseID,
+	}
+
+	return request(t, "POST", Authenticated(CreateAssignment), cookie, nil, a)
+}
+
+// getAssignmentStatus requests the assignment with the given id and returns the status code of the response
+func getAssignmentStatus(t *testing.T, cookie *http.Cookie, id string) int {
+	return requestStatus(t, "GET", Authenticated(GetAssignment), cookie, map[string]string{"id": id}, nil)
+}
@@ -0,0 +1,149 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+)
+
+type contextKey int
+
+// userContextKey is the key of the authenticated user in the request context
+const userContextKey contextKey = iota
+
+// Authenticated only lets requests with a valid session through. The user of the session is stored in the request
+// context, handlers get it with currentUser.
+func Authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return Scoped("", h)
+}
+
+// Scoped is Authenticated for routes that may also be used with a personal access token (`Authorization: Bearer`), as
+// long as the token has the scope. With an empty scope, only sessions are accepted.
+//
+// Users whose role requires two-factor authentication get 403 until they enabled it.
+func Scoped(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return scoped(scope, true, h)
+}
+
+// TwoFactorSetup is Authenticated for the routes users need to set up two-factor authentication, they work even if the
+// role of the user requires it and it isn't enabled yet
+func TwoFactorSetup(h http.HandlerFunc) http.HandlerFunc {
+	return scoped("", false, h)
+}
+
+func scoped(scope string, enforceTwoFactor bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := authenticate(w, r, scope)
+		if !ok {
+			return
+		}
+
+		if enforceTwoFactor && !requireTwoFactorSetup(w, user) {
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	}
+}
+
+// RequirePermission is Authenticated for routes that are only allowed if the user's role grants the permission
+func RequirePermission(permission string, h http.HandlerFunc) http.HandlerFunc {
+	return Authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if !requirePermission(w, currentUser(r), permission) {
+			return
+		}
+
+		h(w, r)
+	})
+}
+
+// authenticate resolves the session or, if the route has a scope, the personal access token of the request. If there
+// is no valid session, it responds with 401 (or 500 if looking it up failed) and returns false.
+func authenticate(w http.ResponseWriter, r *http.Request, scope string) (structs.User, bool) {
+	if token, ok := bearerToken(r); ok {
+		return authenticateAPIToken(w, token, scope)
+	}
+
+	user, authenticated, err := getUserBySession(r)
+	if err != nil && err != db.ErrNotFound {
+		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
+		respondError(w, errInternal)
+		return structs.User{}, false
+	}
+
+	if !authenticated || err == db.ErrNotFound {
+		respondError(w, errInvalidSession)
+		return structs.User{}, false
+	}
+
+	return user, true
+}
+
+// authenticateAPIToken is authenticate for requests with a personal access token
+func authenticateAPIToken(w http.ResponseWriter, token string, scope string) (structs.User, bool) {
+	user, apiToken, err := db.GetUserByAPIToken(token)
+	if err != nil {
+		if err == db.ErrInvalidToken || err == db.ErrNotFound {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondError(w, errInvalidAPIToken)
+			return structs.User{}, false
+		}
+
+		logging.ErrorLogger.Printf("error getting user by api token: %v\n", err)
+		respondError(w, errInternal)
+		return structs.User{}, false
+	}
+
+	if scope == "" {
+		respondError(w, errTokenNotAllowed)
+		return structs.User{}, false
+	}
+
+	if !apiToken.HasScope(scope) {
+		respondError(w, errMissingScope.withMessage("the token is missing the scope "+scope))
+		return structs.User{}, false
+	}
+
+	return user, true
+}
+
+// bearerToken returns the token of the `Authorization: Bearer` header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < len("Bearer ") || !strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(header[len("Bearer "):]), true
+}
+
+// currentUser returns the user Authenticated stored in the request context. Only call it in handlers registered with
+// Authenticated.
+func currentUser(r *http.Request) structs.User {
+	user, ok := r.Context().Value(userContextKey).(structs.User)
+	if !ok {
+		panic("currentUser called for a route that is not authenticated")
+	}
+
+	return user
+}
+
+// currentUserWithCourses is currentUser with the user's moodle and native courses. If they can't be loaded, it responds
+// with 500 and returns false.
+func currentUserWithCourses(w http.ResponseWriter, r *http.Request) (structs.User, bool) {
+	user := currentUser(r)
+
+	courses, err := db.GetUserCourses(user)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting courses of user: %v\n", err)
+		respondError(w, errInternal)
+		return structs.User{}, false
+	}
+
+	user.Courses = courses
+	return user, true
+}
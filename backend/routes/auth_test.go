@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticated(t *testing.T) {
+	cookie := registerTestUser(t, "authenticated")
+
+	var username string
+	handler := Authenticated(func(w http.ResponseWriter, r *http.Request) {
+		username = currentUser(r).Username
+		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+	})
+
+	for _, c := range []struct {
+		name     string
+		cookie   *http.Cookie
+		expected int
+	}{
+		{"without session", nil, http.StatusUnauthorized},
+		{"with unknown session", &http.Cookie{Name: sessionCookieName, Value: "not a session"}, http.StatusUnauthorized},
+		{"with session", cookie, http.StatusOK},
+	} {
+		username = ""
+
+		req, err := http.NewRequest("GET", "http://localhost:8000", nil)
+		if err != nil {
+			t.Fatalf("error requesting: %v", err)
+		}
+		if c.cookie != nil {
+			req.AddCookie(c.cookie)
+		}
+		rr := httptest.NewRecorder()
+
+		handler(rr, req)
+
+		result := rr.Result()
+		if result.StatusCode != c.expected {
+			t.Errorf("requesting %s returned status code %d, expected %d", c.name, result.StatusCode, c.expected)
+			continue
+		}
+
+		if c.expected != http.StatusOK {
+			var body apiResponse
+			if err := json.NewDecoder(result.Body).Decode(&body); err != nil {
+				t.Fatalf("error decoding body: %v", err)
+			}
+			if len(body.Errors) != 1 || body.Errors[0].Code != errInvalidSession.Code {
+				t.Errorf("requesting %s returned errors %+v, expected %s", c.name, body.Errors, errInvalidSession.Code)
+			}
+			if username != "" {
+				t.Errorf("handler was called %s", c.name)
+			}
+		} else if username != "authenticated" {
+			t.Errorf("handler got user %q from the context, expected %q", username, "authenticated")
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package routes
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
+	"strings"
 	"time"
 
 	"git.teich.3nt3.de/3nt3/homework/db"
@@ -14,38 +14,25 @@ import (
 
 func GetActiveCourses(w http.ResponseWriter, r *http.Request) {
 
-	user, authenticated, err := getUserBySession(r, false)
-	if err != nil {
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
-		return
-	}
+	user := currentUser(r)
 
 	courses, err := db.GetMoodleUserCourses(user)
 	if err != nil {
-		if err.Error() == "no token or moodle url was provided" {
+		if err == db.ErrMoodleNotConnected || err == db.ErrMoodleTokenExpired {
 			logging.InfoLogger.Printf("no moodle access configured for user %s\n", user.ID.String())
-
-			_ = returnApiResponse(w, apiResponse{
-				Content: []string{},
-				Errors:  []string{},
-			}, 200)
-			return
+		} else {
+			logging.ErrorLogger.Printf("error: %v\n", err)
 		}
-		logging.ErrorLogger.Printf("error: %v\n", err)
 	}
 
+	nativeCourses, err := db.GetNativeUserCourses(user, false)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting native courses: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+	courses = append(courses, nativeCourses...)
+
 	var filteredCourses []structs.Course
 	for _, c := range courses {
 		var filteredAssignments []structs.Assignment
@@ -88,36 +75,20 @@ func GetActiveCourses(w http.ResponseWriter, r *http.Request) {
 
 	if _, ok := r.URL.Query()["expandUsers"]; ok {
 
-		// get users for assignments
-		// literally the ugliest code ever
-		var knownUsers map[string]structs.CleanUser = make(map[string]structs.CleanUser)
+		// the done by users are already loaded together with the assignments, they only have to be cleaned
 		var courseMaps []map[string]interface{}
 
 		for _, c := range filteredFilteredCourses {
 			var expandedAssignments []map[string]interface{} = make([]map[string]interface{}, 0)
 			for _, a := range c.Assignments {
 				var users []structs.CleanUser = make([]structs.CleanUser, 0)
-				for _, userID := range a.DoneBy {
-					user, ok := knownUsers[userID]
-					if !ok {
-						dbUser, err := db.GetUserById(userID, false)
-						if err != nil {
-							logging.WarningLogger.Printf("error getting user '%s' from db: %v\n", userID, err)
-							_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"internal server error"}}, http.StatusInternalServerError)
-						}
-
-						knownUsers[userID] = dbUser.GetClean()
-
-						users = append(users, dbUser.GetClean())
-					} else {
-						users = append(users, user)
-					}
-
+				for _, u := range a.DoneByUsers {
+					users = append(users, u.GetClean())
 				}
 				aMap, err := structToMap(a)
 				if err != nil {
 					logging.InfoLogger.Printf("error converting assignment to map: %v\n", err)
-					_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"internal server error"}}, http.StatusInternalServerError)
+					respondError(w, errInternal)
 					return
 				}
 
@@ -129,7 +100,7 @@ func GetActiveCourses(w http.ResponseWriter, r *http.Request) {
 			cMap, err := structToMap(c)
 			if err != nil {
 				logging.InfoLogger.Printf("error converting course to map: %v\n", err)
-				_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"internal server error"}}, http.StatusInternalServerError)
+				respondError(w, errInternal)
 				return
 			}
 
@@ -140,42 +111,32 @@ func GetActiveCourses(w http.ResponseWriter, r *http.Request) {
 
 		_ = returnApiResponse(w, apiResponse{
 			Content: courseMaps,
-			Errors:  []string{},
+			Errors:  []apiError{},
 		}, 200)
 	} else {
 		_ = returnApiResponse(w, apiResponse{
 			Content: filteredFilteredCourses,
-			Errors:  []string{},
+			Errors:  []apiError{},
 		}, 200)
 	}
 }
 
 func SearchCourses(w http.ResponseWriter, r *http.Request) {
-	user, authenticated, err := getUserBySession(r, false)
-	if !authenticated {
-		if err != nil {
-			logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		}
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
-		return
-	}
+	user := currentUser(r)
 
 	searchterm, ok := mux.Vars(r)["searchterm"]
 	if !ok {
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"no searchterm provided"}}, http.StatusBadRequest)
+		respondError(w, errBadRequest.withMessage("no searchterm provided"))
 		return
 	}
 
 	matchingCourses, err := db.SearchUserCourses(searchterm, user)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{Content: []interface{}{}, Errors: []string{}}, http.StatusOK)
+		if err == db.ErrNotFound {
+			_ = returnApiResponse(w, apiResponse{Content: []interface{}{}, Errors: []apiError{}}, http.StatusOK)
 		} else {
 			logging.ErrorLogger.Printf("an error occured searching courses: %v", err)
-			_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"internal server error"}}, http.StatusInternalServerError)
+			respondError(w, errInternal)
 		}
 		return
 	}
@@ -187,37 +148,216 @@ func SearchCourses(w http.ResponseWriter, r *http.Request) {
 
 	_ = returnApiResponse(w, apiResponse{
 		Content: cleanCourses,
-		Errors:  []string{},
+		Errors:  []apiError{},
 	}, 200)
 }
 
-// TODO
+// GetAllCourses returns all courses the user is enrolled in, moodle courses as well as native ones.
+// Archived native courses are only included if ?archived is provided.
 func GetAllCourses(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	courses, err := db.GetMoodleUserCourses(user)
+	if err != nil && err != db.ErrMoodleNotConnected && err != db.ErrMoodleTokenExpired {
+		logging.ErrorLogger.Printf("error getting moodle courses: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_, includeArchived := r.URL.Query()["archived"]
+	nativeCourses, err := db.GetNativeUserCourses(user, includeArchived)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting native courses: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+	courses = append(courses, nativeCourses...)
+
+	cleanCourses := make([]structs.CleanCourse, 0)
+	for _, c := range courses {
+		cleanCourses = append(cleanCourses, c.GetClean())
+	}
 
+	_ = returnApiResponse(w, apiResponse{
+		Content: cleanCourses,
+		Errors:  []apiError{},
+	}, 200)
 }
 
-func GetCourseStats(w http.ResponseWriter, r *http.Request) {
-	user, authenticated, err := getUserBySession(r, false)
-	if !authenticated {
-		if err != nil {
-			logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
+// CreateCourse creates a new native course. The creator becomes its teacher.
+func CreateCourse(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	type courseData struct {
+		Name string `json:"name"`
+	}
+
+	var data courseData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	data.Name = strings.TrimSpace(data.Name)
+	if data.Name == "" {
+		respondError(w, errEmptyCourseName)
+		return
+	}
+
+	course, err := db.CreateCourse(data.Name, user)
+	if err != nil {
+		logging.ErrorLogger.Printf("error creating course: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{
+		Content: course.GetClean(),
+		Errors:  []apiError{},
+	}, http.StatusOK)
+}
+
+// GetCourse returns the native course with the id from the url if the user is enrolled in it
+func GetCourse(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := courseIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	role, err := db.GetCourseMemberRole(id, user)
+	if err != nil {
+		// don't tell non-members whether the course exists
+		if err == db.ErrNotFound {
+			respondError(w, errCourseNotFound)
+			return
 		}
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"not authenticated"},
-		}, 401)
+
+		logging.ErrorLogger.Printf("error checking course membership: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	course, err := db.GetCourseByID(id)
+	if err != nil {
+		if err == db.ErrNotFound {
+			respondError(w, errCourseNotFound)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error getting course: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+	course.User = user.ID
+
+	if role == structs.CourseRoleStudent {
+		course.InviteCode = ""
+	}
+
+	_ = returnApiResponse(w, apiResponse{
+		Content: course.GetClean(),
+		Errors:  []apiError{},
+	}, http.StatusOK)
+}
+
+// UpdateCourse renames and/or (un)archives a native course. Only the teacher of the course may do this.
+func UpdateCourse(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := courseIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	role, err := db.GetCourseMemberRole(id, user)
+	if err != nil {
+		// don't tell non-members whether the course exists
+		if err == db.ErrNotFound {
+			respondError(w, errCourseNotFound)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error checking course membership: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if role != structs.CourseRoleTeacher {
+		respondError(w, errCourseRoleRequired)
 		return
 	}
 
+	course, err := db.GetCourseByID(id)
+	if err != nil {
+		if err == db.ErrNotFound {
+			respondError(w, errCourseNotFound)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error getting course: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	type updateDataStruct struct {
+		Name     *string `json:"name"`
+		Archived *bool   `json:"archived"`
+	}
+
+	var updateData updateDataStruct
+	if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	if updateData.Name != nil {
+		name := strings.TrimSpace(*updateData.Name)
+		if name == "" {
+			respondError(w, errEmptyCourseName)
+			return
+		}
+		course.Name = name
+	}
+
+	if updateData.Archived != nil {
+		course.Archived = *updateData.Archived
+	}
+
+	if err := db.UpdateCourse(id, course); err != nil {
+		logging.ErrorLogger.Printf("error updating course: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+	course.User = user.ID
+
+	_ = returnApiResponse(w, apiResponse{
+		Content: course.GetClean(),
+		Errors:  []apiError{},
+	}, http.StatusOK)
+}
+
+func GetCourseStats(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
 	courses, err := db.GetMoodleUserCourses(user)
 	if err != nil {
-		if err != sql.ErrNoRows {
+		if err != db.ErrNotFound && err != db.ErrMoodleNotConnected && err != db.ErrMoodleTokenExpired {
 			logging.ErrorLogger.Printf("error getting courses: %v\n", err)
-			_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"internal server error"}}, 500)
+			respondError(w, errInternal)
 			return
 		}
 	}
 
+	nativeCourses, err := db.GetNativeUserCourses(user, false)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting native courses: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+	courses = append(courses, nativeCourses...)
+
 	// FIXME: use ids rather than names to avoid confusion
 	var courseAssignments map[string]int = make(map[string]int)
 	for _, c := range courses {
@@ -226,9 +366,9 @@ func GetCourseStats(w http.ResponseWriter, r *http.Request) {
 		if !ok {
 			id = int(c.ID.(float64))
 		}
-		assignments, err := db.GetAssignmentsByCourse(id)
+		assignments, err := db.GetAssignmentsByCourse(user.MoodleURL, id)
 		if err != nil {
-			if err != sql.ErrNoRows {
+			if err != db.ErrNotFound {
 				logging.WarningLogger.Printf("error getting assignments: %v\n", err)
 				continue
 			}
@@ -0,0 +1,375 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+)
+
+// JoinCourse enrolls the user as a student in the native course belonging to the invite code in the request body
+func JoinCourse(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	type joinData struct {
+		InviteCode string `json:"invite_code"`
+	}
+
+	var data joinData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	course, err := db.GetCourseByInviteCode(strings.ToUpper(strings.TrimSpace(data.InviteCode)))
+	if err != nil {
+		if err == db.ErrNotFound {
+			respondError(w, errInvalidInviteCode)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error getting course by invite code: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if course.Archived {
+		respondError(w, errCourseArchived)
+		return
+	}
+
+	if err := db.AddCourseMember(course.ID.(int), user, structs.CourseRoleStudent); err != nil {
+		logging.ErrorLogger.Printf("error adding course member: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	course.User = user.ID
+	course.InviteCode = ""
+
+	_ = returnApiResponse(w, apiResponse{
+		Content: course.GetClean(),
+		Errors:  []apiError{},
+	}, http.StatusOK)
+}
+
+// LeaveCourse removes the user from the native course with the id from the url.
+// Teachers can't leave their course, they have to archive it instead.
+func LeaveCourse(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := courseIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	role, err := db.GetCourseMemberRole(id, user)
+	if err != nil {
+		if err == db.ErrNotFound {
+			respondError(w, errNotCourseMember.withMessage("you are not a member of this course"))
+			return
+		}
+
+		logging.ErrorLogger.Printf("error getting course member role: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if role == structs.CourseRoleTeacher {
+		respondError(w, errTeacherCantLeave)
+		return
+	}
+
+	if err := db.RemoveCourseMember(id, user.ID.String()); err != nil {
+		logging.ErrorLogger.Printf("error removing course member: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{
+		Content: nil,
+		Errors:  []apiError{},
+	}, http.StatusOK)
+}
+
+// GetCourseMembers returns the members of the native course with the id from the url. Only members may see them.
+func GetCourseMembers(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := courseIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !requireCourseRole(w, id, user, structs.CourseRoleStudent, structs.CourseRoleHelper, structs.CourseRoleTeacher) {
+		return
+	}
+
+	members, err := db.GetCourseMembers(id)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting course members: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if members == nil {
+		members = make([]structs.CourseMember, 0)
+	}
+
+	_ = returnApiResponse(w, apiResponse{
+		Content: members,
+		Errors:  []apiError{},
+	}, http.StatusOK)
+}
+
+// UpdateCourseMember changes the role of a member of a native course. Only teachers may do this.
+func UpdateCourseMember(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := courseIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !requireCourseRole(w, id, user, structs.CourseRoleTeacher) {
+		return
+	}
+
+	memberID := mux.Vars(r)["user_id"]
+	if memberID == user.ID.String() {
+		respondError(w, errOwnRole)
+		return
+	}
+
+	if !canChangeCourseMember(w, id, user, memberID) {
+		return
+	}
+
+	type memberData struct {
+		Role string `json:"role"`
+	}
+
+	var data memberData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || !structs.ValidCourseRole(data.Role) {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	if err := db.SetCourseMemberRole(id, memberID, data.Role); err != nil {
+		if err == db.ErrNotFound {
+			respondError(w, errNotCourseMember)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error setting course member role: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{
+		Content: nil,
+		Errors:  []apiError{},
+	}, http.StatusOK)
+}
+
+// RemoveCourseMember removes a member from a native course. Only teachers may do this.
+func RemoveCourseMember(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := courseIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !requireCourseRole(w, id, user, structs.CourseRoleTeacher) {
+		return
+	}
+
+	memberID := mux.Vars(r)["user_id"]
+	if memberID == user.ID.String() {
+		respondError(w, errTeacherCantLeave)
+		return
+	}
+
+	if !canChangeCourseMember(w, id, user, memberID) {
+		return
+	}
+
+	if err := db.RemoveCourseMember(id, memberID); err != nil {
+		if err == db.ErrNotFound {
+			respondError(w, errNotCourseMember)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error removing course member: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{
+		Content: nil,
+		Errors:  []apiError{},
+	}, http.StatusOK)
+}
+
+// RegenerateInviteCode replaces the invite code of a native course, e.g. after it was leaked. Only teachers may do this.
+func RegenerateInviteCode(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id, ok := courseIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !requireCourseRole(w, id, user, structs.CourseRoleTeacher) {
+		return
+	}
+
+	inviteCode, err := db.RegenerateInviteCode(id)
+	if err != nil {
+		logging.ErrorLogger.Printf("error regenerating invite code: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{
+		Content: inviteCode,
+		Errors:  []apiError{},
+	}, http.StatusOK)
+}
+
+// courseIDFromRequest parses the course id from the url and responds with 400 if it is invalid
+func courseIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, errBadRequest.withMessage("invalid course id"))
+		return 0, false
+	}
+
+	return id, true
+}
+
+// canChangeCourseMember checks that the user may change the role of the member or remove them and responds with an error
+// if not. Teachers are peers when it comes to students and helpers, but only the teacher the course belongs to
+// (structs.Course.TeacherID) may change or remove other teachers, so it can't be taken away from them.
+func canChangeCourseMember(w http.ResponseWriter, courseID int, user structs.User, memberID string) bool {
+	memberKSUID, err := ksuid.Parse(memberID)
+	if err != nil {
+		respondError(w, errNotCourseMember)
+		return false
+	}
+
+	role, err := db.GetCourseMemberRole(courseID, structs.User{ID: memberKSUID})
+	if err != nil {
+		if err == db.ErrNotFound {
+			respondError(w, errNotCourseMember)
+			return false
+		}
+
+		logging.ErrorLogger.Printf("error getting course member role: %v\n", err)
+		respondError(w, errInternal)
+		return false
+	}
+
+	if role != structs.CourseRoleTeacher {
+		return true
+	}
+
+	teacherID, err := db.GetCourseTeacherID(courseID)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting course teacher: %v\n", err)
+		respondError(w, errInternal)
+		return false
+	}
+
+	if teacherID != user.ID.String() {
+		respondError(w, errCourseRoleRequired.withMessage("only the teacher the course belongs to may change other teachers"))
+		return false
+	}
+
+	return true
+}
+
+// requireCourseRole checks that the user has one of roles in the native course and responds with 403 if not.
+// It returns true if the request may continue.
+func requireCourseRole(w http.ResponseWriter, courseID int, user structs.User, roles ...string) bool {
+	role, err := db.GetCourseMemberRole(courseID, user)
+	if err != nil && err != db.ErrNotFound {
+		logging.ErrorLogger.Printf("error getting course member role: %v\n", err)
+		respondError(w, errInternal)
+		return false
+	}
+
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+
+	respondError(w, errCourseRoleRequired)
+	return false
+}
+
+// canManageAssignment returns true if the user may edit or delete the assignment.
+// That's the creator, users whose role allows moderating assignments and, in native courses, the course's teachers and
+// helpers.
+func canManageAssignment(user structs.User, assignment structs.Assignment) (bool, error) {
+	if assignment.User.ID == user.ID {
+		return true, nil
+	}
+
+	moderator, err := db.HasPermission(user, structs.PermissionModerateAssignments)
+	if err != nil || moderator {
+		return moderator, err
+	}
+
+	if assignment.Course >= 0 {
+		return false, nil
+	}
+
+	role, err := db.GetCourseMemberRole(assignment.Course, user)
+	if err != nil {
+		if err == db.ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return role == structs.CourseRoleTeacher || role == structs.CourseRoleHelper, nil
+}
+
+// requireCourseAccess checks that the user may access the course (see db.UserCanAccessCourse) and responds with 403
+// if not. It returns true if the request may continue.
+func requireCourseAccess(w http.ResponseWriter, user structs.User, courseID int) bool {
+	canAccess, err := db.UserCanAccessCourse(user, courseID)
+	if err != nil {
+		logging.ErrorLogger.Printf("error checking course access: %v\n", err)
+		respondError(w, errInternal)
+		return false
+	}
+
+	if !canAccess {
+		respondError(w, errNoCourseAccess)
+		return false
+	}
+
+	return true
+}
+
+// requireAssignmentAccess checks that the user may access the assignment like requireCourseAccess. Moodle course ids
+// are only unique per instance, so assignments imported from another moodle instance can't be accessed even if the
+// user is in a course with the same id there.
+func requireAssignmentAccess(w http.ResponseWriter, user structs.User, assignment structs.Assignment) bool {
+	if assignment.MoodleURL != "" && assignment.MoodleURL != user.MoodleURL {
+		respondError(w, errNoCourseAccess)
+		return false
+	}
+
+	return requireCourseAccess(w, user, assignment.Course)
+}
@@ -0,0 +1,82 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/segmentio/ksuid"
+)
+
+func TestUpdateForeignCourse(t *testing.T) {
+	otherCookie := registerTestUser(t, "update_course_owner")
+	courseID := createTestCourse(t, otherCookie, "foreign course")
+
+	// non-members can't tell a foreign course from one that doesn't exist
+	if status := courseRequestStatus(t, "PUT", UpdateCourse, sessionCookie(), courseID, "", map[string]string{"name": "renamed"}); status != http.StatusNotFound {
+		t.Errorf("updating a foreign course returned status code %d, expected %d", status, http.StatusNotFound)
+	}
+	if status := courseRequestStatus(t, "PUT", UpdateCourse, sessionCookie(), -999999999, "", map[string]string{"name": "renamed"}); status != http.StatusNotFound {
+		t.Errorf("updating a nonexistent course returned status code %d, expected %d", status, http.StatusNotFound)
+	}
+
+	// students of the course aren't allowed to either
+	if err := db.AddCourseMember(courseID, userOfSession(t, sessionCookie()), structs.CourseRoleStudent); err != nil {
+		t.Fatalf("error joining course: %v", err)
+	}
+	if status := courseRequestStatus(t, "PUT", UpdateCourse, sessionCookie(), courseID, "", map[string]string{"name": "renamed"}); status != http.StatusForbidden {
+		t.Errorf("updating a course as a student returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	if status := courseRequestStatus(t, "PUT", UpdateCourse, otherCookie, courseID, "", map[string]string{"name": "renamed"}); status != http.StatusOK {
+		t.Errorf("updating an own course returned status code %d, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestCourseTeachers(t *testing.T) {
+	creatorCookie := registerTestUser(t, "course_teacher_creator")
+	courseID := createTestCourse(t, creatorCookie, "teacher course")
+	creator := userOfSession(t, creatorCookie)
+
+	secondCookie := registerTestUser(t, "course_teacher_second")
+	second := userOfSession(t, secondCookie)
+	if err := db.AddCourseMember(courseID, second, structs.CourseRoleStudent); err != nil {
+		t.Fatalf("error joining course: %v", err)
+	}
+
+	if status := courseRequestStatus(t, "PUT", UpdateCourseMember, creatorCookie, courseID, second.ID.String(), map[string]string{"role": structs.CourseRoleTeacher}); status != http.StatusOK {
+		t.Fatalf("promoting a member to teacher returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	// other teachers can't take the course away from the one it belongs to
+	if status := courseRequestStatus(t, "PUT", UpdateCourseMember, secondCookie, courseID, creator.ID.String(), map[string]string{"role": structs.CourseRoleStudent}); status != http.StatusForbidden {
+		t.Errorf("demoting the creator returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+	if status := courseRequestStatus(t, "DELETE", RemoveCourseMember, secondCookie, courseID, creator.ID.String(), nil); status != http.StatusForbidden {
+		t.Errorf("removing the creator returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	if status := courseRequestStatus(t, "DELETE", RemoveCourseMember, creatorCookie, courseID, ksuid.New().String(), nil); status != http.StatusNotFound {
+		t.Errorf("removing someone who isn't a member returned status code %d, expected %d", status, http.StatusNotFound)
+	}
+
+	// if the teacher stops being one anyway, the other teacher takes their place
+	if err := db.SetCourseMemberRole(courseID, creator.ID.String(), structs.CourseRoleStudent); err != nil {
+		t.Fatalf("error setting role: %v", err)
+	}
+	if course, err := db.GetCourseByID(courseID); err != nil || course.TeacherID != second.ID || course.Teacher != second.Username {
+		t.Errorf("the teacher of the course is %s (%s), %v, expected %s", course.Teacher, course.TeacherID, err, second.Username)
+	}
+
+	if status := courseRequestStatus(t, "DELETE", RemoveCourseMember, secondCookie, courseID, creator.ID.String(), nil); status != http.StatusOK {
+		t.Errorf("removing a student returned status code %d, expected %d", status, http.StatusOK)
+	}
+}
+
+// courseRequestStatus sends data to the handler for the course (and member if memberID isn't empty) and returns the
+// status code of the response
+func courseRequestStatus(t *testing.T, method string, handler http.HandlerFunc, cookie *http.Cookie, courseID int, memberID string, data interface{}) int {
+	return requestStatus(t, method, Authenticated(handler), cookie, map[string]string{"id": strconv.Itoa(courseID), "user_id": memberID}, data)
+}
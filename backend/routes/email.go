@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/mail"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+)
+
+// VerifyEmail marks the email address of the user the `token` was sent to as verified. Without a token, a new
+// verification mail is sent to the user of the session.
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type verifyData struct {
+		Token string `json:"token"`
+	}
+
+	var data verifyData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	if data.Token == "" {
+		resendVerificationMail(w, r)
+		return
+	}
+
+	userID, err := db.UseUserToken(data.Token, db.TokenPurposeVerifyEmail)
+	if err != nil {
+		respondTokenError(w, err)
+		return
+	}
+
+	if err := db.SetEmailVerified(userID); err != nil {
+		logging.ErrorLogger.Printf("error verifying email: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// resendVerificationMail sends a new verification mail to the user of the session. VerifyEmail is public, so the session
+// is checked here instead of by Authenticated.
+func resendVerificationMail(w http.ResponseWriter, r *http.Request) {
+	user, ok := authenticate(w, r, "")
+	if !ok {
+		return
+	}
+
+	if user.EmailVerified {
+		respondError(w, errEmailAlreadyVerified)
+		return
+	}
+
+	if err := sendVerificationMail(user, mail.VerifyEmailMail); err != nil {
+		logging.ErrorLogger.Printf("error sending verification mail: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// sendVerificationMail creates a new verification token and sends it to the user with send, e.g. mail.WelcomeMail
+func sendVerificationMail(user structs.User, send func(structs.User, string) error) error {
+	token, err := db.NewUserToken(user.ID.String(), db.TokenPurposeVerifyEmail, config.Get().Mail.VerifyEmailTokenLifetime)
+	if err != nil {
+		return err
+	}
+
+	return send(user, token)
+}
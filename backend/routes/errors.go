@@ -0,0 +1,97 @@
+package routes
+
+import "net/http"
+
+// apiError is an error as it is sent to clients. Code is meant for programs and doesn't change, Message is meant for
+// humans and may be reworded.
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// status is the http status code of responses with this error
+	status int
+}
+
+// withMessage returns the error with a more specific message, the code and status stay the same
+func (e apiError) withMessage(message string) apiError {
+	e.Message = message
+	return e
+}
+
+// every error the api responds with. Errors with the same cause share a code, so clients don't have to compare
+// messages.
+var (
+	// generic errors
+	errInternal         = apiError{Code: "internal_error", Message: "internal server error", status: http.StatusInternalServerError}
+	errBadRequest       = apiError{Code: "bad_request", Message: "bad request", status: http.StatusBadRequest}
+	errInvalidSession   = apiError{Code: "invalid_session", Message: "invalid session", status: http.StatusUnauthorized}
+	errPermissionDenied = apiError{Code: "permission_denied", Message: "permission denied", status: http.StatusForbidden}
+	errTooManyRequests  = apiError{Code: "too_many_requests", Message: "too many requests", status: http.StatusTooManyRequests}
+
+	// accounts
+	errInvalidCredentials    = apiError{Code: "invalid_credentials", Message: "wrong username or password", status: http.StatusUnauthorized}
+	errWrongPassword         = apiError{Code: "wrong_password", Message: "wrong password", status: http.StatusForbidden}
+	errPasswordResetRequired = apiError{Code: "password_reset_required", Message: "password reset required", status: http.StatusForbidden}
+	errWeakPassword          = apiError{Code: "weak_password", Message: "password is too weak", status: http.StatusBadRequest}
+	errUsernameTaken         = apiError{Code: "username_taken", Message: "username already in use", status: http.StatusConflict}
+	errEmailTaken            = apiError{Code: "email_taken", Message: "email already in use", status: http.StatusConflict}
+	errEmailAlreadyVerified  = apiError{Code: "email_already_verified", Message: "email already verified", status: http.StatusConflict}
+	errInvalidToken          = apiError{Code: "invalid_token", Message: "invalid or expired token", status: http.StatusBadRequest}
+	errUserNotFound          = apiError{Code: "user_not_found", Message: "user not found", status: http.StatusNotFound}
+	errSessionNotFound       = apiError{Code: "session_not_found", Message: "session does not exist", status: http.StatusNotFound}
+
+	// personal access tokens
+	errInvalidAPIToken  = apiError{Code: "invalid_api_token", Message: "invalid or revoked token", status: http.StatusUnauthorized}
+	errTokenNotAllowed  = apiError{Code: "token_not_allowed", Message: "personal access tokens can't be used for this route", status: http.StatusForbidden}
+	errMissingScope     = apiError{Code: "missing_scope", Message: "the token is missing the scope required for this route", status: http.StatusForbidden}
+	errAPITokenNotFound = apiError{Code: "api_token_not_found", Message: "token does not exist", status: http.StatusNotFound}
+
+	// identity providers. Errors of the callback are passed to the frontend as ?error=<code> instead of a response.
+	errProviderNotFound    = apiError{Code: "provider_not_found", Message: "unknown identity provider", status: http.StatusNotFound}
+	errProviderUnavailable = apiError{Code: "provider_unavailable", Message: "error accessing the identity provider", status: http.StatusBadGateway}
+	errLoginCancelled      = apiError{Code: "login_cancelled", Message: "the login at the identity provider was cancelled", status: http.StatusBadRequest}
+	errInvalidLoginState   = apiError{Code: "invalid_login_state", Message: "invalid or expired login, please try again", status: http.StatusBadRequest}
+	errEmailRequired       = apiError{Code: "email_required", Message: "the identity provider didn't share an email address", status: http.StatusBadRequest}
+	errEmailLinkRequired   = apiError{Code: "email_link_required", Message: "an account with this email exists, log in with your password and connect the identity provider in your settings", status: http.StatusConflict}
+	errIdentityTaken       = apiError{Code: "identity_taken", Message: "this account is already connected to another user", status: http.StatusConflict}
+	errProviderLinked      = apiError{Code: "provider_linked", Message: "you already connected an account of this identity provider", status: http.StatusConflict}
+	errIdentityNotFound    = apiError{Code: "identity_not_found", Message: "no account of this identity provider is connected", status: http.StatusNotFound}
+	errLastLoginMethod     = apiError{Code: "last_login_method", Message: "set a password before disconnecting your only way to log in", status: http.StatusConflict}
+
+	// two-factor authentication
+	errTwoFactorRequired       = apiError{Code: "two_factor_required", Message: "enter the code of your authenticator app or a recovery code", status: http.StatusUnauthorized}
+	errInvalidTwoFactorCode    = apiError{Code: "invalid_two_factor_code", Message: "wrong or already used code", status: http.StatusForbidden}
+	errTwoFactorSetupRequired  = apiError{Code: "two_factor_setup_required", Message: "your role requires two-factor authentication, set it up in your settings", status: http.StatusForbidden}
+	errTwoFactorAlreadyEnabled = apiError{Code: "two_factor_already_enabled", Message: "two-factor authentication is already enabled", status: http.StatusConflict}
+	errTwoFactorNotSetUp       = apiError{Code: "two_factor_not_set_up", Message: "two-factor authentication is not set up", status: http.StatusConflict}
+	errTwoFactorRequiredByRole = apiError{Code: "two_factor_required_by_role", Message: "your role requires two-factor authentication", status: http.StatusConflict}
+
+	// roles
+	errOwnRole     = apiError{Code: "own_role", Message: "you can't change your own role", status: http.StatusBadRequest}
+	errUnknownRole = apiError{Code: "unknown_role", Message: "unknown role", status: http.StatusBadRequest}
+	errLastAdmin   = apiError{Code: "last_admin", Message: "the last admin can't be demoted", status: http.StatusConflict}
+
+	// assignments
+	errAssignmentNotFound = apiError{Code: "assignment_not_found", Message: "assignment not found", status: http.StatusNotFound}
+	errNotCreator         = apiError{Code: "not_creator", Message: "you are not the creator of this assignment", status: http.StatusForbidden}
+
+	// courses
+	errCourseNotFound     = apiError{Code: "course_not_found", Message: "course not found", status: http.StatusNotFound}
+	errNoCourseAccess     = apiError{Code: "no_course_access", Message: "you do not have access to this course", status: http.StatusForbidden}
+	errCourseRoleRequired = apiError{Code: "course_role_required", Message: "you don't have the required role in this course", status: http.StatusForbidden}
+	errCourseArchived     = apiError{Code: "course_archived", Message: "this course is archived", status: http.StatusForbidden}
+	errEmptyCourseName    = apiError{Code: "empty_course_name", Message: "course name must not be empty", status: http.StatusBadRequest}
+	errInvalidInviteCode  = apiError{Code: "invalid_invite_code", Message: "invalid invite code", status: http.StatusNotFound}
+	errNotCourseMember    = apiError{Code: "not_course_member", Message: "user is not a member of this course", status: http.StatusNotFound}
+	errTeacherCantLeave   = apiError{Code: "teacher_cant_leave", Message: "teachers can't leave their course", status: http.StatusConflict}
+
+	// moodle
+	errMoodleUnavailable  = apiError{Code: "moodle_unavailable", Message: "error accessing moodle", status: http.StatusBadGateway}
+	errInvalidMoodleURL   = apiError{Code: "invalid_moodle_url", Message: "invalid url", status: http.StatusBadRequest}
+	errMoodleBadData      = apiError{Code: "moodle_bad_data", Message: "moodle returned bad data", status: http.StatusBadGateway}
+	errMoodleNotConnected = apiError{Code: "moodle_not_connected", Message: "moodle is not connected", status: http.StatusConflict}
+)
+
+// respondError responds with the errors and the status of the first one
+func respondError(w http.ResponseWriter, errs ...apiError) {
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: errs}, errs[0].status)
+}
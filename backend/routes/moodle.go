@@ -1,155 +1,195 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
-	"net/url"
-	"strings"
+	"strconv"
+	"time"
 
+	"git.teich.3nt3.de/3nt3/homework/config"
 	"git.teich.3nt3.de/3nt3/homework/db"
 	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/moodle"
+	"git.teich.3nt3.de/3nt3/homework/structs"
 )
 
+// moodleIdentityProvider is the provider of the identities of users who log in with moodle, their subject is
+// moodleSubject
+const moodleIdentityProvider = "moodle"
+
+// moodleAccount is a moodle account whose credentials were checked
+type moodleAccount struct {
+	// URL is the normalized address of the moodle instance
+	URL      string
+	Token    string
+	UserID   int
+	Username string
+	Email    string
+}
+
+// MoodleAuthenticate connects the moodle account with `url`, `username` and `password` to the current user. After that,
+// the user can also log in with it.
 func MoodleAuthenticate(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
 
-	user, authenticated, err := getUserBySession(r, false)
-	if err != nil {
-		logging.WarningLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"error authenticating"},
-		}, 500)
+	var loginData moodleLoginData
+	if err := json.NewDecoder(r.Body).Decode(&loginData); err != nil {
+		respondError(w, errBadRequest)
 		return
 	}
 
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid credentials"},
-		}, 401)
+	account, e, ok := authenticateMoodle(r.Context(), loginData.URL, loginData.Username, loginData.Password)
+	if !ok {
+		respondError(w, e)
 		return
 	}
 
-	// decode moodle credentials
-	type moodleLoginData struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-		URL      string `json:"url"`
+	updatedUser, err := db.UpdateMoodleData(user, account.URL, account.Token, account.UserID, false)
+	if err != nil {
+		respondError(w, errInternal)
+		logging.InfoLogger.Printf("error updating user: %v\n", err)
+		return
 	}
 
-	var loginData moodleLoginData
-	if err = json.NewDecoder(r.Body).Decode(&loginData); err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"bad body (not valid json)"},
-		}, 400)
-		return
+	// connecting worked before logging in with moodle existed, so it must not fail if someone else already logs in
+	// with this moodle account or the user with another one
+	_, err = db.LinkIdentity(structs.Identity{Provider: moodleIdentityProvider, Subject: moodleSubject(account), UserID: user.ID, Email: account.Email})
+	if err != nil && err != db.ErrIdentityTaken && err != db.ErrProviderLinked {
+		logging.ErrorLogger.Printf("error linking moodle identity: %v\n", err)
 	}
 
-	// replace http:// with https://
-	loginData.URL = strings.Replace(loginData.URL, "http://", "https://", 1)
+	_ = returnApiResponse(w, apiResponse{Content: updatedUser.GetClean(), Errors: []apiError{}}, 200)
+}
 
-	// make request to moodle
-	values := url.Values{}
-	values.Set("username", loginData.Username)
-	values.Set("password", loginData.Password)
-	resp, err := http.PostForm(loginData.URL+"/login/token.php?service=moodle_mobile_app", values)
+// MoodleDisconnect removes the moodle account and its token from the current user. Moodle courses aren't shown anymore
+// until moodle is connected again.
+func MoodleDisconnect(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
 
-	if err != nil {
-		if resp != nil {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"error accessing moodle"},
-			}, resp.StatusCode)
-		} else {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"error accessing moodle"},
-			}, 500)
+	if err := db.DisconnectMoodle(user.ID.String()); err != nil {
+		if err == db.ErrMoodleNotConnected {
+			respondError(w, errMoodleNotConnected)
+			return
 		}
-		logging.WarningLogger.Printf("error: %v", err)
+
+		logging.ErrorLogger.Printf("error disconnecting moodle: %v\n", err)
+		respondError(w, errInternal)
 		return
 	}
 
-	if resp != nil {
-		if resp.StatusCode != 200 {
-			_ = returnApiResponse(w, apiResponse{
-				Content: nil,
-				Errors:  []string{"error accessing moodle"},
-			}, resp.StatusCode)
-			return
-		}
+	updatedUser, err := db.GetUserById(user.ID.String(), false)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting user: %v\n", err)
+		respondError(w, errInternal)
+		return
 	}
 
-	// decode response
-	type moodleTokenResponse struct {
-		Token string `json:"token"`
+	_ = returnApiResponse(w, apiResponse{Content: updatedUser.GetClean(), Errors: []apiError{}}, http.StatusOK)
+}
+
+// MoodleLogin logs in with the moodle account with `url`, `username` and `password`. The first time, an account
+// without a password is created for it, unless someone already uses the email address of the moodle account.
+func MoodleLogin(w http.ResponseWriter, r *http.Request) {
+	var loginData moodleLoginData
+	if err := json.NewDecoder(r.Body).Decode(&loginData); err != nil {
+		respondError(w, errBadRequest)
+		return
 	}
-	tokenResp := moodleTokenResponse{}
 
-	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
-	if err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"error accessing moodle"},
-		}, 500)
-		logging.WarningLogger.Printf("error: %v", err)
+	// moodle accounts are locked out separately from local accounts with the same username
+	lockoutKey := moodleIdentityProvider + ":" + loginData.URL + ":" + loginData.Username
+	if retryAfter := loginLockedOut(r, lockoutKey); retryAfter > 0 {
+		tooManyRequests(w, retryAfter)
 		return
 	}
 
-	logging.DebugLogger.Printf("token: %v\n", tokenResp.Token)
+	account, e, ok := authenticateMoodle(r.Context(), loginData.URL, loginData.Username, loginData.Password)
+	if !ok {
+		if e.Code == errInvalidCredentials.Code {
+			loginFailed(r, lockoutKey)
+		}
+		respondError(w, e)
+		return
+	}
+
+	user, err := db.GetUserByIdentity(moodleIdentityProvider, moodleSubject(account))
+	if err == db.ErrNotFound {
+		if account.Email == "" {
+			respondError(w, errEmailRequired.withMessage("moodle didn't share an email address"))
+			return
+		}
 
-	// get user id
-	idResp, err := http.PostForm(loginData.URL+"/webservice/rest/server.php", url.Values{
-		"wstoken":            {tokenResp.Token},
-		"wsfunction":         {"core_user_get_users_by_field"},
-		"field":              {"username"},
-		"values[0]":          {loginData.Username},
-		"moodlewsrestformat": {"json"},
-	})
+		user, err = newUserWithIdentity(account.Username, account.Email, false, structs.Identity{Provider: moodleIdentityProvider, Subject: moodleSubject(account), Email: account.Email})
+	}
 	if err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"error accessing moodle"},
-		}, resp.StatusCode)
-		logging.WarningLogger.Printf("error: %v", err)
+		e := identityError(err)
+		if e.Code == errEmailLinkRequired.Code {
+			e = e.withMessage("an account with this email exists, log in with your password and connect moodle in your settings")
+		}
+		respondError(w, e)
 		return
 	}
 
-	var responseData []map[string]interface{}
+	if !loginSecondFactor(w, r, user, loginData.Code, lockoutKey) {
+		return
+	}
+	loginSucceeded(lockoutKey)
 
-	// debugging
-	err = json.NewDecoder(idResp.Body).Decode(&responseData)
+	// the token changes with every login, the courses are fetched with the latest one
+	user, err = db.UpdateMoodleData(user, account.URL, account.Token, account.UserID, false)
 	if err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"error accessing moodle"},
-		}, 500)
+		logging.ErrorLogger.Printf("error updating user: %v\n", err)
+		respondError(w, errInternal)
 		return
 	}
 
-	idInterface, ok := responseData[0]["id"]
+	logIn(w, r, user)
+}
+
+type moodleLoginData struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	URL      string `json:"url"`
+	// Code is the two-factor code of users who enabled it
+	Code string `json:"code"`
+}
+
+// authenticateMoodle exchanges moodle credentials for a token of the mobile app and looks up the account. If that
+// fails, it returns the error to respond with and false.
+func authenticateMoodle(ctx context.Context, rawURL string, username string, password string) (moodleAccount, apiError, bool) {
+	moodleURL, ok := moodle.NormalizeURL(rawURL)
 	if !ok {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"error accessing moodle"},
-		}, 500)
-		logging.WarningLogger.Printf("error: no id returned. data: %+v", responseData)
-		return
+		return moodleAccount{}, errInvalidMoodleURL, false
 	}
 
-	id := int(idInterface.(float64))
-
-	updatedUser, err := db.UpdateMoodleData(user, loginData.URL, tokenResp.Token, id, false)
+	token, err := moodleClient.Token(ctx, moodleURL, username, password)
+	if err == moodle.ErrInvalidLogin {
+		return moodleAccount{}, errInvalidCredentials.withMessage("wrong moodle username or password"), false
+	}
 	if err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		logging.InfoLogger.Printf("error updating user: %v\n", err)
-		return
+		logging.WarningLogger.Printf("error getting moodle token: %v\n", err)
+		return moodleAccount{}, errMoodleUnavailable, false
+	}
+
+	user, err := moodleClient.UserByUsername(ctx, moodleURL, token, username)
+	if err != nil || user.ID <= 0 {
+		logging.WarningLogger.Printf("moodle returned no user id (%v)\n", err)
+		return moodleAccount{}, errMoodleBadData, false
 	}
-	_ = returnApiResponse(w, apiResponse{Content: updatedUser.GetClean()}, 200)
+
+	return moodleAccount{
+		URL:      moodleURL,
+		Token:    token,
+		UserID:   user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+	}, apiError{}, true
+}
+
+// moodleSubject identifies a moodle account in user_identities, moodle user ids are only unique per instance
+func moodleSubject(account moodleAccount) string {
+	return account.URL + "#" + strconv.Itoa(account.UserID)
 }
 
 func MoodleGetSchoolInfo(w http.ResponseWriter, r *http.Request) {
@@ -161,57 +201,87 @@ func MoodleGetSchoolInfo(w http.ResponseWriter, r *http.Request) {
 	var requestData requestStruct
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
 		logging.WarningLogger.Printf("invalid json: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"bad body"},
-		}, http.StatusBadRequest)
+		respondError(w, errBadRequest)
 		return
 	}
-	if _, err := url.Parse(requestData.Url); err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid url"},
-		}, http.StatusBadRequest)
+	moodleURL, ok := moodle.NormalizeURL(requestData.Url)
+	if !ok {
+		respondError(w, errInvalidMoodleURL)
 		return
 	}
 
-	requestURL := requestData.Url + "/lib/ajax/service-nologin.php?args=[{\"index\":0,\"methodname\":\"tool_mobile_get_public_config\",\"args\":[]}]"
-
-	resp, err := http.Get(requestURL)
+	publicConfig, err := moodleClient.PublicConfig(r.Context(), moodleURL)
 	if err != nil {
-		logging.WarningLogger.Printf("error accessing moodle: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid url"},
-		}, http.StatusBadRequest)
+		logging.WarningLogger.Printf("error getting moodle public config: %v\n", err)
+		respondError(w, errInvalidMoodleURL, errMoodleBadData)
 		return
 	}
 
-	if resp.StatusCode != 200 {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid url"},
-		}, http.StatusBadRequest)
+	_ = returnApiResponse(w, apiResponse{Content: publicConfig, Errors: []apiError{}}, http.StatusOK)
+}
+
+// moodleTokenCheckBatch is how many tokens are checked at once, so a big backlog doesn't hit moodle all at once
+const moodleTokenCheckBatch = 50
+
+// StartMoodleTokenChecks checks the moodle tokens of all users in the background, each one at most once per interval.
+// Users see the result as `moodle_status`. An interval of 0 disables the checks.
+func StartMoodleTokenChecks(cfg config.Moodle) {
+	if cfg.TokenCheckInterval <= 0 {
 		return
 	}
 
-	var moodleSiteData []map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&moodleSiteData); err != nil || len(moodleSiteData) == 0 {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid url", "moodle returned bad data"},
-		}, http.StatusBadRequest)
+	// tokens are checked in small batches spread over the interval instead of all at once
+	ticker := time.NewTicker(cfg.TokenCheckInterval / 24)
+	go func() {
+		for range ticker.C {
+			checkMoodleTokens(cfg.TokenCheckInterval)
+		}
+	}()
+}
+
+// checkMoodleTokens checks the tokens that weren't checked during the last interval
+func checkMoodleTokens(interval time.Duration) {
+	users, err := db.GetUsersToCheckMoodle(time.Now().Add(-interval), moodleTokenCheckBatch)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting moodle tokens to check: %v\n", err)
 		return
 	}
 
-	relevantData, ok := moodleSiteData[0]["data"]
-	if !ok {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid url", "moodle returned bad data"},
-		}, http.StatusBadRequest)
-		return
+	for _, user := range users {
+		status := checkMoodleToken(user)
+		if status == structs.MoodleExpired {
+			logging.InfoLogger.Printf("moodle rejected the token of %s\n", user.Username)
+		}
+
+		if err := db.SetMoodleStatus(user.ID.String(), status); err != nil {
+			logging.ErrorLogger.Printf("error updating moodle status: %v\n", err)
+		}
+	}
+}
+
+// checkMoodleToken asks moodle whether the token of the user still works and returns the moodle status of the user
+func checkMoodleToken(user structs.User) string {
+	info, err := moodleClient.SiteInfo(context.Background(), user.MoodleURL, user.MoodleToken)
+	switch {
+	case moodle.TokenRejected(err):
+		return structs.MoodleExpired
+	case err != nil:
+		logging.WarningLogger.Printf("error getting moodle site info: %v\n", err)
+		return structs.MoodleError
+	case info.UserID != user.MoodleUserID:
+		// the token belongs to someone else, it can't be used for this user
+		return structs.MoodleExpired
+	default:
+		return structs.MoodleConnected
 	}
+}
+
+// moodleClient sends the requests to moodle instances, see InitMoodle
+var moodleClient = moodle.NewClient(config.Default().Moodle.Timeout, nil)
 
-	_ = returnApiResponse(w, apiResponse{Content: relevantData}, 200)
+// InitMoodle sets up the client for requests to moodle instances, here and in db. A nil transport is
+// http.DefaultTransport, tests pass the one of their fake moodle instance.
+func InitMoodle(cfg config.Moodle, transport http.RoundTripper) {
+	moodleClient = moodle.NewClient(cfg.Timeout, transport)
+	db.SetMoodleClient(moodleClient)
 }
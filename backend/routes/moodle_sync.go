@@ -0,0 +1,206 @@
+package routes
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/moodle"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+)
+
+// moodleEventsLookback is how far back calendar events are fetched, so due dates of overdue assignments are found too
+const moodleEventsLookback = 30 * 24 * time.Hour
+
+// StartMoodleAssignmentSync imports the assignments of the moodle courses of all users and which of them they submitted
+// in the background, right away and then every interval. An interval of 0 disables the import.
+func StartMoodleAssignmentSync(cfg config.Moodle) {
+	if cfg.AssignmentSyncInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(cfg.AssignmentSyncInterval)
+	go func() {
+		syncMoodleAssignments()
+		for range ticker.C {
+			syncMoodleAssignments()
+		}
+	}()
+}
+
+// syncMoodleAssignments imports the assignments and submissions of all users whose token works
+func syncMoodleAssignments() {
+	users, err := db.GetMoodleUsers()
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting moodle users: %v\n", err)
+		return
+	}
+
+	// most courses have many students, each course is only imported once
+	synced := make(map[string]bool)
+	for _, user := range users {
+		if err := syncMoodleUser(context.Background(), user, synced); err != nil {
+			logging.WarningLogger.Printf("error importing the moodle assignments of %s: %v\n", user.Username, err)
+		}
+	}
+}
+
+// syncMoodleUser imports the assignments of the moodle courses of the user that aren't in synced yet, adds the
+// courses to synced and then marks the assignments the user submitted as done
+func syncMoodleUser(ctx context.Context, user structs.User, synced map[string]bool) error {
+	if user.MoodleURL == "" || user.MoodleToken == "" {
+		return nil
+	}
+
+	courses, err := moodleClient.UserCourses(ctx, user.MoodleURL, user.MoodleToken, user.MoodleUserID)
+	if err != nil {
+		moodleSyncFailed(user, err)
+		return err
+	}
+
+	if err := importMoodleAssignments(ctx, user, courses, synced); err != nil {
+		return err
+	}
+
+	return importMoodleSubmissions(ctx, user, courses)
+}
+
+// importMoodleAssignments imports the assignments of the courses that aren't in synced yet and adds them to synced.
+// Assignments are identified by their moodle id, so importing them again updates them.
+func importMoodleAssignments(ctx context.Context, user structs.User, courses []moodle.Course, synced map[string]bool) error {
+	var courseIDs []int
+	for _, course := range courses {
+		if !synced[moodleCourseKey(user.MoodleURL, course.ID)] {
+			courseIDs = append(courseIDs, course.ID)
+		}
+	}
+	if len(courseIDs) == 0 {
+		return nil
+	}
+
+	assignments, err := moodleClient.Assignments(ctx, user.MoodleURL, user.MoodleToken, courseIDs)
+	if err != nil {
+		moodleSyncFailed(user, err)
+		return err
+	}
+
+	dueDates := moodleEventDueDates(ctx, user, assignments)
+
+	now := time.Now()
+	for _, a := range assignments {
+		dueDate := a.DueDate
+		if dueDate == 0 {
+			dueDate = dueDates[a.ID]
+		}
+		// without a due date it isn't homework
+		if dueDate == 0 {
+			continue
+		}
+
+		_, _, err := db.UpsertMoodleAssignment(user.MoodleURL, a.ID, structs.Assignment{
+			User:    user,
+			Created: structs.UnixTime(now),
+			Title:   a.Name,
+			DueDate: structs.UnixTime(time.Unix(dueDate, 0).UTC()),
+			Course:  a.Course,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range courseIDs {
+		synced[moodleCourseKey(user.MoodleURL, id)] = true
+	}
+
+	return nil
+}
+
+// importMoodleSubmissions marks the imported assignments of the courses as done for the user if they submitted them on
+// moodle. Only assignments that were due during the last moodleEventsLookback and weren't submitted before are checked.
+func importMoodleSubmissions(ctx context.Context, user structs.User, courses []moodle.Course) error {
+	courseIDs := make([]int, 0, len(courses))
+	for _, course := range courses {
+		courseIDs = append(courseIDs, course.ID)
+	}
+
+	assignments, err := db.GetMoodleAssignmentsToCheck(user.ID.String(), user.MoodleURL, courseIDs, time.Now().Add(-moodleEventsLookback))
+	if err != nil {
+		return err
+	}
+
+	for id, moodleID := range assignments {
+		submission, err := moodleClient.SubmissionStatus(ctx, user.MoodleURL, user.MoodleToken, moodleID)
+		if err != nil {
+			if moodle.TokenRejected(err) {
+				moodleSyncFailed(user, err)
+				return err
+			}
+			// e.g. the assignment is hidden from the user, the others can still be checked
+			logging.WarningLogger.Printf("error getting the moodle submission of %s for %d: %v\n", user.Username, moodleID, err)
+			continue
+		}
+		if submission.Status != moodle.SubmissionSubmitted {
+			continue
+		}
+
+		submittedAt := time.Now()
+		if submission.TimeModified > 0 {
+			submittedAt = time.Unix(submission.TimeModified, 0).UTC()
+		}
+		if err := db.MoodleAssignmentSubmitted(id, user.ID.String(), submittedAt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moodleEventDueDates returns the due dates of the calendar events of assignments by assignment id. They are only
+// fetched if an assignment has no due date of its own. Errors are only logged, assignments with a due date are
+// imported anyway.
+func moodleEventDueDates(ctx context.Context, user structs.User, assignments []moodle.Assignment) map[int]int64 {
+	dueDates := make(map[int]int64)
+
+	missing := false
+	for _, a := range assignments {
+		missing = missing || a.DueDate == 0
+	}
+	if !missing {
+		return dueDates
+	}
+
+	events, err := moodleClient.ActionEvents(ctx, user.MoodleURL, user.MoodleToken, time.Now().Add(-moodleEventsLookback))
+	if err != nil {
+		logging.WarningLogger.Printf("error getting moodle calendar events: %v\n", err)
+		return dueDates
+	}
+
+	for _, e := range events {
+		if e.ModuleName == "assign" {
+			dueDates[e.Instance] = e.TimeSort
+		}
+	}
+
+	return dueDates
+}
+
+// moodleSyncFailed marks the token of the user as expired if moodle rejected it
+func moodleSyncFailed(user structs.User, err error) {
+	if !moodle.TokenRejected(err) {
+		return
+	}
+
+	logging.InfoLogger.Printf("moodle rejected the token of %s\n", user.Username)
+	if err := db.SetMoodleStatus(user.ID.String(), structs.MoodleExpired); err != nil {
+		logging.ErrorLogger.Printf("error updating moodle status: %v\n", err)
+	}
+}
+
+// moodleCourseKey identifies a moodle course, course ids are only unique per instance
+func moodleCourseKey(moodleURL string, courseID int) string {
+	return moodleURL + "#" + strconv.Itoa(courseID)
+}
@@ -0,0 +1,331 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/moodle"
+	"git.teich.3nt3.de/3nt3/homework/moodle/moodletest"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+)
+
+func TestMoodleLoginCreatesUser(t *testing.T) {
+	moodleURL := newTestMoodle(t, moodletest.User{ID: 7, Username: "moodle_new", Password: "moodle password", Email: "moodle_new@example.com"}).URL
+
+	result := moodleLogin(t, moodleURL, "moodle_new", "moodle password")
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("logging in with moodle returned status code %d, expected %d", result.StatusCode, http.StatusOK)
+	}
+
+	user, _, err := db.GetUserBySession(sessionCookieOf(t, result).Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if user.Username != "moodle_new" || user.MoodleURL != moodleURL || user.MoodleUserID != 7 || user.MoodleToken == "" {
+		t.Errorf("unexpected user created: %+v", user)
+	}
+
+	// the next login is the same user, even if the url is written differently
+	again, _, err := db.GetUserBySession(sessionCookieOf(t, moodleLogin(t, moodleURL+"/", "moodle_new", "moodle password")).Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if again.ID != user.ID {
+		t.Errorf("logging in again logged in as %s, expected %s", again.ID, user.ID)
+	}
+
+	if status := moodleLogin(t, moodleURL, "moodle_new", "wrong password").StatusCode; status != http.StatusUnauthorized {
+		t.Errorf("logging in with a wrong moodle password returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestMoodleLoginAfterConnecting(t *testing.T) {
+	moodleURL := newTestMoodle(t, moodletest.User{ID: 8, Username: "moodle_connect", Password: "moodle password", Email: "someone.else@example.com"}).URL
+
+	cookie := registerTestUser(t, "moodle_connect")
+	existing, _, err := db.GetUserBySession(cookie.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]string{"url": moodleURL, "username": "moodle_connect", "password": "moodle password"})
+	req, err := http.NewRequest("POST", "http://localhost:8000/moodle/authenticate", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+
+	Authenticated(MoodleAuthenticate)(rr, req)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("connecting moodle returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	user, _, err := db.GetUserBySession(sessionCookieOf(t, moodleLogin(t, moodleURL, "moodle_connect", "moodle password")).Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if user.ID != existing.ID {
+		t.Errorf("logging in with the connected moodle account logged in as %s, expected %s", user.ID, existing.ID)
+	}
+}
+
+func TestMoodleLoginWithTakenEmail(t *testing.T) {
+	registerTestUser(t, "moodle_taken")
+
+	moodleURL := newTestMoodle(t, moodletest.User{ID: 9, Username: "moodle_taken", Password: "moodle password", Email: "moodle_taken@example.com"}).URL
+
+	result := moodleLogin(t, moodleURL, "moodle_taken", "moodle password")
+	if result.StatusCode != http.StatusConflict {
+		t.Fatalf("logging in with the email of another account returned status code %d, expected %d", result.StatusCode, http.StatusConflict)
+	}
+
+	var resp apiResponse
+	if err := json.NewDecoder(result.Body).Decode(&resp); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Code != errEmailLinkRequired.Code {
+		t.Errorf("logging in with the email of another account returned errors %+v, expected %s", resp.Errors, errEmailLinkRequired.Code)
+	}
+}
+
+func TestMoodleStatusAndDisconnect(t *testing.T) {
+	server := newTestMoodle(t, moodletest.User{ID: 10, Username: "moodle_status", Password: "moodle password", Email: "moodle_status@example.com", Courses: []moodle.Course{{ID: 501, DisplayName: "Physics"}}})
+
+	cookie := sessionCookieOf(t, moodleLogin(t, server.URL, "moodle_status", "moodle password"))
+	user := userOfSession(t, cookie)
+
+	if status := checkMoodleToken(user); status != structs.MoodleConnected {
+		t.Errorf("checking a working token returned %q, expected %q", status, structs.MoodleConnected)
+	}
+
+	courses, err := db.GetMoodleUserCourses(user)
+	if err != nil || len(courses) != 1 || courses[0].ID != 501 {
+		t.Errorf("getting the moodle courses returned %+v, %v", courses, err)
+	}
+
+	server.RevokeTokens("moodle_status")
+	if status := checkMoodleToken(user); status != structs.MoodleExpired {
+		t.Errorf("checking a revoked token returned %q, expected %q", status, structs.MoodleExpired)
+	}
+
+	if err := db.SetMoodleStatus(user.ID.String(), structs.MoodleExpired); err != nil {
+		t.Fatalf("error setting moodle status: %v", err)
+	}
+	if status := userOfSession(t, cookie).GetClean().MoodleStatus; status != structs.MoodleExpired {
+		t.Errorf("moodle status is %q after the token was rejected, expected %q", status, structs.MoodleExpired)
+	}
+
+	// the user still works without moodle courses
+	if status := requestStatus(t, "GET", TwoFactorSetup(GetUser), cookie, nil, nil); status != http.StatusOK {
+		t.Errorf("getting the user with an expired token returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	if status := requestStatus(t, "DELETE", Authenticated(MoodleDisconnect), cookie, nil, nil); status != http.StatusOK {
+		t.Fatalf("disconnecting moodle returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	disconnected := userOfSession(t, cookie)
+	if disconnected.MoodleToken != "" || disconnected.MoodleURL != "" || disconnected.GetClean().MoodleStatus != structs.MoodleNotConnected {
+		t.Errorf("moodle is still connected after disconnecting: %+v", disconnected.GetClean())
+	}
+
+	if status := requestStatus(t, "DELETE", Authenticated(MoodleDisconnect), cookie, nil, nil); status != http.StatusConflict {
+		t.Errorf("disconnecting moodle again returned status code %d, expected %d", status, http.StatusConflict)
+	}
+}
+
+func TestMoodleAssignmentSync(t *testing.T) {
+	server := newTestMoodle(t, moodletest.User{ID: 11, Username: "moodle_sync", Password: "moodle password", Email: "moodle_sync@example.com", Courses: []moodle.Course{{ID: 601, DisplayName: "History"}}})
+
+	due := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	event := moodle.Event{ID: 1, ModuleName: "assign", Instance: 602, TimeSort: due.Add(time.Hour).Unix()}
+	event.Course.ID = 601
+	server.SetEvents(event)
+	server.SetAssignments(
+		moodle.Assignment{ID: 601, Course: 601, Name: "Essay", DueDate: due.Unix()},
+		moodle.Assignment{ID: 602, Course: 601, Name: "Timeline"},
+		moodle.Assignment{ID: 603, Course: 601, Name: "Reading"},
+	)
+
+	user := userOfSession(t, sessionCookieOf(t, moodleLogin(t, server.URL, "moodle_sync", "moodle password")))
+
+	if err := syncMoodleUser(context.Background(), user, make(map[string]bool)); err != nil {
+		t.Fatalf("error importing assignments: %v", err)
+	}
+
+	titles := moodleAssignmentTitles(t, server.URL, 601)
+	if len(titles) != 2 || !titles["Essay"].Equal(due) || !titles["Timeline"].Equal(due.Add(time.Hour)) {
+		t.Errorf("unexpected assignments imported: %v", titles)
+	}
+
+	// edits on moodle are imported, nothing is imported twice
+	server.SetAssignments(moodle.Assignment{ID: 601, Course: 601, Name: "Long essay", DueDate: due.Add(24 * time.Hour).Unix()})
+	if err := syncMoodleUser(context.Background(), user, make(map[string]bool)); err != nil {
+		t.Fatalf("error importing assignments again: %v", err)
+	}
+
+	titles = moodleAssignmentTitles(t, server.URL, 601)
+	if len(titles) != 2 || !titles["Long essay"].Equal(due.Add(24*time.Hour)) {
+		t.Errorf("unexpected assignments after importing again: %v", titles)
+	}
+
+	// a course that was imported in this run isn't imported again
+	server.SetAssignments(moodle.Assignment{ID: 601, Course: 601, Name: "Essay", DueDate: due.Unix()})
+	synced := map[string]bool{moodleCourseKey(server.URL, 601): true}
+	if err := syncMoodleUser(context.Background(), user, synced); err != nil {
+		t.Fatalf("error importing assignments: %v", err)
+	}
+	if _, ok := moodleAssignmentTitles(t, server.URL, 601)["Long essay"]; !ok {
+		t.Errorf("a course that was already imported was imported again")
+	}
+}
+
+func TestMoodleSubmissionSync(t *testing.T) {
+	server := newTestMoodle(t, moodletest.User{ID: 12, Username: "moodle_submission", Password: "moodle password", Email: "moodle_submission@example.com", Courses: []moodle.Course{{ID: 701, DisplayName: "Biology"}}})
+
+	due := time.Now().Add(48 * time.Hour).Unix()
+	server.SetAssignments(
+		moodle.Assignment{ID: 701, Course: 701, Name: "Lab report", DueDate: due},
+		moodle.Assignment{ID: 702, Course: 701, Name: "Poster", DueDate: due},
+	)
+	submittedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	server.SetSubmission("moodle_submission", 701, moodle.Submission{Status: moodle.SubmissionSubmitted, TimeModified: submittedAt.Unix()})
+	server.SetSubmission("moodle_submission", 702, moodle.Submission{Status: "draft"})
+
+	user := userOfSession(t, sessionCookieOf(t, moodleLogin(t, server.URL, "moodle_submission", "moodle password")))
+	if err := syncMoodleUser(context.Background(), user, make(map[string]bool)); err != nil {
+		t.Fatalf("error importing assignments: %v", err)
+	}
+
+	assignments := moodleAssignmentsByTitle(t, server.URL, 701)
+	report, poster := assignments["Lab report"], assignments["Poster"]
+	if len(report.DoneBy) != 1 || len(report.AutoDoneBy) != 1 || report.AutoDoneBy[0] != user.ID.String() || !report.DoneAt[user.ID.String()].Time().Equal(submittedAt) {
+		t.Errorf("the submitted assignment wasn't marked as done automatically: %+v", report.GetClean())
+	}
+	if len(poster.DoneBy) != 0 {
+		t.Errorf("the assignment that wasn't submitted was marked as done: %+v", poster.GetClean())
+	}
+
+	// marking it as not done sticks, the submission was imported already
+	if err := db.AssignmentDone(report.UID.String(), user.ID.String(), false); err != nil {
+		t.Fatalf("error marking assignment as not done: %v", err)
+	}
+	server.SetSubmission("moodle_submission", 702, moodle.Submission{Status: moodle.SubmissionSubmitted})
+	if err := syncMoodleUser(context.Background(), user, make(map[string]bool)); err != nil {
+		t.Fatalf("error importing assignments again: %v", err)
+	}
+
+	assignments = moodleAssignmentsByTitle(t, server.URL, 701)
+	if len(assignments["Lab report"].DoneBy) != 0 {
+		t.Errorf("an assignment marked as not done was marked as done again")
+	}
+	if len(assignments["Poster"].AutoDoneBy) != 1 {
+		t.Errorf("the assignment submitted since the last import wasn't marked as done")
+	}
+}
+
+func TestMoodleAssignmentsOfTwoInstances(t *testing.T) {
+	due := time.Now().Add(48 * time.Hour).Unix()
+
+	server := newTestMoodle(t, moodletest.User{ID: 13, Username: "moodle_first", Password: "moodle password", Email: "moodle_first@example.com", Courses: []moodle.Course{{ID: 801, DisplayName: "Physics"}}})
+	server.SetAssignments(moodle.Assignment{ID: 801, Course: 801, Name: "Pendulum", DueDate: due})
+
+	// the other instance has a course and an assignment with the same ids. Its certificate is the same, so the
+	// transport of the first instance trusts it too.
+	otherServer := moodletest.NewServer(moodletest.User{ID: 13, Username: "moodle_second", Password: "moodle password", Email: "moodle_second@example.com", Courses: []moodle.Course{{ID: 801, DisplayName: "Art"}}})
+	t.Cleanup(otherServer.Close)
+	otherServer.SetAssignments(moodle.Assignment{ID: 801, Course: 801, Name: "Still life", DueDate: due})
+
+	firstCookie := sessionCookieOf(t, moodleLogin(t, server.URL, "moodle_first", "moodle password"))
+	secondCookie := sessionCookieOf(t, moodleLogin(t, otherServer.URL, "moodle_second", "moodle password"))
+	synced := make(map[string]bool)
+	for _, cookie := range []*http.Cookie{firstCookie, secondCookie} {
+		if err := syncMoodleUser(context.Background(), userOfSession(t, cookie), synced); err != nil {
+			t.Fatalf("error importing assignments: %v", err)
+		}
+	}
+
+	first, second := moodleAssignmentsByTitle(t, server.URL, 801), moodleAssignmentsByTitle(t, otherServer.URL, 801)
+	if len(first) != 1 || first["Pendulum"].UID.IsNil() {
+		t.Errorf("unexpected assignments of the first instance: %v", first)
+	}
+	if len(second) != 1 || second["Still life"].UID.IsNil() {
+		t.Errorf("unexpected assignments of the second instance: %v", second)
+	}
+
+	courses, err := db.GetMoodleUserCourses(userOfSession(t, firstCookie))
+	if err != nil || len(courses) != 1 || len(courses[0].Assignments) != 1 || courses[0].Assignments[0].Title != "Pendulum" {
+		t.Errorf("getting the courses of the first instance returned %+v, %v", courses, err)
+	}
+
+	if status := getAssignmentStatus(t, firstCookie, second["Still life"].UID.String()); status != http.StatusForbidden {
+		t.Errorf("getting an assignment of another moodle instance returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+	if status := getAssignmentStatus(t, firstCookie, first["Pendulum"].UID.String()); status != http.StatusOK {
+		t.Errorf("getting an assignment of the own moodle instance returned status code %d, expected %d", status, http.StatusOK)
+	}
+}
+
+// moodleAssignmentsByTitle returns the assignments imported from the moodle instance into the course by title
+func moodleAssignmentsByTitle(t *testing.T, moodleURL string, courseID int) map[string]structs.Assignment {
+	assignments, err := db.GetAssignmentsByCourse(moodleURL, courseID)
+	if err != nil {
+		t.Fatalf("error getting assignments: %v", err)
+	}
+
+	byTitle := make(map[string]structs.Assignment)
+	for _, a := range assignments {
+		if a.FromMoodle {
+			byTitle[a.Title] = a
+		}
+	}
+
+	return byTitle
+}
+
+// moodleAssignmentTitles returns the due dates of the assignments imported from the moodle instance into the course by
+// title
+func moodleAssignmentTitles(t *testing.T, moodleURL string, courseID int) map[string]time.Time {
+	titles := make(map[string]time.Time)
+	for title, a := range moodleAssignmentsByTitle(t, moodleURL, courseID) {
+		titles[title] = a.DueDate.Time()
+	}
+
+	return titles
+}
+
+// newTestMoodle starts a fake moodle instance with the users. Requests to moodle go to it until the test is done.
+func newTestMoodle(t *testing.T, users ...moodletest.User) *moodletest.Server {
+	server := moodletest.NewServer(users...)
+	InitMoodle(config.Get().Moodle, server.Transport())
+	t.Cleanup(func() {
+		InitMoodle(config.Get().Moodle, nil)
+		server.Close()
+	})
+
+	return server
+}
+
+// moodleLogin logs in with the moodle credentials and returns the response
+func moodleLogin(t *testing.T, moodleURL string, username string, password string) *http.Response {
+	body, _ := json.Marshal(map[string]string{"url": moodleURL, "username": username, "password": password})
+
+	req, err := http.NewRequest("POST", "http://localhost:8000/moodle/login", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	rr := httptest.NewRecorder()
+
+	MoodleLogin(rr, req)
+
+	return rr.Result()
+}
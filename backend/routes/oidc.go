@@ -0,0 +1,380 @@
+package routes
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/oidc"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+)
+
+// loginStateCookieName is the cookie that ties a login at an identity provider to the browser that started it, so
+// nobody can make someone else finish a login they started
+const loginStateCookieName = "hw_oidc_state"
+
+// usernames created for identity provider logins are cut to this length. If one is taken, a number is appended, up
+// to maxUsernameAttempts.
+const (
+	maxGeneratedUsernameLength = 32
+	maxUsernameAttempts        = 10
+)
+
+// where the frontend is sent to after a login at an identity provider
+const (
+	loginPage    = "/login"
+	settingsPage = "/settings"
+)
+
+var (
+	// oidcProviders are the configured identity providers by name
+	oidcProviders = make(map[string]*oidc.Provider)
+	// oidcProviderList are the same providers in the order they were configured
+	oidcProviderList []*oidc.Provider
+	// loginStateLifetime is how long a login at an identity provider may take
+	loginStateLifetime = config.DefaultOIDC().StateLifetime
+)
+
+// InitOIDC sets up the configured identity providers. Nothing is requested from them until the first login.
+func InitOIDC(cfg config.OIDC) {
+	client := &http.Client{Timeout: cfg.Timeout}
+	base := strings.TrimSuffix(cfg.RedirectBaseURL, "/")
+
+	oidcProviders = make(map[string]*oidc.Provider)
+	oidcProviderList = nil
+	for _, p := range cfg.Providers {
+		provider := oidc.NewProvider(p, base+"/auth/oidc/"+p.Name+"/callback", client)
+		oidcProviders[p.Name] = provider
+		oidcProviderList = append(oidcProviderList, provider)
+	}
+
+	loginStateLifetime = cfg.StateLifetime
+}
+
+// GetIdentityProviders returns the `name` and `display_name` of every identity provider users can log in with
+func GetIdentityProviders(w http.ResponseWriter, r *http.Request) {
+	type providerInfo struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+	}
+
+	providers := make([]providerInfo, 0, len(oidcProviderList))
+	for _, p := range oidcProviderList {
+		providers = append(providers, providerInfo{Name: p.Name, DisplayName: p.DisplayName})
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: providers, Errors: []apiError{}}, http.StatusOK)
+}
+
+// OIDCLogin redirects the browser to the identity provider to log in. It comes back to OIDCCallback.
+func OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		respondError(w, errProviderNotFound)
+		return
+	}
+
+	authURL, ok := startOIDCLogin(w, r, provider, "")
+	if !ok {
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// LinkIdentity starts connecting an account at the identity provider to the current user. The frontend has to send the
+// browser to the returned `url`, the provider redirects back to OIDCCallback.
+func LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	provider, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		respondError(w, errProviderNotFound)
+		return
+	}
+
+	authURL, ok := startOIDCLogin(w, r, provider, user.ID.String())
+	if !ok {
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: map[string]string{"url": authURL}, Errors: []apiError{}}, http.StatusOK)
+}
+
+// OIDCCallback is where identity providers redirect back to. The identity is linked to the user who started the login
+// with LinkIdentity, or the user it belongs to is logged in. If there is none, the identity is linked to the account
+// with the same email address (only for providers with link_by_email) or a new account is created.
+//
+// The browser is always redirected to the frontend, errors are passed as ?error=<code>.
+func OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		respondError(w, errProviderNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	state := query.Get("state")
+
+	cookie, err := r.Cookie(loginStateCookieName)
+	clearLoginStateCookie(w)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		redirectToFrontend(w, r, loginPage, url.Values{"error": {errInvalidLoginState.Code}})
+		return
+	}
+
+	login, err := db.UseOIDCLogin(state, provider.Name)
+	if err != nil {
+		if err != db.ErrInvalidToken {
+			logging.ErrorLogger.Printf("error getting oidc login: %v\n", err)
+		}
+		redirectToFrontend(w, r, loginPage, url.Values{"error": {errInvalidLoginState.Code}})
+		return
+	}
+
+	page := loginPage
+	if login.UserID != "" {
+		page = settingsPage
+	}
+
+	if query.Get("error") != "" {
+		logging.InfoLogger.Printf("login at %s failed: %s %s\n", provider.Name, query.Get("error"), query.Get("error_description"))
+		redirectToFrontend(w, r, page, url.Values{"error": {errLoginCancelled.Code}})
+		return
+	}
+
+	identity, err := provider.Exchange(r.Context(), query.Get("code"), oidc.Login{State: state, Nonce: login.Nonce, Verifier: login.Verifier})
+	if err != nil {
+		logging.ErrorLogger.Printf("error exchanging code of %s: %v\n", provider.Name, err)
+		redirectToFrontend(w, r, page, url.Values{"error": {errProviderUnavailable.Code}})
+		return
+	}
+
+	if login.UserID != "" {
+		userID, err := ksuid.Parse(login.UserID)
+		if err == nil {
+			_, err = db.LinkIdentity(structs.Identity{Provider: provider.Name, Subject: identity.Subject, UserID: userID, Email: identity.Email})
+		}
+		if err != nil {
+			redirectToFrontend(w, r, page, url.Values{"error": {identityError(err).Code}})
+			return
+		}
+
+		redirectToFrontend(w, r, page, url.Values{"linked": {provider.Name}})
+		return
+	}
+
+	user, err := db.GetUserByIdentity(provider.Name, identity.Subject)
+	if err == db.ErrNotFound {
+		if identity.Email == "" {
+			redirectToFrontend(w, r, page, url.Values{"error": {errEmailRequired.Code}})
+			return
+		}
+
+		user, err = signUpWithIdentity(provider, identity)
+	}
+	if err != nil {
+		redirectToFrontend(w, r, page, url.Values{"error": {identityError(err).Code}})
+		return
+	}
+
+	// the frontend asks for the code and finishes the login with the token
+	status, err := db.GetTwoFactorStatus(user)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting two-factor status: %v\n", err)
+		redirectToFrontend(w, r, page, url.Values{"error": {errInternal.Code}})
+		return
+	}
+	if status.Enabled {
+		token, err := db.NewUserToken(user.ID.String(), db.TokenPurposeTwoFactor, twoFactorTokenLifetime)
+		if err != nil {
+			logging.ErrorLogger.Printf("error creating two-factor token: %v\n", err)
+			redirectToFrontend(w, r, page, url.Values{"error": {errInternal.Code}})
+			return
+		}
+
+		redirectToFrontend(w, r, page, url.Values{"two_factor_token": {token}})
+		return
+	}
+
+	session, err := db.NewSession(user, r.UserAgent(), clientIP(r))
+	if err != nil {
+		logging.ErrorLogger.Printf("error creating new session: %v\n", err)
+		redirectToFrontend(w, r, page, url.Values{"error": {errInternal.Code}})
+		return
+	}
+
+	setSessionCookie(w, session)
+	redirectToFrontend(w, r, "/", nil)
+}
+
+// GetIdentities returns the accounts at identity providers the user connected (`provider`, `email`, `created`)
+func GetIdentities(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	identities, err := db.GetIdentities(user.ID.String())
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting identities: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: identities, Errors: []apiError{}}, http.StatusOK)
+}
+
+// UnlinkIdentity disconnects the user's account at the identity provider. Users without a password can't disconnect
+// their only account.
+func UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	if err := db.UnlinkIdentity(user.ID.String(), mux.Vars(r)["provider"]); err != nil {
+		switch err {
+		case db.ErrNotFound:
+			respondError(w, errIdentityNotFound)
+		case db.ErrLastLoginMethod:
+			respondError(w, errLastLoginMethod)
+		default:
+			logging.ErrorLogger.Printf("error unlinking identity: %v\n", err)
+			respondError(w, errInternal)
+		}
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// startOIDCLogin stores a new login for the user (empty if nobody is logged in yet), sets the state cookie and returns
+// the url of the provider. If that fails, it responds with an error and returns false.
+func startOIDCLogin(w http.ResponseWriter, r *http.Request, provider *oidc.Provider, userID string) (string, bool) {
+	login, err := oidc.NewLogin()
+	if err != nil {
+		logging.ErrorLogger.Printf("error creating oidc login: %v\n", err)
+		respondError(w, errInternal)
+		return "", false
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), login)
+	if err != nil {
+		logging.ErrorLogger.Printf("error starting login at %s: %v\n", provider.Name, err)
+		respondError(w, errProviderUnavailable)
+		return "", false
+	}
+
+	err = db.NewOIDCLogin(login.State, db.OIDCLogin{Provider: provider.Name, Nonce: login.Nonce, Verifier: login.Verifier, UserID: userID}, loginStateLifetime)
+	if err != nil {
+		logging.ErrorLogger.Printf("error storing oidc login: %v\n", err)
+		respondError(w, errInternal)
+		return "", false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginStateCookieName,
+		Value:    login.State,
+		MaxAge:   int(loginStateLifetime.Seconds()),
+		Path:     "/auth/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+
+	return authURL, true
+}
+
+// signUpWithIdentity links the identity to the account with the same email address if the provider may do that, or
+// creates a new account for it
+func signUpWithIdentity(provider *oidc.Provider, identity oidc.Identity) (structs.User, error) {
+	if provider.LinkByEmail && identity.EmailVerified {
+		user, err := db.GetUserByEmail(identity.Email, false)
+		if err == nil {
+			_, err = db.LinkIdentity(structs.Identity{Provider: provider.Name, Subject: identity.Subject, UserID: user.ID, Email: identity.Email})
+			return user, err
+		}
+		if err != db.ErrNotFound {
+			return structs.User{}, err
+		}
+	}
+
+	username := identity.PreferredUsername
+	if strings.TrimSpace(username) == "" {
+		username = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+
+	return newUserWithIdentity(username, identity.Email, identity.EmailVerified, structs.Identity{Provider: provider.Name, Subject: identity.Subject, Email: identity.Email})
+}
+
+// newUserWithIdentity creates an account without a password for the identity. If the username is taken, a number is
+// appended to it.
+func newUserWithIdentity(username string, email string, emailVerified bool, identity structs.Identity) (structs.User, error) {
+	base := generatedUsername(username)
+	username = base
+	for attempt := 2; ; attempt++ {
+		user, err := db.NewUserWithIdentity(username, email, emailVerified, identity)
+		if err != db.ErrUsernameTaken || attempt > maxUsernameAttempts {
+			return user, err
+		}
+
+		username = base + strconv.Itoa(attempt)
+	}
+}
+
+// generatedUsername cleans up a username suggested by an identity provider
+func generatedUsername(suggested string) string {
+	username := strings.TrimSpace(suggested)
+	if username == "" {
+		username = "user"
+	}
+
+	if utf8.RuneCountInString(username) > maxGeneratedUsernameLength {
+		username = string([]rune(username)[:maxGeneratedUsernameLength])
+	}
+
+	return username
+}
+
+// identityError is the error passed to the frontend if linking or creating an account for an identity failed
+func identityError(err error) apiError {
+	switch err {
+	case db.ErrEmailTaken:
+		return errEmailLinkRequired
+	case db.ErrUsernameTaken:
+		return errUsernameTaken
+	case db.ErrIdentityTaken:
+		return errIdentityTaken
+	case db.ErrProviderLinked:
+		return errProviderLinked
+	}
+
+	logging.ErrorLogger.Printf("error logging in with identity: %v\n", err)
+	return errInternal
+}
+
+// redirectToFrontend sends the browser to path in the frontend
+func redirectToFrontend(w http.ResponseWriter, r *http.Request, path string, query url.Values) {
+	target := strings.TrimSuffix(config.Get().Server.FrontendURL, "/") + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// clearLoginStateCookie deletes the state cookie, every login can only be finished once
+func clearLoginStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginStateCookieName,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/auth/oidc",
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+}
@@ -0,0 +1,257 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/oidc/oidctest"
+	"github.com/gorilla/mux"
+)
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	server := newTestIdentityProvider(t, false)
+	server.SetIdentity(oidctest.Identity{Subject: "new", Email: "oidc_new@example.com", EmailVerified: true, PreferredUsername: "oidc_new"})
+
+	result := finishOIDCLogin(t, server, nil)
+	if location := redirectLocation(t, result); location.Path != "/" || location.Query().Get("error") != "" {
+		t.Fatalf("logging in redirected to %s, expected the frontend", location)
+	}
+
+	cookie := sessionCookieOf(t, result)
+	user, _, err := db.GetUserBySession(cookie.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if user.Username != "oidc_new" || user.Email != "oidc_new@example.com" || !user.EmailVerified {
+		t.Errorf("unexpected user created: %+v", user)
+	}
+
+	// the next login is the same user
+	again, _, err := db.GetUserBySession(sessionCookieOf(t, finishOIDCLogin(t, server, nil)).Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if again.ID != user.ID {
+		t.Errorf("logging in again logged in as %s, expected %s", again.ID, user.ID)
+	}
+
+	// there is no password to log in with, so the only identity can't be removed
+	if status := requestStatus(t, "DELETE", Authenticated(UnlinkIdentity), cookie, map[string]string{"provider": "test"}, nil); status != http.StatusConflict {
+		t.Errorf("unlinking the only way to log in returned status code %d, expected %d", status, http.StatusConflict)
+	}
+}
+
+func TestOIDCLoginWithTakenEmail(t *testing.T) {
+	cookie := registerTestUser(t, "oidc_taken")
+	existing, _, err := db.GetUserBySession(cookie.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+
+	server := newTestIdentityProvider(t, false)
+	server.SetIdentity(oidctest.Identity{Subject: "taken", Email: "oidc_taken@example.com", EmailVerified: true, PreferredUsername: "oidc_taken"})
+
+	location := redirectLocation(t, finishOIDCLogin(t, server, nil))
+	if location.Path != loginPage || location.Query().Get("error") != errEmailLinkRequired.Code {
+		t.Errorf("logging in with the email of another account redirected to %s, expected the error %s", location, errEmailLinkRequired.Code)
+	}
+
+	// providers that are trusted to verify addresses log in to the account with the address
+	server = newTestIdentityProvider(t, true)
+	server.SetIdentity(oidctest.Identity{Subject: "taken", Email: "oidc_taken@example.com", EmailVerified: true, PreferredUsername: "oidc_taken"})
+
+	user, _, err := db.GetUserBySession(sessionCookieOf(t, finishOIDCLogin(t, server, nil)).Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if user.ID != existing.ID {
+		t.Errorf("logging in with a verified email logged in as %s, expected %s", user.ID, existing.ID)
+	}
+}
+
+func TestOIDCLinkIdentity(t *testing.T) {
+	cookie := registerTestUser(t, "oidc_link")
+	existing, _, err := db.GetUserBySession(cookie.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+
+	server := newTestIdentityProvider(t, false)
+	server.SetIdentity(oidctest.Identity{Subject: "link", Email: "someone.else@example.com", PreferredUsername: "link"})
+
+	location := redirectLocation(t, finishOIDCLogin(t, server, cookie))
+	if location.Path != settingsPage || location.Query().Get("linked") != "test" {
+		t.Fatalf("linking redirected to %s, expected the settings", location)
+	}
+
+	identities, err := db.GetIdentities(existing.ID.String())
+	if err != nil {
+		t.Fatalf("error getting identities: %v", err)
+	}
+	if len(identities) != 1 || identities[0].Provider != "test" || identities[0].Email != "someone.else@example.com" {
+		t.Errorf("unexpected identities after linking: %+v", identities)
+	}
+
+	user, _, err := db.GetUserBySession(sessionCookieOf(t, finishOIDCLogin(t, server, nil)).Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if user.ID != existing.ID {
+		t.Errorf("logging in with the linked identity logged in as %s, expected %s", user.ID, existing.ID)
+	}
+
+	// another user can't link the same account
+	other := registerTestUser(t, "oidc_link_other")
+	location = redirectLocation(t, finishOIDCLogin(t, server, other))
+	if location.Query().Get("error") != errIdentityTaken.Code {
+		t.Errorf("linking an account linked to another user redirected to %s, expected the error %s", location, errIdentityTaken.Code)
+	}
+
+	if status := requestStatus(t, "DELETE", Authenticated(UnlinkIdentity), cookie, map[string]string{"provider": "test"}, nil); status != http.StatusOK {
+		t.Errorf("unlinking returned status code %d, expected %d", status, http.StatusOK)
+	}
+	if status := requestStatus(t, "DELETE", Authenticated(UnlinkIdentity), cookie, map[string]string{"provider": "test"}, nil); status != http.StatusNotFound {
+		t.Errorf("unlinking twice returned status code %d, expected %d", status, http.StatusNotFound)
+	}
+}
+
+func TestOIDCCallbackWithoutStateCookie(t *testing.T) {
+	server := newTestIdentityProvider(t, false)
+
+	authURL, _ := startTestOIDCLogin(t, nil)
+	callback, err := server.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("error authorizing: %v", err)
+	}
+
+	// e.g. a link to the callback someone else was sent
+	location := redirectLocation(t, oidcCallback(t, callback, nil))
+	if location.Query().Get("error") != errInvalidLoginState.Code {
+		t.Errorf("finishing a login without the state cookie redirected to %s, expected the error %s", location, errInvalidLoginState.Code)
+	}
+}
+
+// newTestIdentityProvider starts a fake identity provider and configures it as "test"
+func newTestIdentityProvider(t *testing.T, linkByEmail bool) *oidctest.Server {
+	server := oidctest.NewServer()
+	t.Cleanup(server.Close)
+
+	cfg := config.DefaultOIDC()
+	cfg.Providers = []config.OIDCProvider{{
+		Name:         "test",
+		Issuer:       server.Issuer(),
+		ClientID:     server.ClientID,
+		ClientSecret: server.ClientSecret,
+		LinkByEmail:  linkByEmail,
+	}}
+	InitOIDC(cfg)
+	t.Cleanup(func() { InitOIDC(config.DefaultOIDC()) })
+
+	return server
+}
+
+// finishOIDCLogin logs in at the provider, or links the account to the user the cookie belongs to if it isn't nil, and
+// returns the response of the callback
+func finishOIDCLogin(t *testing.T, server *oidctest.Server, cookie *http.Cookie) *http.Response {
+	authURL, stateCookie := startTestOIDCLogin(t, cookie)
+
+	callback, err := server.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("error authorizing: %v", err)
+	}
+
+	return oidcCallback(t, callback, stateCookie)
+}
+
+// startTestOIDCLogin starts a login, or links an account if cookie isn't nil, and returns the url of the provider and
+// the state cookie
+func startTestOIDCLogin(t *testing.T, cookie *http.Cookie) (string, *http.Cookie) {
+	method, handler := "GET", OIDCLogin
+	if cookie != nil {
+		method, handler = "POST", Authenticated(LinkIdentity)
+	}
+
+	req, err := http.NewRequest(method, "http://localhost:8000/auth/oidc/test/login", nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	req = mux.SetURLVars(req, map[string]string{"provider": "test"})
+	rr := httptest.NewRecorder()
+
+	handler(rr, req)
+
+	result := rr.Result()
+
+	var authURL string
+	if cookie != nil {
+		var resp struct {
+			Content struct {
+				URL string `json:"url"`
+			} `json:"content"`
+		}
+		if err := json.NewDecoder(result.Body).Decode(&resp); err != nil {
+			t.Fatalf("error decoding body: %v", err)
+		}
+		authURL = resp.Content.URL
+	} else {
+		authURL = redirectLocation(t, result).String()
+	}
+
+	for _, c := range result.Cookies() {
+		if c.Name == loginStateCookieName {
+			return authURL, c
+		}
+	}
+
+	t.Fatalf("starting a login didn't set the state cookie")
+	return "", nil
+}
+
+// oidcCallback requests the callback the provider redirected to
+func oidcCallback(t *testing.T, callback *url.URL, stateCookie *http.Cookie) *http.Response {
+	req, err := http.NewRequest("GET", callback.String(), nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	if stateCookie != nil {
+		req.AddCookie(stateCookie)
+	}
+	req = mux.SetURLVars(req, map[string]string{"provider": "test"})
+	rr := httptest.NewRecorder()
+
+	OIDCCallback(rr, req)
+
+	return rr.Result()
+}
+
+func redirectLocation(t *testing.T, result *http.Response) *url.URL {
+	if result.StatusCode != http.StatusFound {
+		t.Fatalf("expected a redirect, got status code %d", result.StatusCode)
+	}
+
+	location, err := result.Location()
+	if err != nil {
+		t.Fatalf("error getting redirect location: %v", err)
+	}
+
+	return location
+}
+
+func sessionCookieOf(t *testing.T, result *http.Response) *http.Cookie {
+	for _, c := range result.Cookies() {
+		if c.Name == sessionCookieName && c.Value != "" {
+			return c
+		}
+	}
+
+	t.Fatalf("no session cookie was set")
+	return nil
+}
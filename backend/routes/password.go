@@ -0,0 +1,199 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/mail"
+)
+
+const minPasswordLength = 8
+
+// bcrypt ignores everything after the first 72 bytes
+const maxPasswordBytes = 72
+
+// checkPassword returns what is wrong with a new password or an empty string if it may be used
+func checkPassword(password string, username string, email string) string {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return "password has to be at least 8 characters long"
+	}
+
+	if len(password) > maxPasswordBytes {
+		return "password is too long"
+	}
+
+	if strings.EqualFold(password, username) || strings.EqualFold(password, email) {
+		return "password must not be your username or email"
+	}
+
+	return ""
+}
+
+// ChangePassword sets a new password for the user. The current password is required unless the account doesn't have
+// one yet. Accounts that have to reset their password have to use PasswordReset, their sessions can't be trusted. All
+// other sessions of the user are logged out.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	type passwordData struct {
+		CurrentPassword string `json:"current_password"`
+		Password        string `json:"password"`
+	}
+
+	var data passwordData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	if user.PasswordResetRequired {
+		respondError(w, errPasswordResetRequired)
+		return
+	}
+
+	// users who signed up with an identity provider don't have a current password
+	if user.PasswordHash != "" {
+		_, correct, err := db.Authenticate(user.Username, data.CurrentPassword)
+		if err != nil {
+			logging.ErrorLogger.Printf("error authenticating: %v\n", err)
+			respondError(w, errInternal)
+			return
+		}
+
+		if !correct {
+			respondError(w, errWrongPassword)
+			return
+		}
+	}
+
+	if problem := checkPassword(data.Password, user.Username, user.Email); problem != "" {
+		respondError(w, errWeakPassword.withMessage(problem))
+		return
+	}
+
+	if err := db.SetPassword(user.ID.String(), data.Password); err != nil {
+		logging.ErrorLogger.Printf("error setting password: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if _, err := db.DeleteOtherSessions(user.ID.String(), sessionIDFromRequest(r)); err != nil {
+		logging.ErrorLogger.Printf("error deleting other sessions after changing password: %v\n", err)
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// PasswordReset either sends a mail with a link to reset the password to `email` or, if `token` is set, sets
+// `password` as the new password of the user the token was sent to. All sessions of the user are logged out.
+func PasswordReset(w http.ResponseWriter, r *http.Request) {
+	type resetData struct {
+		Email    string `json:"email"`
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	var data resetData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	if data.Token == "" {
+		requestPasswordReset(w, data.Email)
+		return
+	}
+
+	// the token is only used up once the new password is known to be acceptable
+	userID, err := db.CheckUserToken(data.Token, db.TokenPurposeResetPassword)
+	if err != nil {
+		respondTokenError(w, err)
+		return
+	}
+
+	user, err := db.GetUserById(userID, false)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting user: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if problem := checkPassword(data.Password, user.Username, user.Email); problem != "" {
+		respondError(w, errWeakPassword.withMessage(problem))
+		return
+	}
+
+	if _, err := db.UseUserToken(data.Token, db.TokenPurposeResetPassword); err != nil {
+		respondTokenError(w, err)
+		return
+	}
+
+	if err := db.SetPassword(userID, data.Password); err != nil {
+		logging.ErrorLogger.Printf("error setting password: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	// the reset link was sent to the address, so it obviously works
+	if err := db.SetEmailVerified(userID); err != nil {
+		logging.ErrorLogger.Printf("error verifying email after password reset: %v\n", err)
+	}
+
+	if err := db.DeleteUserSessions(userID); err != nil {
+		logging.ErrorLogger.Printf("error deleting sessions after password reset: %v\n", err)
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// requestPasswordReset sends a reset link to the user with the email address. Whether there is such a user is not
+// revealed.
+func requestPasswordReset(w http.ResponseWriter, email string) {
+	if email == "" {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	user, err := db.GetUserByEmail(email, false)
+	if err != nil {
+		if err == db.ErrNotFound {
+			_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error getting user by email: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	token, err := db.NewUserToken(user.ID.String(), db.TokenPurposeResetPassword, config.Get().Mail.ResetPasswordTokenLifetime)
+	if err != nil {
+		logging.ErrorLogger.Printf("error creating password reset token: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if err := mail.ResetPasswordMail(user, token); err != nil {
+		logging.ErrorLogger.Printf("error sending password reset mail: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// respondTokenError answers with 400 for invalid tokens and 500 for everything else
+func respondTokenError(w http.ResponseWriter, err error) {
+	if err == db.ErrInvalidToken {
+		respondError(w, errInvalidToken)
+		return
+	}
+
+	logging.ErrorLogger.Printf("error checking token: %v\n", err)
+	respondError(w, errInternal)
+}
@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/gorilla/mux"
+)
+
+// requirePermission checks that the user's role grants the permission and responds with 403 if not. It returns true if
+// the request may continue.
+func requirePermission(w http.ResponseWriter, user structs.User, permission string) bool {
+	allowed, err := db.HasPermission(user, permission)
+	if err != nil {
+		logging.ErrorLogger.Printf("error checking permission: %v\n", err)
+		respondError(w, errInternal)
+		return false
+	}
+
+	if !allowed {
+		respondError(w, errPermissionDenied)
+		return false
+	}
+
+	return true
+}
+
+// GetRoles returns all roles and their permissions
+func GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := db.GetRoles()
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting roles: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: roles, Errors: []apiError{}}, http.StatusOK)
+}
+
+// SetUserRole promotes or demotes a user. The change is recorded in the audit trail together with who made it and why.
+func SetUserRole(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	targetID := mux.Vars(r)["id"]
+	if targetID == user.ID.String() {
+		respondError(w, errOwnRole)
+		return
+	}
+
+	type roleData struct {
+		Role   string `json:"role"`
+		Reason string `json:"reason"`
+	}
+
+	var data roleData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Role == "" {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	change, err := db.SetUserRole(targetID, data.Role, user.ID.String(), strings.TrimSpace(data.Reason))
+	if err != nil {
+		switch err {
+		case db.ErrNotFound:
+			respondError(w, errUserNotFound)
+		case db.ErrUnknownRole:
+			respondError(w, errUnknownRole)
+		case db.ErrLastAdmin:
+			respondError(w, errLastAdmin)
+		default:
+			logging.ErrorLogger.Printf("error setting user role: %v\n", err)
+			respondError(w, errInternal)
+		}
+		return
+	}
+
+	logging.InfoLogger.Printf("%s changed the role of %s from %s to %s\n", user.Username, targetID, change.OldRole, change.NewRole)
+
+	_ = returnApiResponse(w, apiResponse{Content: change, Errors: []apiError{}}, http.StatusOK)
+}
+
+// UpdateRole sets whether users with the role have to use two-factor authentication (`two_factor_required`)
+func UpdateRole(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	role := mux.Vars(r)["role"]
+
+	type updateRoleData struct {
+		TwoFactorRequired *bool `json:"two_factor_required"`
+	}
+
+	var data updateRoleData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.TwoFactorRequired == nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	if err := db.SetRoleTwoFactorRequired(role, *data.TwoFactorRequired); err != nil {
+		if err == db.ErrUnknownRole {
+			respondError(w, errUnknownRole)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error updating role: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	logging.InfoLogger.Printf("%s set two_factor_required of %s to %t\n", user.Username, role, *data.TwoFactorRequired)
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// GetRoleChanges returns the audit trail of role changes, newest first. ?user_id= limits it to one user.
+func GetRoleChanges(w http.ResponseWriter, r *http.Request) {
+	changes, err := db.GetRoleChanges(r.URL.Query().Get("user_id"))
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting role changes: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: changes, Errors: []apiError{}}, http.StatusOK)
+}
@@ -0,0 +1,128 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+)
+
+func TestRequirePermission(t *testing.T) {
+	student := registerTestUser(t, "permissions_student")
+	admin := registerTestAdmin(t, "permissions_admin")
+
+	handler := RequirePermission(structs.PermissionManageRoles, GetRoles)
+
+	for _, c := range []struct {
+		name     string
+		cookie   *http.Cookie
+		expected int
+	}{
+		{"without session", nil, http.StatusUnauthorized},
+		{"as student", student, http.StatusForbidden},
+		{"as admin", admin, http.StatusOK},
+	} {
+		req, err := http.NewRequest("GET", "http://localhost:8000/admin/roles", nil)
+		if err != nil {
+			t.Fatalf("error requesting: %v", err)
+		}
+		if c.cookie != nil {
+			req.AddCookie(c.cookie)
+		}
+		rr := httptest.NewRecorder()
+
+		handler(rr, req)
+
+		if status := rr.Result().StatusCode; status != c.expected {
+			t.Errorf("getting roles %s returned status code %d, expected %d", c.name, status, c.expected)
+		}
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	admin := registerTestAdmin(t, "set_role_admin")
+	registerTestUser(t, "set_role_target")
+
+	target, err := db.GetUserByUsername("set_role_target", false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+
+	if status := setUserRoleStatus(t, admin, target.ID.String(), structs.RoleModerator); status != http.StatusOK {
+		t.Fatalf("promoting returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	target, err = db.GetUserByUsername("set_role_target", false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if target.Role != structs.RoleModerator {
+		t.Errorf("role is %q after promoting, expected %q", target.Role, structs.RoleModerator)
+	}
+
+	changes, err := db.GetRoleChanges(target.ID.String())
+	if err != nil {
+		t.Fatalf("error getting role changes: %v", err)
+	}
+	if len(changes) != 1 || changes[0].OldRole != structs.RoleStudent || changes[0].NewRole != structs.RoleModerator || changes[0].Reason != "test" {
+		t.Errorf("unexpected audit trail after promoting: %+v", changes)
+	}
+
+	if status := setUserRoleStatus(t, admin, target.ID.String(), "overlord"); status != http.StatusBadRequest {
+		t.Errorf("setting an unknown role returned status code %d, expected %d", status, http.StatusBadRequest)
+	}
+
+	adminUser, _, err := db.GetUserBySession(admin.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if status := setUserRoleStatus(t, admin, adminUser.ID.String(), structs.RoleStudent); status != http.StatusBadRequest {
+		t.Errorf("changing the own role returned status code %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestDemoteLastAdmin(t *testing.T) {
+	registerTestAdmin(t, "last_admin")
+
+	lastAdmin, err := db.GetUserByUsername("last_admin", false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+
+	// other tests create admins as well, so demote everyone else first
+	for _, username := range []string{"permissions_admin", "set_role_admin"} {
+		if other, err := db.GetUserByUsername(username, false); err == nil {
+			if _, err := db.SetUserRole(other.ID.String(), structs.RoleStudent, "", "test"); err != nil {
+				t.Fatalf("error demoting %s: %v", username, err)
+			}
+		}
+	}
+
+	if _, err := db.SetUserRole(lastAdmin.ID.String(), structs.RoleStudent, "", "test"); err != db.ErrLastAdmin {
+		t.Errorf("demoting the last admin returned %v, expected %v", err, db.ErrLastAdmin)
+	}
+}
+
+// registerTestAdmin registers a new user, makes it an admin and returns its session cookie
+func registerTestAdmin(t *testing.T, username string) *http.Cookie {
+	cookie := registerTestUser(t, username)
+
+	user, _, err := db.GetUserBySession(cookie.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+
+	if _, err := db.SetUserRole(user.ID.String(), structs.RoleAdmin, "", "test"); err != nil {
+		t.Fatalf("error making %s an admin: %v", username, err)
+	}
+
+	return cookie
+}
+
+// setUserRoleStatus changes the role of the user with the id and returns the status code of the response
+func setUserRoleStatus(t *testing.T, cookie *http.Cookie, id string, role string) int {
+	data := map[string]string{"role": role, "reason": "test"}
+	return requestStatus(t, "PUT", Authenticated(SetUserRole), cookie, map[string]string{"id": id}, data)
+}
@@ -0,0 +1,101 @@
+package routes
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/ratelimit"
+)
+
+// both are nil (no limits) until InitRateLimits is called
+var (
+	// requestLimiter limits requests per ip to routes that can be used to guess passwords or find out who is registered
+	requestLimiter *ratelimit.Limiter
+	// loginLockout locks accounts and ips out after too many failed logins
+	loginLockout *ratelimit.Lockout
+)
+
+// InitRateLimits sets up rate limiting as configured. Limits that are set to 0 stay disabled.
+func InitRateLimits(cfg config.RateLimit) {
+	requestLimiter = nil
+	if cfg.Requests > 0 {
+		requestLimiter = ratelimit.NewLimiter(cfg.Requests, cfg.Window)
+	}
+
+	loginLockout = nil
+	if cfg.LoginAttempts > 0 {
+		loginLockout = ratelimit.NewLockout(cfg.LoginAttempts, cfg.Lockout, cfg.MaxLockout)
+	}
+}
+
+// RateLimited limits how often a single ip may call the handler
+func RateLimited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestLimiter != nil {
+			if ok, retryAfter := requestLimiter.Allow(clientIP(r)); !ok {
+				logging.WarningLogger.Printf("rate limited %s request to %s from %s\n", r.Method, r.URL.Path, clientIP(r))
+				tooManyRequests(w, retryAfter)
+				return
+			}
+		}
+
+		h(w, r)
+	}
+}
+
+// loginLockedOut returns how long logins for the account or from the ip of the request are still locked out
+func loginLockedOut(r *http.Request, username string) time.Duration {
+	if loginLockout == nil {
+		return 0
+	}
+
+	byAccount := loginLockout.Locked(accountKey(username))
+	byIP := loginLockout.Locked(ipKey(r))
+	if byIP > byAccount {
+		return byIP
+	}
+	return byAccount
+}
+
+// loginFailed records a failed login for the account and the ip of the request
+func loginFailed(r *http.Request, username string) {
+	if loginLockout == nil {
+		return
+	}
+
+	if locked := loginLockout.Fail(accountKey(username)); locked > 0 {
+		logging.WarningLogger.Printf("locked out logins to %s for %v after too many failures\n", username, locked)
+	}
+	if locked := loginLockout.Fail(ipKey(r)); locked > 0 {
+		logging.WarningLogger.Printf("locked out logins from %s for %v after too many failures\n", clientIP(r), locked)
+	}
+}
+
+// loginSucceeded forgets the failed logins of the account. Failures of the ip are kept, otherwise logging in to an
+// own account in between would allow guessing passwords of others without limit.
+func loginSucceeded(username string) {
+	if loginLockout == nil {
+		return
+	}
+
+	loginLockout.Reset(accountKey(username))
+}
+
+func accountKey(username string) string {
+	return "account:" + strings.ToLower(username)
+}
+
+func ipKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// tooManyRequests answers with 429 and tells the client when to try again
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	respondError(w, errTooManyRequests)
+}
@@ -0,0 +1,95 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/ratelimit"
+	"git.teich.3nt3.de/3nt3/homework/totp"
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimited(t *testing.T) {
+	requestLimiter = ratelimit.NewLimiter(2, time.Minute)
+	defer func() { requestLimiter = nil }()
+
+	handler := RateLimited(UsernameTaken)
+	request := func(ip string) *http.Response {
+		req, err := http.NewRequest("GET", "http://localhost:8000/username-taken/test", nil)
+		if err != nil {
+			t.Fatalf("error requesting: %v", err)
+		}
+		req.Header.Set("X-Real-IP", ip)
+		req = mux.SetURLVars(req, map[string]string{"username": "test"})
+		rr := httptest.NewRecorder()
+
+		handler(rr, req)
+
+		return rr.Result()
+	}
+
+	for i := 0; i < 2; i++ {
+		if status := request("192.0.2.1").StatusCode; status != http.StatusOK {
+			t.Fatalf("request %d returned status code %d, expected %d", i+1, status, http.StatusOK)
+		}
+	}
+
+	result := request("192.0.2.1")
+	if result.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request exceeding the limit returned status code %d, expected %d", result.StatusCode, http.StatusTooManyRequests)
+	}
+	if result.Header.Get("Retry-After") != "30" {
+		t.Errorf("Retry-After is %q, expected 30", result.Header.Get("Retry-After"))
+	}
+
+	// X-Real-IP identifies the client, not the address of the reverse proxy
+	if status := request("192.0.2.2").StatusCode; status != http.StatusOK {
+		t.Errorf("request from another ip returned status code %d, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	loginLockout = ratelimit.NewLockout(3, time.Minute, time.Hour)
+	defer func() { loginLockout = nil }()
+
+	registerTestUser(t, "lockout")
+
+	for i := 0; i < 3; i++ {
+		if status := loginStatus(t, "lockout", "wrong password"); status != http.StatusUnauthorized {
+			t.Fatalf("failed login %d returned status code %d, expected %d", i+1, status, http.StatusUnauthorized)
+		}
+	}
+
+	// even the correct password is rejected while the account is locked
+	if status := loginStatus(t, "lockout", "test1234"); status != http.StatusTooManyRequests {
+		t.Errorf("logging in to a locked account returned status code %d, expected %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	cookie := registerTestUser(t, "two_factor_lockout")
+	secret, _ := enableTestTwoFactor(t, cookie)
+
+	loginLockout = ratelimit.NewLockout(3, time.Minute, time.Hour)
+	defer func() { loginLockout = nil }()
+
+	for i := 0; i < 3; i++ {
+		if status := requestStatus(t, "DELETE", Authenticated(DisableTwoFactor), cookie, nil, map[string]string{"code": "000000"}); status != http.StatusForbidden {
+			t.Fatalf("disabling two-factor authentication with wrong code %d returned status code %d, expected %d", i+1, status, http.StatusForbidden)
+		}
+	}
+
+	// codes can't be guessed with a session either, even the correct one is rejected now
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+	if status := requestStatus(t, "POST", Authenticated(RegenerateRecoveryCodes), cookie, nil, map[string]string{"code": code}); status != http.StatusTooManyRequests {
+		t.Errorf("replacing the recovery codes of a locked account returned status code %d, expected %d", status, http.StatusTooManyRequests)
+	}
+	if status := requestStatus(t, "DELETE", Authenticated(DisableTwoFactor), cookie, nil, map[string]string{"code": code}); status != http.StatusTooManyRequests {
+		t.Errorf("disabling two-factor authentication of a locked account returned status code %d, expected %d", status, http.StatusTooManyRequests)
+	}
+}
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
 	"time"
 
@@ -12,7 +13,7 @@ import (
 
 type apiResponse struct {
 	Content interface{} `json:"content"`
-	Errors  []string    `json:"errors"`
+	Errors  []apiError  `json:"errors"`
 }
 
 type Request struct {
@@ -23,11 +24,12 @@ type Request struct {
 var Requests []Request
 
 func returnApiResponse(w http.ResponseWriter, response apiResponse, status int) error {
-	w.WriteHeader(status)
+	// headers set after WriteHeader are not sent
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 
 	if response.Errors == nil {
-		response.Errors = []string{}
+		response.Errors = []apiError{}
 	}
 
 	err := json.NewEncoder(w).Encode(response)
@@ -35,21 +37,62 @@ func returnApiResponse(w http.ResponseWriter, response apiResponse, status int)
 	return err
 }
 
-func getUserBySession(r *http.Request, getCourses bool) (structs.User, bool, error) {
-	cookie, err := r.Cookie("hw_cookie_v2")
-	if err != nil {
+const sessionCookieName = "hw_cookie_v2"
+
+// getUserBySession returns the user of the session cookie and records that the session was used. Handlers don't call it
+// themselves, they are registered with Authenticated.
+func getUserBySession(r *http.Request) (structs.User, bool, error) {
+	user, authenticated, err := lookupUserBySession(r)
+	if !authenticated || err != nil {
+		return user, authenticated, err
+	}
+
+	// only used to show the user where their sessions are used, so failing to record it is not fatal
+	if err := db.TouchSession(sessionIDFromRequest(r), clientIP(r)); err != nil {
+		logging.WarningLogger.Printf("error updating session: %v\n", err)
+	}
+
+	return user, authenticated, nil
+}
+
+// lookupUserBySession is getUserBySession without recording that the session was used
+func lookupUserBySession(r *http.Request) (structs.User, bool, error) {
+	sessionId := sessionIDFromRequest(r)
+	if sessionId == "" {
 		// return no error, because the error will (probably) only be `named cookie not present`, which can be ignored here,
 		// rather than being checked every fucking time this helper is called. This prevents the client from just getting
 		// "500 internal server error" if the cookie does not exist.
 		return structs.User{}, false, nil
 	}
 
-	sessionId := cookie.Value
+	return db.GetUserBySession(sessionId, false)
+}
+
+// sessionIDFromRequest returns the value of the session cookie or an empty string if there is none
+func sessionIDFromRequest(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+// clientIP returns the address the request came from. Behind the reverse proxy that's X-Real-IP, see loggingMiddleware.
+func clientIP(r *http.Request) string {
+	if ip := r.Header.Get("X-Real-IP"); ip != "" {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
 
-	return db.GetUserBySession(sessionId, getCourses)
+	return host
 }
 
-func getOnlineUsers() []structs.CleanUser {
+func getOnlineUsers() []structs.PublicUser {
 	// filter requests
 	now := time.Now()
 	relevantRequests := getRequestsAfter(now.Add(time.Minute * -5))
@@ -57,7 +100,8 @@ func getOnlineUsers() []structs.CleanUser {
 	// get users
 	var users []structs.User
 	for _, req := range relevantRequests {
-		rUser, rAuthenticated, err := getUserBySession(req.Request, false)
+		// these requests are old, they must not count as using the session now
+		rUser, rAuthenticated, err := lookupUserBySession(req.Request)
 		if err != nil {
 			logging.WarningLogger.Printf("error getting user by saved request session: %v\n", err)
 			continue
@@ -72,14 +116,14 @@ func getOnlineUsers() []structs.CleanUser {
 
 	// filter duplicates
 	keys := make(map[string]bool)
-	var filteredUsers []structs.CleanUser
+	var filteredUsers []structs.PublicUser
 
 	for _, rUser := range users {
 		if _, value := keys[rUser.ID.String()]; !value {
 			keys[rUser.ID.String()] = true
 
-			// append cleaned user
-			filteredUsers = append(filteredUsers, rUser.GetClean())
+			// append public profile
+			filteredUsers = append(filteredUsers, rUser.GetPublic())
 		}
 	}
 
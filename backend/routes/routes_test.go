@@ -3,20 +3,35 @@ package routes
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
 
+	"git.teich.3nt3.de/3nt3/homework/config"
 	"git.teich.3nt3.de/3nt3/homework/db"
 	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/mail"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/gorilla/mux"
 )
 
+// sentMails contains every mail sent during the tests
+var sentMails = mail.NewMemorySender()
+
 func setup() {
-	logging.InitLoggers(true)
+	logging.InitLoggers(true, "logs.txt")
+	mail.SetSender(sentMails)
+
+	// moodle tokens are encrypted like in production
+	err := db.InitEncryption(config.Encryption{Keys: map[string]string{"test": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="}, CurrentKey: "test"})
+	if err != nil {
+		logging.ErrorLogger.Fatalf("error setting up encryption: %v\n", err)
+	}
 
 	// initialize database
-	err := db.InitDatabase(true)
+	err = db.InitDatabase(config.TestingDatabase(), true)
 	if err != nil {
 		logging.ErrorLogger.Fatalf("error initializing db: %v\n", err)
 	}
@@ -25,7 +40,7 @@ func setup() {
 	body, _ := json.Marshal(map[string]string{
 		"username": "test",
 		"email":    "test@example.com",
-		"password": "test123",
+		"password": "test1234",
 	})
 
 	req, err := http.NewRequest("POST", "http://localhost:8000", bytes.NewBuffer(body))
@@ -44,6 +59,83 @@ func setup() {
 	os.Setenv("HW_SESSION_COOKIE", result.Cookies()[0].Value)
 }
 
+// registerTestUser registers a new user and returns its session cookie
+func registerTestUser(t *testing.T, username string) *http.Cookie {
+	body, _ := json.Marshal(map[string]string{
+		"username": username,
+		"email":    username + "@example.com",
+		"password": "test1234",
+	})
+
+	req, err := http.NewRequest("POST", "http://localhost:8000/user/register", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	rr := httptest.NewRecorder()
+
+	NewUser(rr, req)
+
+	result := rr.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("registering %s failed with status code %d", username, result.StatusCode)
+	}
+
+	return result.Cookies()[0]
+}
+
+// request sends data as JSON to the handler and returns the recorded response. The cookie and the mux vars are only
+// added if they aren't nil, a nil data sends no body at all.
+func request(t *testing.T, method string, handler http.HandlerFunc, cookie *http.Cookie, vars map[string]string, data interface{}) *httptest.ResponseRecorder {
+	var body io.Reader = http.NoBody
+	if data != nil {
+		encoded, _ := json.Marshal(data)
+		body = bytes.NewBuffer(encoded)
+	}
+
+	req, err := http.NewRequest(method, "http://localhost:8000", body)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	if vars != nil {
+		req = mux.SetURLVars(req, vars)
+	}
+	rr := httptest.NewRecorder()
+
+	handler(rr, req)
+
+	return rr
+}
+
+// requestStatus is like request but only returns the status code of the response
+func requestStatus(t *testing.T, method string, handler http.HandlerFunc, cookie *http.Cookie, vars map[string]string, data interface{}) int {
+	return request(t, method, handler, cookie, vars, data).Code
+}
+
+// sessionCookie returns the session cookie of the user created in setup
+func sessionCookie() *http.Cookie {
+	return &http.Cookie{Name: "hw_cookie_v2", Value: os.Getenv("HW_SESSION_COOKIE")}
+}
+
+// createTestCourse creates a native course as the user the cookie belongs to and returns its id
+func createTestCourse(t *testing.T, cookie *http.Cookie, name string) int {
+	result := request(t, "POST", Authenticated(CreateCourse), cookie, nil, map[string]string{"name": name}).Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("creating course failed with status code %d", result.StatusCode)
+	}
+
+	var course struct {
+		Content structs.CleanCourse `json:"content"`
+	}
+	if err := json.NewDecoder(result.Body).Decode(&course); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+
+	return int(course.Content.ID.(float64))
+}
+
 func shutdown() {
 	_ = db.DropTables()
 }
@@ -54,3 +146,12 @@ func TestMain(m *testing.M) {
 	shutdown()
 	os.Exit(0)
 }
+
+func TestErrorResponseContentType(t *testing.T) {
+	rr := httptest.NewRecorder()
+	respondError(rr, errBadRequest)
+
+	if contentType := rr.Result().Header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("error responses have the content type %q, expected application/json", contentType)
+	}
+}
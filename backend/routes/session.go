@@ -0,0 +1,131 @@
+package routes
+
+import (
+	"net/http"
+
+	"git.teich.3nt3.de/3nt3/homework/config"
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/gorilla/mux"
+)
+
+// Logout deletes the session of the request and removes the session cookie
+func Logout(w http.ResponseWriter, r *http.Request) {
+	sessionID := sessionIDFromRequest(r)
+	if sessionID == "" {
+		respondError(w, errInvalidSession)
+		return
+	}
+
+	if err := db.DeleteSession(sessionID); err != nil {
+		logging.ErrorLogger.Printf("error deleting session: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	clearSessionCookie(w)
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// GetSessions returns all active sessions of the user. The session of the request is marked as current.
+func GetSessions(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	sessions, err := db.GetUserSessions(user.ID.String())
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting sessions: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	currentID := sessionIDFromRequest(r)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].UID.String() == currentID
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: sessions, Errors: []apiError{}}, http.StatusOK)
+}
+
+// RevokeSession deletes one of the user's sessions by its id. Revoking the current session is the same as logging out.
+func RevokeSession(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	id := mux.Vars(r)["id"]
+
+	current, err := db.GetSessionById(sessionIDFromRequest(r))
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting current session: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if err := db.DeleteUserSession(user.ID.String(), id); err != nil {
+		if err == db.ErrNotFound {
+			respondError(w, errSessionNotFound)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error deleting session: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if current.ID == id {
+		clearSessionCookie(w)
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// RevokeOtherSessions deletes all sessions of the user except the one the request was made with
+func RevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	revoked, err := db.DeleteOtherSessions(user.ID.String(), sessionIDFromRequest(r))
+	if err != nil {
+		logging.ErrorLogger.Printf("error deleting sessions: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: map[string]int64{"revoked": revoked}, Errors: []apiError{}}, http.StatusOK)
+}
+
+// logIn creates a session for the user, sets the session cookie and responds with the user
+func logIn(w http.ResponseWriter, r *http.Request, user structs.User) {
+	session, err := db.NewSession(user, r.UserAgent(), clientIP(r))
+	if err != nil {
+		logging.ErrorLogger.Printf("error creating new session: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	setSessionCookie(w, session)
+	_ = returnApiResponse(w, apiResponse{Content: user.GetClean(), Errors: []apiError{}}, http.StatusOK)
+}
+
+// setSessionCookie logs the browser in with the session
+func setSessionCookie(w http.ResponseWriter, session structs.Session) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.UID.String(),
+		MaxAge:   int(config.Get().Session.Lifetime.Seconds()),
+		Path:     "/",
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+}
+
+// clearSessionCookie tells the browser to delete the session cookie
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		MaxAge:   -1,
+		Path:     "/",
+		SameSite: http.SameSiteNoneMode,
+		Secure:   true,
+	})
+}
@@ -0,0 +1,146 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"github.com/gorilla/mux"
+)
+
+func TestLogout(t *testing.T) {
+	cookie := registerTestUser(t, "logout")
+
+	req, err := http.NewRequest("POST", "http://localhost:8000/user/logout", nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+
+	Logout(rr, req)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("logging out returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	if status := requestStatus(t, "GET", Authenticated(GetUser), cookie, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("using the session after logging out returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	cookie := registerTestUser(t, "revoke")
+
+	user, _, err := db.GetUserBySession(cookie.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+
+	var others []structs.Session
+	for i := 0; i < 2; i++ {
+		session, err := db.NewSession(user, "other device", "192.0.2.1")
+		if err != nil {
+			t.Fatalf("error creating session: %v", err)
+		}
+		others = append(others, session)
+	}
+
+	sessions := getSessions(t, cookie)
+	if len(sessions) != 3 {
+		t.Fatalf("got %d sessions, expected 3", len(sessions))
+	}
+
+	var current int
+	for _, s := range sessions {
+		if s.Current {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Errorf("%d sessions are marked as current, expected 1", current)
+	}
+
+	// revoke a single session
+	req, err := http.NewRequest("DELETE", "http://localhost:8000/user/sessions/"+others[0].ID, nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	req = mux.SetURLVars(req, map[string]string{"id": others[0].ID})
+	rr := httptest.NewRecorder()
+
+	Authenticated(RevokeSession)(rr, req)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("revoking a session returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	otherCookie := &http.Cookie{Name: sessionCookieName, Value: others[0].UID.String()}
+	if status := requestStatus(t, "GET", Authenticated(GetUser), otherCookie, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("using a revoked session returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+
+	// sessions of other users can't be revoked
+	req, err = http.NewRequest("DELETE", "http://localhost:8000/user/sessions/"+others[1].ID, nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(sessionCookie())
+	req = mux.SetURLVars(req, map[string]string{"id": others[1].ID})
+	rr = httptest.NewRecorder()
+
+	Authenticated(RevokeSession)(rr, req)
+
+	if status := rr.Result().StatusCode; status != http.StatusNotFound {
+		t.Errorf("revoking another user's session returned status code %d, expected %d", status, http.StatusNotFound)
+	}
+
+	// revoke all others
+	req, err = http.NewRequest("DELETE", "http://localhost:8000/user/sessions", nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+
+	Authenticated(RevokeOtherSessions)(rr, req)
+
+	if status := rr.Result().StatusCode; status != http.StatusOK {
+		t.Fatalf("revoking other sessions returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	sessions = getSessions(t, cookie)
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("got sessions %+v after revoking all others, expected only the current one", sessions)
+	}
+}
+
+// getSessions returns the sessions of the user the cookie belongs to
+func getSessions(t *testing.T, cookie *http.Cookie) []structs.Session {
+	req, err := http.NewRequest("GET", "http://localhost:8000/user/sessions", nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+
+	Authenticated(GetSessions)(rr, req)
+
+	result := rr.Result()
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("getting sessions failed with status code %d", result.StatusCode)
+	}
+
+	var response struct {
+		Content []structs.Session `json:"content"`
+	}
+	if err := json.NewDecoder(result.Body).Decode(&response); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+
+	return response.Content
+}
@@ -0,0 +1,321 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"git.teich.3nt3.de/3nt3/homework/totp"
+)
+
+// twoFactorIssuer is the name authenticator apps show for the account
+const twoFactorIssuer = "homework"
+
+// twoFactorTokenLifetime is how long users who logged in with an identity provider have to enter their code
+const twoFactorTokenLifetime = 5 * time.Minute
+
+type twoFactorCodeData struct {
+	Code string `json:"code"`
+}
+
+// GetTwoFactor returns whether the user enabled two-factor authentication, whether their role requires it and how
+// many recovery codes are left
+func GetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	status, err := db.GetTwoFactorStatus(currentUser(r))
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting two-factor status: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: status, Errors: []apiError{}}, http.StatusOK)
+}
+
+// SetUpTwoFactor generates a new totp secret and returns it as `secret` and as `uri`, an otpauth:// uri to show as a
+// qr code. Users with a password have to confirm it with `password`. Two-factor authentication is only enabled after
+// EnableTwoFactor was called with a code from the authenticator app.
+func SetUpTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	type setupData struct {
+		Password string `json:"password"`
+	}
+
+	var data setupData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	// users who signed up with an identity provider don't have a password to confirm
+	if user.PasswordHash != "" {
+		// wrong passwords count like failed logins, so this can't be used to guess the password either
+		if retryAfter := loginLockedOut(r, user.Username); retryAfter > 0 {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		_, correct, err := db.Authenticate(user.Username, data.Password)
+		if err != nil && err != db.ErrPasswordResetRequired {
+			logging.ErrorLogger.Printf("error authenticating: %v\n", err)
+			respondError(w, errInternal)
+			return
+		}
+
+		if !correct {
+			loginFailed(r, user.Username)
+			respondError(w, errWrongPassword)
+			return
+		}
+	}
+
+	secret, err := db.NewTwoFactorSecret(user.ID.String())
+	if err != nil {
+		if err == db.ErrTwoFactorEnabled {
+			respondError(w, errTwoFactorAlreadyEnabled)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error creating two-factor secret: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: map[string]string{
+		"secret": secret,
+		"uri":    totp.ProvisioningURI(secret, twoFactorIssuer, user.Username),
+	}, Errors: []apiError{}}, http.StatusOK)
+}
+
+// EnableTwoFactor enables two-factor authentication if `code` is valid for the secret from SetUpTwoFactor. It returns
+// the recovery codes as `recovery_codes`, they are only shown this once.
+func EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	var data twoFactorCodeData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Code == "" {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	codes, err := db.EnableTwoFactor(user.ID.String(), data.Code)
+	if err != nil {
+		switch err {
+		case db.ErrNotFound:
+			respondError(w, errTwoFactorNotSetUp)
+		case db.ErrTwoFactorEnabled:
+			respondError(w, errTwoFactorAlreadyEnabled)
+		case db.ErrInvalidTwoFactorCode:
+			respondError(w, errInvalidTwoFactorCode)
+		default:
+			logging.ErrorLogger.Printf("error enabling two-factor authentication: %v\n", err)
+			respondError(w, errInternal)
+		}
+		return
+	}
+
+	logging.InfoLogger.Printf("%s enabled two-factor authentication\n", user.Username)
+
+	_ = returnApiResponse(w, apiResponse{Content: map[string][]string{"recovery_codes": codes}, Errors: []apiError{}}, http.StatusOK)
+}
+
+// DisableTwoFactor turns two-factor authentication off after checking `code`, a current code or a recovery code. It
+// can't be turned off if the role of the user requires it.
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	status, ok := twoFactorEnabled(w, user)
+	if !ok {
+		return
+	}
+
+	if status.Required {
+		respondError(w, errTwoFactorRequiredByRole)
+		return
+	}
+
+	var data twoFactorCodeData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	if retryAfter := loginLockedOut(r, user.Username); retryAfter > 0 {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+
+	if !checkSecondFactor(w, r, user, data.Code, user.Username) {
+		return
+	}
+
+	if err := db.DisableTwoFactor(user.ID.String()); err != nil {
+		logging.ErrorLogger.Printf("error disabling two-factor authentication: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	logging.InfoLogger.Printf("%s disabled two-factor authentication\n", user.Username)
+
+	_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []apiError{}}, http.StatusOK)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user after checking `code` and returns the new ones as
+// `recovery_codes`
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+
+	if _, ok := twoFactorEnabled(w, user); !ok {
+		return
+	}
+
+	var data twoFactorCodeData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		respondError(w, errBadRequest)
+		return
+	}
+
+	if retryAfter := loginLockedOut(r, user.Username); retryAfter > 0 {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+
+	if !checkSecondFactor(w, r, user, data.Code, user.Username) {
+		return
+	}
+
+	codes, err := db.NewRecoveryCodes(user.ID.String())
+	if err != nil {
+		logging.ErrorLogger.Printf("error creating recovery codes: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	_ = returnApiResponse(w, apiResponse{Content: map[string][]string{"recovery_codes": codes}, Errors: []apiError{}}, http.StatusOK)
+}
+
+// twoFactorEnabled responds with 409 if the user didn't enable two-factor authentication. It returns true if they did.
+func twoFactorEnabled(w http.ResponseWriter, user structs.User) (structs.TwoFactorStatus, bool) {
+	status, err := db.GetTwoFactorStatus(user)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting two-factor status: %v\n", err)
+		respondError(w, errInternal)
+		return structs.TwoFactorStatus{}, false
+	}
+
+	if !status.Enabled {
+		respondError(w, errTwoFactorNotSetUp)
+		return structs.TwoFactorStatus{}, false
+	}
+
+	return status, true
+}
+
+// requireTwoFactorSetup responds with 403 if the role of the user requires two-factor authentication and the user
+// didn't enable it. It returns true if the request may continue.
+func requireTwoFactorSetup(w http.ResponseWriter, user structs.User) bool {
+	status, err := db.GetTwoFactorStatus(user)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting two-factor status: %v\n", err)
+		respondError(w, errInternal)
+		return false
+	}
+
+	if status.Required && !status.Enabled {
+		respondError(w, errTwoFactorSetupRequired)
+		return false
+	}
+
+	return true
+}
+
+// loginSecondFactor is checkSecondFactor for logins, users without two-factor authentication don't need a code. Wrong
+// codes count as failed logins of lockoutKey.
+func loginSecondFactor(w http.ResponseWriter, r *http.Request, user structs.User, code string, lockoutKey string) bool {
+	status, err := db.GetTwoFactorStatus(user)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting two-factor status: %v\n", err)
+		respondError(w, errInternal)
+		return false
+	}
+
+	if !status.Enabled {
+		return true
+	}
+
+	return checkSecondFactor(w, r, user, code, lockoutKey)
+}
+
+// checkSecondFactor checks code, a current totp code or a recovery code of the user. If there is none, it responds
+// with 401, if it is wrong with 403 and counts a failed login of lockoutKey. It returns true if the code is valid.
+func checkSecondFactor(w http.ResponseWriter, r *http.Request, user structs.User, code string, lockoutKey string) bool {
+	if code == "" {
+		respondError(w, errTwoFactorRequired)
+		return false
+	}
+
+	valid, err := db.CheckTwoFactorCode(user.ID.String(), code)
+	if err != nil {
+		logging.ErrorLogger.Printf("error checking two-factor code: %v\n", err)
+		respondError(w, errInternal)
+		return false
+	}
+
+	if !valid {
+		logging.InfoLogger.Printf("authentication failed, wrong two-factor code")
+		loginFailed(r, lockoutKey)
+		respondError(w, errInvalidTwoFactorCode)
+		return false
+	}
+
+	return true
+}
+
+// loginWithTwoFactorToken logs in the user who got the token after logging in with an identity provider, if code is
+// valid. The token can only be used once, but wrong codes don't use it up.
+func loginWithTwoFactorToken(w http.ResponseWriter, r *http.Request, token string, code string) {
+	userID, err := db.CheckUserToken(token, db.TokenPurposeTwoFactor)
+	if err != nil {
+		if err == db.ErrInvalidToken {
+			respondError(w, errInvalidToken)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error checking two-factor token: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	user, err := db.GetUserById(userID, false)
+	if err != nil {
+		logging.ErrorLogger.Printf("error getting user: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+
+	if retryAfter := loginLockedOut(r, user.Username); retryAfter > 0 {
+		tooManyRequests(w, retryAfter)
+		return
+	}
+
+	if !checkSecondFactor(w, r, user, code, user.Username) {
+		return
+	}
+
+	if _, err := db.UseUserToken(token, db.TokenPurposeTwoFactor); err != nil {
+		if err == db.ErrInvalidToken {
+			respondError(w, errInvalidToken)
+			return
+		}
+
+		logging.ErrorLogger.Printf("error using two-factor token: %v\n", err)
+		respondError(w, errInternal)
+		return
+	}
+	loginSucceeded(user.Username)
+
+	logIn(w, r, user)
+}
@@ -0,0 +1,189 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"git.teich.3nt3.de/3nt3/homework/db"
+	"git.teich.3nt3.de/3nt3/homework/oidc/oidctest"
+	"git.teich.3nt3.de/3nt3/homework/structs"
+	"git.teich.3nt3.de/3nt3/homework/totp"
+)
+
+func TestTwoFactorLogin(t *testing.T) {
+	cookie := registerTestUser(t, "two_factor_login")
+	secret, recoveryCodes := enableTestTwoFactor(t, cookie)
+
+	if status := twoFactorLoginStatus(t, "two_factor_login", ""); status != http.StatusUnauthorized {
+		t.Errorf("logging in without a code returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+	if status := twoFactorLoginStatus(t, "two_factor_login", "000000"); status != http.StatusForbidden {
+		t.Errorf("logging in with a wrong code returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	// the code of the current period was used to enable two-factor authentication, the next one is accepted as well
+	code, err := totp.Code(secret, time.Now().Add(totp.Period))
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+	if status := twoFactorLoginStatus(t, "two_factor_login", code); status != http.StatusOK {
+		t.Errorf("logging in with the code returned status code %d, expected %d", status, http.StatusOK)
+	}
+	if status := twoFactorLoginStatus(t, "two_factor_login", code); status != http.StatusForbidden {
+		t.Errorf("logging in with the same code again returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	if status := twoFactorLoginStatus(t, "two_factor_login", recoveryCodes[0]); status != http.StatusOK {
+		t.Errorf("logging in with a recovery code returned status code %d, expected %d", status, http.StatusOK)
+	}
+	if status := twoFactorLoginStatus(t, "two_factor_login", recoveryCodes[0]); status != http.StatusForbidden {
+		t.Errorf("logging in with a used recovery code returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	status, err := db.GetTwoFactorStatus(userOfSession(t, cookie))
+	if err != nil {
+		t.Fatalf("error getting two-factor status: %v", err)
+	}
+	if !status.Enabled || status.RecoveryCodesLeft != len(recoveryCodes)-1 {
+		t.Errorf("unexpected two-factor status %+v", status)
+	}
+}
+
+func TestTwoFactorRequiredByRole(t *testing.T) {
+	cookie := registerTestUser(t, "two_factor_role")
+	if _, err := db.SetUserRole(userOfSession(t, cookie).ID.String(), structs.RoleModerator, "", "test"); err != nil {
+		t.Fatalf("error changing role: %v", err)
+	}
+
+	admin := registerTestAdmin(t, "two_factor_role_admin")
+	if status := updateRoleStatus(t, admin, structs.RoleModerator, true); status != http.StatusOK {
+		t.Fatalf("requiring two-factor authentication returned status code %d, expected %d", status, http.StatusOK)
+	}
+	t.Cleanup(func() {
+		if err := db.SetRoleTwoFactorRequired(structs.RoleModerator, false); err != nil {
+			t.Errorf("error resetting role: %v", err)
+		}
+	})
+
+	if status := requestStatus(t, "GET", Authenticated(GetSessions), cookie, nil, nil); status != http.StatusForbidden {
+		t.Errorf("getting sessions without two-factor authentication returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+	if status := requestStatus(t, "GET", TwoFactorSetup(GetUser), cookie, nil, nil); status != http.StatusOK {
+		t.Errorf("getting the user without two-factor authentication returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	secret, _ := enableTestTwoFactor(t, cookie)
+
+	if status := requestStatus(t, "GET", Authenticated(GetSessions), cookie, nil, nil); status != http.StatusOK {
+		t.Errorf("getting sessions with two-factor authentication returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	code, err := totp.Code(secret, time.Now().Add(totp.Period))
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+	if status := requestStatus(t, "DELETE", Authenticated(DisableTwoFactor), cookie, nil, map[string]string{"code": code}); status != http.StatusConflict {
+		t.Errorf("disabling two-factor authentication required by the role returned status code %d, expected %d", status, http.StatusConflict)
+	}
+
+	if status := updateRoleStatus(t, admin, "overlord", true); status != http.StatusBadRequest {
+		t.Errorf("updating an unknown role returned status code %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestOIDCLoginWithTwoFactor(t *testing.T) {
+	server := newTestIdentityProvider(t, false)
+	server.SetIdentity(oidctest.Identity{Subject: "two-factor", Email: "oidc_two_factor@example.com", EmailVerified: true, PreferredUsername: "oidc_two_factor"})
+
+	cookie := sessionCookieOf(t, finishOIDCLogin(t, server, nil))
+	secret, _ := enableTestTwoFactor(t, cookie)
+
+	location := redirectLocation(t, finishOIDCLogin(t, server, nil))
+	token := location.Query().Get("two_factor_token")
+	if location.Path != loginPage || token == "" {
+		t.Fatalf("logging in with two-factor authentication redirected to %s, expected %s with a token", location, loginPage)
+	}
+
+	code, err := totp.Code(secret, time.Now().Add(totp.Period))
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+
+	// registration doesn't log in
+	if status := postJSONStatus(t, NewUser, map[string]string{"two_factor_token": token, "code": code}); status != http.StatusBadRequest {
+		t.Errorf("registering with a two-factor token returned status code %d, expected %d", status, http.StatusBadRequest)
+	}
+	if status := postJSONStatus(t, Login, map[string]string{"two_factor_token": token, "code": "000000"}); status != http.StatusForbidden {
+		t.Errorf("finishing the login with a wrong code returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+	if status := postJSONStatus(t, Login, map[string]string{"two_factor_token": token, "code": code}); status != http.StatusOK {
+		t.Errorf("finishing the login returned status code %d, expected %d", status, http.StatusOK)
+	}
+	if status := postJSONStatus(t, Login, map[string]string{"two_factor_token": token, "code": code}); status != http.StatusBadRequest {
+		t.Errorf("using the token again returned status code %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+// enableTestTwoFactor sets up and enables two-factor authentication for the user and returns the secret and the
+// recovery codes
+func enableTestTwoFactor(t *testing.T, cookie *http.Cookie) (string, []string) {
+	rr := request(t, "POST", TwoFactorSetup(SetUpTwoFactor), cookie, nil, map[string]string{"password": "test1234"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("setting up two-factor authentication returned status code %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	var setup struct {
+		Content struct {
+			Secret string `json:"secret"`
+			URI    string `json:"uri"`
+		} `json:"content"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&setup); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+
+	code, err := totp.Code(setup.Content.Secret, time.Now())
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+
+	rr = request(t, "POST", TwoFactorSetup(EnableTwoFactor), cookie, nil, map[string]string{"code": code})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("enabling two-factor authentication returned status code %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	var enabled struct {
+		Content struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		} `json:"content"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&enabled); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+	if len(enabled.Content.RecoveryCodes) == 0 {
+		t.Fatalf("enabling two-factor authentication returned no recovery codes")
+	}
+
+	return setup.Content.Secret, enabled.Content.RecoveryCodes
+}
+
+// twoFactorLoginStatus logs in with the password of test users and the code and returns the status code
+func twoFactorLoginStatus(t *testing.T, username string, code string) int {
+	return postJSONStatus(t, Login, map[string]string{"username": username, "password": "test1234", "code": code})
+}
+
+func updateRoleStatus(t *testing.T, cookie *http.Cookie, role string, twoFactorRequired bool) int {
+	data := map[string]bool{"two_factor_required": twoFactorRequired}
+	return requestStatus(t, "PUT", RequirePermission(structs.PermissionManageRoles, UpdateRole), cookie, map[string]string{"role": role}, data)
+}
+
+func userOfSession(t *testing.T, cookie *http.Cookie) structs.User {
+	user, _, err := db.GetUserBySession(cookie.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+
+	return user
+}
@@ -1,14 +1,13 @@
 package routes
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
-	"strings"
 	"time"
 
 	"git.teich.3nt3.de/3nt3/homework/db"
 	"git.teich.3nt3.de/3nt3/homework/logging"
+	"git.teich.3nt3.de/3nt3/homework/mail"
 	"git.teich.3nt3.de/3nt3/homework/structs"
 	"github.com/gorilla/mux"
 )
@@ -19,68 +18,57 @@ func NewUser(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&userData)
 	if err != nil {
 		logging.WarningLogger.Printf("error decoding request: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"invalid request"}}, 400)
+		respondError(w, errBadRequest)
 		return
 	}
 
 	username, ok := userData["username"]
 	if !ok {
 		logging.WarningLogger.Printf("error decoding request: field 'username' does not exist\n")
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"invalid request"}}, 400)
+		respondError(w, errBadRequest)
 		return
 	}
 
 	email, ok := userData["email"]
 	if !ok {
 		logging.WarningLogger.Printf("error decoding request: field 'email' does not exist\n")
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"invalid request"}}, 400)
+		respondError(w, errBadRequest)
 		return
 	}
 
-	password, ok := userData["username"]
+	password, ok := userData["password"]
 	if !ok {
 		logging.WarningLogger.Printf("error decoding request: field 'password' does not exist\n")
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"invalid request"}}, 400)
+		respondError(w, errBadRequest)
 		return
 	}
 
-	user, err := db.NewUser(username, email, password)
-	if err != nil {
-		var responseCode int
-		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
-			if strings.Contains(err.Error(), "email") {
-				_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"email already in use"}}, http.StatusBadRequest)
-				return
-			}
-			if strings.Contains(err.Error(), "username") {
-				_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"username already in use"}}, http.StatusBadRequest)
-				return
-			}
-		}
-		logging.ErrorLogger.Printf("error creating new user: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"internal server error"}}, responseCode)
+	if problem := checkPassword(password, username, email); problem != "" {
+		respondError(w, errWeakPassword.withMessage(problem))
 		return
 	}
 
-	session, err := db.NewSession(user)
+	user, err := db.NewUser(username, email, password)
 	if err != nil {
-		logging.ErrorLogger.Printf("error creating new session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"internal server error"}}, 500)
+		switch err {
+		case db.ErrEmailTaken:
+			respondError(w, errEmailTaken)
+			return
+		case db.ErrUsernameTaken:
+			respondError(w, errUsernameTaken)
+			return
+		}
+		logging.ErrorLogger.Printf("error creating new user: %v\n", err)
+		respondError(w, errInternal)
 		return
 	}
 
-	sessionCookie := http.Cookie{
-		Name:     "hw_cookie_v2",
-		Value:    session.UID.String(),
-		MaxAge:   structs.MaxSessionAge * 24 * 60 * 60,
-		Path:     "/",
-		SameSite: http.SameSiteNoneMode,
-		Secure:   true,
+	// the account is usable without a verified email, so failing to send the mail must not fail the registration
+	if err := sendVerificationMail(user, mail.WelcomeMail); err != nil {
+		logging.ErrorLogger.Printf("error sending welcome mail: %v\n", err)
 	}
 
-	http.SetCookie(w, &sessionCookie)
-
-	_ = returnApiResponse(w, apiResponse{Content: user.GetClean(), Errors: []string{}}, 200)
+	logIn(w, r, user)
 }
 
 func GetUserById(w http.ResponseWriter, r *http.Request) {
@@ -88,22 +76,22 @@ func GetUserById(w http.ResponseWriter, r *http.Request) {
 	id, ok := mux.Vars(r)["id"]
 	if !ok {
 		logging.WarningLogger.Printf("no id specified\n")
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"invalid request"}}, 400)
+		respondError(w, errBadRequest)
 		return
 	}
 
 	user, err := db.GetUserById(id, false)
 	if err != nil {
 		logging.ErrorLogger.Printf("error fetching user from db: %v\n", err)
-		if err != sql.ErrNoRows {
-			_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"internal server error"}}, 500)
+		if err != db.ErrNotFound {
+			respondError(w, errInternal)
 		} else {
-			_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"user does not exist"}}, 404)
+			respondError(w, errUserNotFound)
 		}
 		return
 	}
 
-	_ = returnApiResponse(w, apiResponse{Content: user.GetClean(), Errors: []string{}}, 200)
+	_ = returnApiResponse(w, apiResponse{Content: user.GetPublic(), Errors: []apiError{}}, 200)
 }
 
 func Login(w http.ResponseWriter, r *http.Request) {
@@ -113,117 +101,107 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&userData)
 	if err != nil {
 		logging.WarningLogger.Printf("error decoding request: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"invalid request"}}, 400)
+		respondError(w, errBadRequest)
+		return
+	}
+
+	// users who logged in with an identity provider and use two-factor authentication only enter their code
+	if token, ok := userData["two_factor_token"]; ok {
+		loginWithTwoFactorToken(w, r, token, userData["code"])
 		return
 	}
 
 	username, ok := userData["username"]
 	if !ok {
 		logging.WarningLogger.Printf("error decoding request: field 'username' does not exist\n")
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"invalid request"}}, 400)
+		respondError(w, errBadRequest)
 		return
 	}
 
-	password, ok := userData["username"]
+	password, ok := userData["password"]
 	if !ok {
 		logging.WarningLogger.Printf("error decoding request: field 'password' does not exist\n")
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"invalid request"}}, 400)
+		respondError(w, errBadRequest)
+		return
+	}
+
+	if retryAfter := loginLockedOut(r, username); retryAfter > 0 {
+		tooManyRequests(w, retryAfter)
 		return
 	}
 
 	user, authenticated, err := db.Authenticate(username, password)
 	if err != nil {
+		if err == db.ErrPasswordResetRequired {
+			// the hash of these accounts is the one of the username, so this isn't a successful login either
+			loginFailed(r, username)
+			respondError(w, errPasswordResetRequired)
+			return
+		}
+
 		logging.ErrorLogger.Printf("error authenticating: %v\n", err)
+		respondError(w, errInternal)
 		return
 	}
 
 	if !authenticated {
 		logging.InfoLogger.Printf("authentication failed, wrong password")
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"wrong password"}}, 401)
+		loginFailed(r, username)
+		respondError(w, errInvalidCredentials)
 		return
 	}
 
-	session, err := db.NewSession(user)
-	if err != nil {
-		logging.ErrorLogger.Printf("error creating new session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{Content: nil, Errors: []string{"internal server error"}}, 500)
+	if !loginSecondFactor(w, r, user, userData["code"], username) {
 		return
 	}
+	loginSucceeded(username)
 
-	sessionCookie := http.Cookie{
-		Name:     "hw_cookie_v2",
-		Value:    session.UID.String(),
-		MaxAge:   structs.MaxSessionAge * 24 * 60 * 60,
-		Path:     "/",
-		SameSite: http.SameSiteNoneMode,
-		Secure:   true,
-	}
-
-	http.SetCookie(w, &sessionCookie)
-	_ = returnApiResponse(w, apiResponse{Content: user.GetClean(), Errors: []string{}}, 200)
+	logIn(w, r, user)
 }
 
 func GetUser(w http.ResponseWriter, r *http.Request) {
-
-	user, authenticated, err := getUserBySession(r, true)
-	if err != nil && err != sql.ErrNoRows {
-		logging.ErrorLogger.Printf("error getting user by session: %v\n", err)
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"internal server error"},
-		}, 500)
-		return
-	}
-
-	if !authenticated {
-		_ = returnApiResponse(w, apiResponse{
-			Content: nil,
-			Errors:  []string{"invalid session"},
-		}, 401)
+	user, ok := currentUserWithCourses(w, r)
+	if !ok {
 		return
 	}
 
-	_ = returnApiResponse(w, apiResponse{Content: user.GetClean(), Errors: []string{}}, 200)
+	_ = returnApiResponse(w, apiResponse{Content: user.GetClean(), Errors: []apiError{}}, 200)
 }
 
 func UsernameTaken(w http.ResponseWriter, r *http.Request) {
 
 	username, ok := mux.Vars(r)["username"]
 	if !ok {
-		_ = returnApiResponse(w, apiResponse{
-			Errors: []string{"no username provided"},
-		}, 400)
+		respondError(w, errBadRequest.withMessage("no username provided"))
 		return
 	}
 
 	taken, err := db.UsernameTaken(username)
 	if err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Errors: []string{"internal server error"},
-		}, 500)
+		logging.ErrorLogger.Printf("error checking if username is taken: %v\n", err)
+		respondError(w, errInternal)
+		return
 	}
 
-	_ = returnApiResponse(w, apiResponse{Content: taken, Errors: []string{}}, 200)
+	_ = returnApiResponse(w, apiResponse{Content: taken, Errors: []apiError{}}, 200)
 }
 
 func EmailTaken(w http.ResponseWriter, r *http.Request) {
 
 	email, ok := mux.Vars(r)["email"]
 	if !ok {
-		_ = returnApiResponse(w, apiResponse{
-			Errors: []string{"no username provided"},
-		}, 400)
+		respondError(w, errBadRequest.withMessage("no email provided"))
 		return
 	}
 
 	taken, err := db.EmailTaken(email)
 	if err != nil {
-		_ = returnApiResponse(w, apiResponse{
-			Errors: []string{"internal server error"},
-		}, 500)
+		logging.ErrorLogger.Printf("error checking if email is taken: %v\n", err)
+		respondError(w, errInternal)
+		return
 	}
 
-	_ = returnApiResponse(w, apiResponse{Content: taken, Errors: []string{}}, 200)
+	_ = returnApiResponse(w, apiResponse{Content: taken, Errors: []apiError{}}, 200)
 }
 
 // OnlineUsers returns a list of online users.
@@ -244,7 +222,7 @@ func OnlineUsers(w http.ResponseWriter, r *http.Request) {
 	// get users
 	var users []structs.User
 	for _, req := range relevantRequests {
-		rUser, rAuthenticated, err := getUserBySession(req.Request, false)
+		rUser, rAuthenticated, err := lookupUserBySession(req.Request)
 		if err != nil {
 			logging.WarningLogger.Printf("error getting user by saved request session: %v\n", err)
 			continue
@@ -259,14 +237,14 @@ func OnlineUsers(w http.ResponseWriter, r *http.Request) {
 
 	// filter duplicates
 	keys := make(map[string]bool)
-	var filteredUsers []structs.CleanUser
+	var filteredUsers []structs.PublicUser
 
 	for _, rUser := range users {
 		if _, value := keys[rUser.ID.String()]; !value {
 			keys[rUser.ID.String()] = true
 
-			// append cleaned user
-			filteredUsers = append(filteredUsers, rUser.GetClean())
+			// append public profile
+			filteredUsers = append(filteredUsers, rUser.GetPublic())
 		}
 	}
 
@@ -5,16 +5,19 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"testing"
 
+	"git.teich.3nt3.de/3nt3/homework/db"
 	"git.teich.3nt3.de/3nt3/homework/logging"
+	"github.com/gorilla/mux"
 )
 
 func TestCreateUser(t *testing.T) {
 	body, _ := json.Marshal(map[string]string{
 		"username": "test1",
 		"email":    "test1@example.com",
-		"password": "test123",
+		"password": "test1234",
 	})
 
 	req, err := http.NewRequest("POST", "http://localhost:8000", bytes.NewBuffer(body))
@@ -42,3 +45,281 @@ func TestCreateUser(t *testing.T) {
 
 	logging.InfoLogger.Printf("user: %+v\n", resp.Content)
 }
+
+func TestLoginWithCorrectPassword(t *testing.T) {
+	registerTestUser(t, "login_correct")
+
+	if status := loginStatus(t, "login_correct", "test1234"); status != http.StatusOK {
+		t.Errorf("logging in with the correct password returned status code %d, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestLoginWithWrongPassword(t *testing.T) {
+	registerTestUser(t, "login_wrong")
+
+	if status := loginStatus(t, "login_wrong", "wrong password"); status != http.StatusUnauthorized {
+		t.Errorf("logging in with a wrong password returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+
+	// this used to be accepted because the hash of the username was stored instead of the password
+	if status := loginStatus(t, "login_wrong", "login_wrong"); status != http.StatusUnauthorized {
+		t.Errorf("logging in with the username as password returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRegisterWithWeakPassword(t *testing.T) {
+	for _, password := range []string{"", "short", "weak_password", "weak_password@example.com"} {
+		body, _ := json.Marshal(map[string]string{
+			"username": "weak_password",
+			"email":    "weak_password@example.com",
+			"password": password,
+		})
+
+		req, err := http.NewRequest("POST", "http://localhost:8000/user/register", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("error requesting: %v", err)
+		}
+		rr := httptest.NewRecorder()
+
+		NewUser(rr, req)
+
+		if status := rr.Result().StatusCode; status != http.StatusBadRequest {
+			t.Errorf("registering with password %q returned status code %d, expected %d", password, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRegisterTakenUsernameOrEmail(t *testing.T) {
+	registerTestUser(t, "taken")
+
+	for _, c := range []struct {
+		username string
+		email    string
+		expected apiError
+	}{
+		{"taken", "not_taken@example.com", errUsernameTaken},
+		{"not_taken", "taken@example.com", errEmailTaken},
+	} {
+		body, _ := json.Marshal(map[string]string{
+			"username": c.username,
+			"email":    c.email,
+			"password": "test1234",
+		})
+
+		req, err := http.NewRequest("POST", "http://localhost:8000/user/register", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("error requesting: %v", err)
+		}
+		rr := httptest.NewRecorder()
+
+		NewUser(rr, req)
+
+		result := rr.Result()
+		if result.StatusCode != http.StatusConflict {
+			t.Errorf("registering %s <%s> returned status code %d, expected %d", c.username, c.email, result.StatusCode, http.StatusConflict)
+		}
+
+		var resp apiResponse
+		if err := json.NewDecoder(result.Body).Decode(&resp); err != nil {
+			t.Fatalf("error decoding body: %v", err)
+		}
+		if len(resp.Errors) != 1 || resp.Errors[0].Code != c.expected.Code {
+			t.Errorf("registering %s <%s> returned errors %+v, expected %s", c.username, c.email, resp.Errors, c.expected.Code)
+		}
+	}
+}
+
+func TestLoginWithPasswordResetRequired(t *testing.T) {
+	cookie := registerTestUser(t, "reset_required")
+
+	user, _, err := db.GetUserBySession(cookie.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+
+	if err := db.RequirePasswordReset(user.ID.String()); err != nil {
+		t.Fatalf("error requiring password reset: %v", err)
+	}
+
+	// a wrong password doesn't reveal that the account has to reset its password
+	if status := loginStatus(t, "reset_required", "wrong password"); status != http.StatusUnauthorized {
+		t.Errorf("logging in with a wrong password to an account that has to reset its password returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+	if status := loginStatus(t, "reset_required", "test1234"); status != http.StatusForbidden {
+		t.Errorf("logging in to an account that has to reset its password returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	// sessions of these accounts can't be trusted, the password has to be reset by mail
+	body, _ := json.Marshal(map[string]string{"password": "new password"})
+	req, err := http.NewRequest("PUT", "http://localhost:8000/user/password", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+
+	Authenticated(ChangePassword)(rr, req)
+
+	if status := rr.Result().StatusCode; status != http.StatusForbidden {
+		t.Errorf("changing the password of an account that has to reset it returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	if status := postJSONStatus(t, PasswordReset, map[string]string{"email": "reset_required@example.com"}); status != http.StatusOK {
+		t.Fatalf("requesting a password reset returned status code %d, expected %d", status, http.StatusOK)
+	}
+	if status := postJSONStatus(t, PasswordReset, map[string]string{"token": tokenFromMail(t, "reset_required@example.com"), "password": "new password"}); status != http.StatusOK {
+		t.Fatalf("resetting the password returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	if status := loginStatus(t, "reset_required", "new password"); status != http.StatusOK {
+		t.Errorf("logging in with the new password returned status code %d, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestChangePasswordWithWrongCurrentPassword(t *testing.T) {
+	cookie := registerTestUser(t, "change_wrong")
+
+	body, _ := json.Marshal(map[string]string{"current_password": "wrong password", "password": "new password"})
+	req, err := http.NewRequest("PUT", "http://localhost:8000/user/password", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req.AddCookie(cookie)
+	rr := httptest.NewRecorder()
+
+	Authenticated(ChangePassword)(rr, req)
+
+	if status := rr.Result().StatusCode; status != http.StatusForbidden {
+		t.Errorf("changing the password with a wrong current password returned status code %d, expected %d", status, http.StatusForbidden)
+	}
+
+	if status := loginStatus(t, "change_wrong", "test1234"); status != http.StatusOK {
+		t.Errorf("logging in with the old password returned status code %d, expected %d", status, http.StatusOK)
+	}
+}
+
+// loginStatus tries to log in and returns the status code of the response
+func loginStatus(t *testing.T, username string, password string) int {
+	return postJSONStatus(t, Login, map[string]string{"username": username, "password": password})
+}
+
+func TestVerifyEmail(t *testing.T) {
+	cookie := registerTestUser(t, "verify_email")
+
+	token := tokenFromMail(t, "verify_email@example.com")
+
+	if status := postJSONStatus(t, VerifyEmail, map[string]string{"token": token}); status != http.StatusOK {
+		t.Fatalf("verifying the email returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	user, _, err := db.GetUserBySession(cookie.Value, false)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if !user.EmailVerified {
+		t.Errorf("email is not verified after using the token")
+	}
+
+	// tokens can only be used once
+	if status := postJSONStatus(t, VerifyEmail, map[string]string{"token": token}); status != http.StatusBadRequest {
+		t.Errorf("using a verification token twice returned status code %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	cookie := registerTestUser(t, "reset")
+
+	if status := postJSONStatus(t, PasswordReset, map[string]string{"email": "reset@example.com"}); status != http.StatusOK {
+		t.Fatalf("requesting a password reset returned status code %d, expected %d", status, http.StatusOK)
+	}
+	token := tokenFromMail(t, "reset@example.com")
+
+	// unknown addresses look exactly the same
+	if status := postJSONStatus(t, PasswordReset, map[string]string{"email": "nobody@example.com"}); status != http.StatusOK {
+		t.Errorf("requesting a password reset for an unknown address returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	if status := postJSONStatus(t, PasswordReset, map[string]string{"token": "not a token", "password": "new password"}); status != http.StatusBadRequest {
+		t.Errorf("resetting the password with an invalid token returned status code %d, expected %d", status, http.StatusBadRequest)
+	}
+
+	// a weak password must not use up the token
+	if status := postJSONStatus(t, PasswordReset, map[string]string{"token": token, "password": "short"}); status != http.StatusBadRequest {
+		t.Errorf("resetting the password to a weak one returned status code %d, expected %d", status, http.StatusBadRequest)
+	}
+
+	if status := postJSONStatus(t, PasswordReset, map[string]string{"token": token, "password": "new password"}); status != http.StatusOK {
+		t.Fatalf("resetting the password returned status code %d, expected %d", status, http.StatusOK)
+	}
+
+	if status := loginStatus(t, "reset", "new password"); status != http.StatusOK {
+		t.Errorf("logging in with the new password returned status code %d, expected %d", status, http.StatusOK)
+	}
+	if status := loginStatus(t, "reset", "test1234"); status != http.StatusUnauthorized {
+		t.Errorf("logging in with the old password returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+
+	if status := requestStatus(t, "GET", Authenticated(GetUser), cookie, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("using a session from before the reset returned status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+
+	if status := postJSONStatus(t, PasswordReset, map[string]string{"token": token, "password": "another password"}); status != http.StatusBadRequest {
+		t.Errorf("using a reset token twice returned status code %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+var tokenPattern = regexp.MustCompile(`\?token=([A-Za-z0-9_-]+)`)
+
+// tokenFromMail returns the token from the link in the last mail sent to address
+func TestGetUserByIdIsPublic(t *testing.T) {
+	user := userOfSession(t, registerTestUser(t, "public_profile"))
+
+	req, err := http.NewRequest("GET", "http://localhost:8000/user/"+user.ID.String(), nil)
+	if err != nil {
+		t.Fatalf("error requesting: %v", err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": user.ID.String()})
+	rr := httptest.NewRecorder()
+
+	GetUserById(rr, req)
+
+	if rr.Result().StatusCode != http.StatusOK {
+		t.Fatalf("getting user returned status code %d, expected %d", rr.Result().StatusCode, http.StatusOK)
+	}
+
+	var response struct {
+		Content map[string]interface{} `json:"content"`
+	}
+	if err := json.NewDecoder(rr.Result().Body).Decode(&response); err != nil {
+		t.Fatalf("error decoding body: %v", err)
+	}
+
+	if response.Content["username"] != user.Username {
+		t.Errorf("got username %v, expected %s", response.Content["username"], user.Username)
+	}
+	// anyone can request this, so it must not contain what only the user themselves should see
+	for _, key := range []string{"email", "courses", "moodle_url", "moodle_user_id", "moodle_status", "password_reset_required", "email_verified"} {
+		if _, ok := response.Content[key]; ok {
+			t.Errorf("public profile contains %s", key)
+		}
+	}
+}
+
+func tokenFromMail(t *testing.T, address string) string {
+	msg, ok := sentMails.LastTo(address)
+	if !ok {
+		t.Fatalf("no mail was sent to %s", address)
+	}
+
+	match := tokenPattern.FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("mail to %s contains no token: %s", address, msg.Body)
+	}
+
+	return match[1]
+}
+
+// postJSONStatus posts data to the handler and returns the status code of the response
+func postJSONStatus(t *testing.T, handler http.HandlerFunc, data interface{}) int {
+	return requestStatus(t, "POST", handler, nil, nil, data)
+}
@@ -1,49 +1,113 @@
 package structs
 
 import (
+	"encoding/json"
 	"strconv"
 	"time"
 
 	"github.com/segmentio/ksuid"
 )
 
-// max age in days
-const MaxSessionAge int = 90
-
+// User is a user with everything stored about them. It is always serialized as CleanUser, so PasswordHash and
+// MoodleToken never leave the server.
 type User struct {
 	ID           ksuid.KSUID `json:"id"`
 	Username     string      `json:"username"`
 	Email        string      `json:"email"`
-	PasswordHash string
-	Created      UnixTime `json:"created"`
-	Privilege    int8     `json:"privilege"`
-	Courses      []Course `json:"courses"`
-	MoodleURL    string   `json:"moodle_url"`
-	MoodleToken  string   `json:"moodle_token"`
-	MoodleUserID int      `json:"moodle_user_id"`
-}
-
-type CleanUser struct {
-	ID           ksuid.KSUID `json:"id"`
-	Username     string      `json:"username"`
-	Email        string      `json:"email"`
+	PasswordHash string      `json:"-"`
 	Created      UnixTime    `json:"created"`
-	Privilege    int8        `json:"privilege"`
+	Role         string      `json:"role"`
 	Courses      []Course    `json:"courses"`
 	MoodleURL    string      `json:"moodle_url"`
+	MoodleToken  string      `json:"-"`
 	MoodleUserID int         `json:"moodle_user_id"`
+	// MoodleStatus is what the last check of the moodle token found out, empty if it wasn't checked yet
+	MoodleStatus          string `json:"-"`
+	PasswordResetRequired bool   `json:"password_reset_required"`
+	EmailVerified         bool   `json:"email_verified"`
+}
+
+// what is known about the moodle token of a user, see CleanUser.MoodleStatus
+const (
+	MoodleNotConnected = "not_connected"
+	MoodleConnected    = "connected"
+	// MoodleExpired means moodle rejected the token, the user has to connect moodle again
+	MoodleExpired = "expired"
+	// MoodleError means moodle couldn't be reached or returned something unexpected the last time the token was checked
+	MoodleError = "error"
+)
+
+// MarshalJSON serializes the user as CleanUser
+func (u User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.GetClean())
+}
+
+type CleanUser struct {
+	ID       ksuid.KSUID `json:"id"`
+	Username string      `json:"username"`
+	Email    string      `json:"email"`
+	Created  UnixTime    `json:"created"`
+	Role     string      `json:"role"`
+	// Privilege is 1 for admins and 0 for everyone else. It is only kept for clients that don't know Role yet.
+	Privilege    int8     `json:"privilege"`
+	Courses      []Course `json:"courses"`
+	MoodleURL    string   `json:"moodle_url"`
+	MoodleUserID int      `json:"moodle_user_id"`
+	// MoodleStatus is one of MoodleNotConnected, MoodleConnected, MoodleExpired and MoodleError
+	MoodleStatus          string `json:"moodle_status"`
+	PasswordResetRequired bool   `json:"password_reset_required"`
+	EmailVerified         bool   `json:"email_verified"`
 }
 
 func (u User) GetClean() CleanUser {
 	return CleanUser{
-		ID:           u.ID,
-		Username:     u.Username,
-		Email:        u.Email,
-		Created:      u.Created,
-		Privilege:    u.Privilege,
-		Courses:      u.Courses,
-		MoodleURL:    u.MoodleURL,
-		MoodleUserID: u.MoodleUserID,
+		ID:                    u.ID,
+		Username:              u.Username,
+		Email:                 u.Email,
+		Created:               u.Created,
+		Role:                  u.Role,
+		Privilege:             u.privilege(),
+		Courses:               u.Courses,
+		MoodleURL:             u.MoodleURL,
+		MoodleUserID:          u.MoodleUserID,
+		MoodleStatus:          u.moodleStatus(),
+		PasswordResetRequired: u.PasswordResetRequired,
+		EmailVerified:         u.EmailVerified,
+	}
+}
+
+// PublicUser is what everyone can see of a user, without anything only the user themselves should know
+type PublicUser struct {
+	ID       ksuid.KSUID `json:"id"`
+	Username string      `json:"username"`
+	Created  UnixTime    `json:"created"`
+	Role     string      `json:"role"`
+	// Privilege is 1 for admins and 0 for everyone else. It is only kept for clients that don't know Role yet.
+	Privilege int8 `json:"privilege"`
+}
+
+func (u User) GetPublic() PublicUser {
+	return PublicUser{
+		ID:        u.ID,
+		Username:  u.Username,
+		Created:   u.Created,
+		Role:      u.Role,
+		Privilege: u.privilege(),
+	}
+}
+
+// moodleStatus is MoodleStatus, taking into account whether moodle is connected at all
+func (u User) moodleStatus() string {
+	switch {
+	case u.MoodleURL == "":
+		return MoodleNotConnected
+	case u.MoodleToken == "":
+		// the token couldn't be decrypted, it has to be replaced just like an expired one
+		return MoodleExpired
+	case u.MoodleStatus == "":
+		return MoodleConnected
+	default:
+		return u.MoodleStatus
 	}
 }
 
@@ -58,44 +122,171 @@ func (a Assignment) GetClean() CleanAssignment {
 		FromMoodle:  a.FromMoodle,
 		DoneBy:      a.DoneBy,
 		DoneByUsers: a.DoneByUsers,
+		DoneAt:      a.DoneAt,
+		AutoDoneBy:  a.AutoDoneBy,
 	}
 }
 
 type Session struct {
-	UID     ksuid.KSUID `json:"uid"`
-	UserID  ksuid.KSUID `json:"user_id"`
-	Created UnixTime    `json:"created"`
+	// UID is the value of the session cookie and must never be sent to anyone else. ID identifies the session
+	// when listing or revoking sessions.
+	UID       ksuid.KSUID `json:"-"`
+	ID        string      `json:"id"`
+	UserID    ksuid.KSUID `json:"user_id"`
+	Created   UnixTime    `json:"created"`
+	UserAgent string      `json:"user_agent"`
+	LastIP    string      `json:"last_ip"`
+	LastSeen  UnixTime    `json:"last_seen"`
+	Current   bool        `json:"current"`
 }
 
 type Assignment struct {
-	UID         ksuid.KSUID `json:"id"`
-	User        User        `json:"user"`
-	Created     UnixTime    `json:"created"`
-	Title       string      `json:"title"`
-	DueDate     UnixTime    `json:"due_date"`
-	Course      int         `json:"course"`
-	FromMoodle  bool        `json:"from_moodle"`
-	DoneBy      []string    `json:"done_by"`
-	DoneByUsers []User      `json:"done_by_users"`
+	UID         ksuid.KSUID         `json:"id"`
+	User        User                `json:"user"`
+	Created     UnixTime            `json:"created"`
+	Title       string              `json:"title"`
+	DueDate     UnixTime            `json:"due_date"`
+	Course      int                 `json:"course"`
+	FromMoodle  bool                `json:"from_moodle"`
+	DoneBy      []string            `json:"done_by"`
+	DoneByUsers []User              `json:"done_by_users"`
+	DoneAt      map[string]UnixTime `json:"done_at"`
+	// AutoDoneBy are the ids of DoneBy that were marked as done because they submitted the assignment on moodle
+	AutoDoneBy []string `json:"auto_done_by"`
+	// MoodleURL is the moodle instance the assignment was imported from, empty for assignments created by users
+	MoodleURL string `json:"-"`
 }
 
 type CleanAssignment struct {
-	UID         ksuid.KSUID `json:"id"`
-	User        CleanUser   `json:"user"`
-	Created     UnixTime    `json:"created"`
-	Title       string      `json:"title"`
-	DueDate     UnixTime    `json:"due_date"`
-	Course      int         `json:"course"`
-	FromMoodle  bool        `json:"from_moodle"`
-	DoneBy      []string    `json:"done_by"`
-	DoneByUsers []User      `json:"done_by_users"`
+	UID         ksuid.KSUID         `json:"id"`
+	User        CleanUser           `json:"user"`
+	Created     UnixTime            `json:"created"`
+	Title       string              `json:"title"`
+	DueDate     UnixTime            `json:"due_date"`
+	Course      int                 `json:"course"`
+	FromMoodle  bool                `json:"from_moodle"`
+	DoneBy      []string            `json:"done_by"`
+	DoneByUsers []User              `json:"done_by_users"`
+	DoneAt      map[string]UnixTime `json:"done_at"`
+	// AutoDoneBy are the ids of DoneBy that were marked as done because they submitted the assignment on moodle
+	AutoDoneBy []string `json:"auto_done_by"`
 }
 
+// privilege returns what the privilege field used to contain before there were roles
+func (u User) privilege() int8 {
+	if u.Role == RoleAdmin {
+		return 1
+	}
+	return 0
+}
+
+// site wide roles of users, see the roles table. They are unrelated to course roles.
+const (
+	RoleStudent   = "student"
+	RoleModerator = "moderator"
+	RoleTeacher   = "teacher"
+	RoleAdmin     = "admin"
+)
+
+// permissions roles can have, see the role_permissions table
+const (
+	// PermissionModerateAssignments allows editing and deleting every assignment
+	PermissionModerateAssignments = "assignments.moderate"
+	PermissionViewContributors    = "contributors.view"
+	PermissionManageRoles         = "roles.manage"
+	PermissionViewAuditLog        = "audit_log.view"
+)
+
+type Role struct {
+	Name        string   `json:"name"`
+	Rank        int      `json:"rank"`
+	Permissions []string `json:"permissions"`
+	// TwoFactorRequired makes users with the role set up two-factor authentication before they can do anything else
+	TwoFactorRequired bool `json:"two_factor_required"`
+}
+
+// RoleChange is an entry of the audit trail of role changes. ChangedBy is empty for changes made on the command line.
+type RoleChange struct {
+	ID        ksuid.KSUID `json:"id"`
+	UserID    ksuid.KSUID `json:"user_id"`
+	ChangedBy string      `json:"changed_by"`
+	OldRole   string      `json:"old_role"`
+	NewRole   string      `json:"new_role"`
+	Reason    string      `json:"reason"`
+	Changed   UnixTime    `json:"changed_at"`
+}
+
+// TwoFactorStatus is whether a user uses two-factor authentication
+type TwoFactorStatus struct {
+	Enabled bool `json:"enabled"`
+	// Required is true if the role of the user requires two-factor authentication
+	Required          bool `json:"required"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+}
+
+// Identity is an account at an OpenID Connect provider that a user can log in with
+type Identity struct {
+	Provider string      `json:"provider"`
+	Subject  string      `json:"-"`
+	UserID   ksuid.KSUID `json:"-"`
+	Email    string      `json:"email"`
+	Created  UnixTime    `json:"created"`
+}
+
+// APIToken is a personal access token. The token itself is only known when it is created, Token is empty otherwise.
+type APIToken struct {
+	ID       ksuid.KSUID `json:"id"`
+	UserID   ksuid.KSUID `json:"-"`
+	Name     string      `json:"name"`
+	Token    string      `json:"token,omitempty"`
+	Scopes   []string    `json:"scopes"`
+	Created  UnixTime    `json:"created"`
+	LastUsed *UnixTime   `json:"last_used"`
+}
+
+// HasScope returns true if the token may be used for routes that require scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopes of personal access tokens, each route that accepts tokens requires one of them
+const (
+	ScopeAssignmentsRead  = "assignments.read"
+	ScopeAssignmentsWrite = "assignments.write"
+	ScopeCoursesRead      = "courses.read"
+)
+
+// ValidScope returns true if scope is one of the scopes above
+func ValidScope(scope string) bool {
+	return scope == ScopeAssignmentsRead || scope == ScopeAssignmentsWrite || scope == ScopeCoursesRead
+}
+
+// roles a user can have in a native course
+const (
+	CourseRoleStudent = "student"
+	CourseRoleHelper  = "helper"
+	CourseRoleTeacher = "teacher"
+)
+
+// ValidCourseRole returns true if role is one of the course roles above
+func ValidCourseRole(role string) bool {
+	return role == CourseRoleStudent || role == CourseRoleHelper || role == CourseRoleTeacher
+}
+
+// Course is either a moodle course or a native one. Native courses have negative ids, moodle courses positive ones.
 type Course struct {
 	ID          interface{}  `json:"id"`
 	Name        string       `json:"name"`
 	Teacher     string       `json:"teacher"`
+	TeacherID   ksuid.KSUID  `json:"teacher_id"`
 	FromMoodle  bool         `json:"from_moodle"`
+	Archived    bool         `json:"archived"`
+	InviteCode  string       `json:"invite_code,omitempty"`
 	Assignments []Assignment `json:"assignments"`
 	User        ksuid.KSUID  `json:"user"`
 }
@@ -104,7 +295,10 @@ type CleanCourse struct {
 	ID          interface{}       `json:"id"`
 	Name        string            `json:"name"`
 	Teacher     string            `json:"teacher"`
+	TeacherID   ksuid.KSUID       `json:"teacher_id"`
 	FromMoodle  bool              `json:"from_moodle"`
+	Archived    bool              `json:"archived"`
+	InviteCode  string            `json:"invite_code,omitempty"`
 	Assignments []CleanAssignment `json:"assignments"`
 	User        ksuid.KSUID       `json:"user"`
 }
@@ -114,7 +308,10 @@ func (c Course) GetClean() CleanCourse {
 		ID:         c.ID,
 		Name:       c.Name,
 		Teacher:    c.Teacher,
+		TeacherID:  c.TeacherID,
 		FromMoodle: c.FromMoodle,
+		Archived:   c.Archived,
+		InviteCode: c.InviteCode,
 		User:       c.User,
 	}
 	cc.Assignments = make([]CleanAssignment, 0)
@@ -125,6 +322,12 @@ func (c Course) GetClean() CleanCourse {
 	return cc
 }
 
+type CourseMember struct {
+	User   CleanUser `json:"user"`
+	Role   string    `json:"role"`
+	Joined UnixTime  `json:"joined"`
+}
+
 type CachedCourse struct {
 	ID ksuid.KSUID `json:"id"`
 	Course
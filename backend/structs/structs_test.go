@@ -0,0 +1,49 @@
+package structs
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUserJSONWithoutSecrets(t *testing.T) {
+	user := User{Username: "someone", PasswordHash: "$2a$10$hash", MoodleToken: "moodle token"}
+
+	for name, value := range map[string]interface{}{
+		"user":       user,
+		"pointer":    &user,
+		"assignment": Assignment{User: user, DoneByUsers: []User{user}},
+	} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatalf("error marshalling %s: %v", name, err)
+		}
+
+		for _, secret := range []string{user.PasswordHash, user.MoodleToken, "PasswordHash", "moodle_token"} {
+			if strings.Contains(string(data), secret) {
+				t.Errorf("%s contains %q: %s", name, secret, data)
+			}
+		}
+		if !strings.Contains(string(data), `"username":"someone"`) {
+			t.Errorf("%s is missing the username: %s", name, data)
+		}
+	}
+}
+
+func TestCleanUserMoodleStatus(t *testing.T) {
+	for _, c := range []struct {
+		user     User
+		expected string
+	}{
+		{User{}, MoodleNotConnected},
+		{User{MoodleURL: "https://moodle.example.com", MoodleToken: "token"}, MoodleConnected},
+		{User{MoodleURL: "https://moodle.example.com", MoodleToken: "token", MoodleStatus: MoodleError}, MoodleError},
+		{User{MoodleURL: "https://moodle.example.com", MoodleToken: "token", MoodleStatus: MoodleExpired}, MoodleExpired},
+		// the token couldn't be decrypted
+		{User{MoodleURL: "https://moodle.example.com", MoodleStatus: MoodleConnected}, MoodleExpired},
+	} {
+		if status := c.user.GetClean().MoodleStatus; status != c.expected {
+			t.Errorf("moodle status of %+v is %q, expected %q", c.user, status, c.expected)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA1 test vectors of RFC 6238 appendix B, cut to 6 digits
+func TestCodeRFC6238(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	for unix, expected := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		got, err := Code(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("error generating code: %v", err)
+		}
+		if got != expected {
+			t.Errorf("code at %d is %s, expected %s", unix, got, expected)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("error generating secret: %v", err)
+	}
+
+	now := time.Now()
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+
+	c, ok := Validate(secret, code, now)
+	if !ok || c != counter(now) {
+		t.Errorf("the current code was not accepted")
+	}
+
+	// a slow phone clock or a code typed in at the end of its period
+	if _, ok := Validate(secret, code, now.Add(Period)); !ok {
+		t.Errorf("the code of the previous period was not accepted")
+	}
+
+	if _, ok := Validate(secret, code, now.Add(3*Period)); ok {
+		t.Errorf("a code from three periods ago was accepted")
+	}
+
+	for _, wrong := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Validate(secret, wrong, now); ok {
+			t.Errorf("%q was accepted", wrong)
+		}
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("JBSWY3DPEHPK3PXP", "homework", "some user")
+
+	if !strings.HasPrefix(uri, "otpauth://totp/homework:some%20user?") {
+		t.Errorf("unexpected label in %s", uri)
+	}
+	for _, param := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=homework", "digits=6", "period=30"} {
+		if !strings.Contains(uri, param) {
+			t.Errorf("%s is missing %s", uri, param)
+		}
+	}
+}
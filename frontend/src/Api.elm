@@ -45,7 +45,7 @@ expectStringButItsJson toMsg decoder =
                     Err NetworkError
 
                 Http.BadStatus_ metadata body ->
-                    case Json.decodeString (Json.at [ "errors" ] (Json.list Json.string)) body of
+                    case Json.decodeString (Json.at [ "errors" ] (Json.list (Json.field "message" Json.string))) body of
                         Ok value ->
                             Err (BadStatus metadata.statusCode value)
 